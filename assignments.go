@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type ScheduleAssignment struct {
+	gorm.Model
+	MaintenanceScheduleID uint                 `gorm:"type:int(10);not null;uniqueIndex:idx_schedule_user" validate:"required"`
+	MaintenanceSchedule   *MaintenanceSchedule `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	UserID                uint                 `gorm:"type:int(10);not null;uniqueIndex:idx_schedule_user;index" validate:"required"`
+	User                  *User                `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	Role                  string               `gorm:"type:ENUM('lead','assistant');not null;default:'lead';column:role" validate:"omitempty,oneof=lead assistant"`
+}
+
+type AssignmentWarning struct {
+	UserID  uint   `json:"user_id"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+type AssignmentResult struct {
+	Assignment ScheduleAssignment  `json:"assignment"`
+	Warnings   []AssignmentWarning `json:"warnings"`
+}
+
+// assignmentWarnings checks a technician against a schedule: other bookings
+// overlapping it, leave, working hours and the skills its maintenance type
+// requires. Problems are reported, not enforced, so planners can override.
+func assignmentWarnings(schedule MaintenanceSchedule, userID uint) ([]AssignmentWarning, error) {
+	var user User
+	if result := db.First(&user, userID); result.Error != nil {
+		return nil, result.Error
+	}
+	start := schedule.ScheduledAt
+	end := start.Add(time.Duration(schedule.DurationMinutes) * time.Minute)
+	loc := newZones().forUser(user)
+
+	warnings := []AssignmentWarning{}
+	bookings, err := userBookings(db, userID, start, end, schedule.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bookings {
+		warnings = append(warnings, AssignmentWarning{UserID: userID, Kind: "double_booked",
+			Message: fmt.Sprintf("user %d is already booked on schedule %d at %s", userID, b.ID, b.ScheduledAt.In(loc).Format(time.RFC3339))})
+	}
+
+	leave, err := userLeave(userID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range leave {
+		warnings = append(warnings, AssignmentWarning{UserID: userID, Kind: "on_leave",
+			Message: fmt.Sprintf("user %d is on %s leave until %s", userID, l.Kind, l.EndsAt.In(loc).Format(time.RFC3339))})
+	}
+
+	working, hasCalendar, err := userWorkingTime(user, start, end, loc, nil)
+	if err != nil {
+		return nil, err
+	}
+	if hasCalendar && len(leave) == 0 {
+		covered := len(working) == 1 && working[0].Start.Equal(start) && working[0].End.Equal(end)
+		if !covered {
+			warnings = append(warnings, AssignmentWarning{UserID: userID, Kind: "outside_shift",
+				Message: fmt.Sprintf("schedule %d falls outside the working hours of user %d", schedule.ID, userID)})
+		}
+	}
+
+	skills, err := missingSkills(userID, schedule.MaintenanceTypeID, start)
+	if err != nil {
+		return nil, err
+	}
+	return append(warnings, skills...), nil
+}
+
+// scheduleConflicts checks every technician assigned to a schedule.
+func scheduleConflicts(schedule MaintenanceSchedule) ([]AssignmentWarning, error) {
+	var assignments []ScheduleAssignment
+	if result := db.Where("maintenance_schedule_id = ?", schedule.ID).Find(&assignments); result.Error != nil {
+		return nil, result.Error
+	}
+	warnings := []AssignmentWarning{}
+	for _, a := range assignments {
+		found, err := assignmentWarnings(schedule, a.UserID)
+		if err != nil {
+			return nil, err
+		}
+		warnings = append(warnings, found...)
+	}
+	return warnings, nil
+}
+
+func scheduleAssignHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var schedule MaintenanceSchedule
+	result := db.First(&schedule, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	body, err := Reader(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	var data ScheduleAssignment
+	if err = decodeJSON(body, &data); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	data.MaintenanceScheduleID = schedule.ID
+
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
+		return
+	}
+
+	warnings, err := assignmentWarnings(schedule, data.UserID)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	result = db.Create(&data)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	assignmentID := strconv.FormatUint(uint64(data.ID), 10)
+	recordChildAudit(r, ScheduleAssignmentsTable, assignmentID, "create", nil, auditSnapshot(db, ScheduleAssignmentsTable, assignmentID))
+
+	msg := fmt.Sprintf("user %d assigned to maintenance schedule %s", data.UserID, id)
+	if len(warnings) > 0 {
+		msg = fmt.Sprintf("%s with %d warnings", msg, len(warnings))
+	}
+	responseWithJSON(w, http.StatusOK, AssignmentResult{Assignment: data, Warnings: warnings}, msg)
+	return
+}
+
+func scheduleAssigneesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var data []ScheduleAssignment
+	result := db.Where("maintenance_schedule_id = ?", id).Order("id").Find(&data)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, data, "maintenance schedule assignees read")
+	return
+}
+
+func scheduleUnassignHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	userID, err := pathID(r, "userId")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var assignment ScheduleAssignment
+	result := db.Where("maintenance_schedule_id = ? AND user_id = ?", id, userID).Limit(1).Find(&assignment)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		responseWithMsg(w, http.StatusNotFound, fmt.Sprintf("user %s is not assigned to maintenance schedule %s", userID, id))
+		return
+	}
+	assignmentID := strconv.FormatUint(uint64(assignment.ID), 10)
+	before := auditSnapshot(db, ScheduleAssignmentsTable, assignmentID)
+	if result = db.Unscoped().Delete(&assignment); result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	recordChildAudit(r, ScheduleAssignmentsTable, assignmentID, "delete", before, nil)
+
+	responseWithMsg(w, http.StatusOK, fmt.Sprintf("user %s unassigned from maintenance schedule %s", userID, id))
+	return
+}
+
+func scheduleConflictsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var schedule MaintenanceSchedule
+	result := db.First(&schedule, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	warnings, err := scheduleConflicts(schedule)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, warnings, fmt.Sprintf("%d conflicts on maintenance schedule %s", len(warnings), id))
+	return
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/go-chi/chi/v5/middleware"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every successful write through the API is recorded in the audit log with
+// who made it, what it touched and how each field changed. Entries are chained
+// by hash: each one covers its own content and the hash of the entry before
+// it, so editing or removing any entry breaks the chain from there on and
+// shows up in /audit-logs/verify.
+
+const auditGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// maxAuditResponseBytes bounds how much of a response is kept to find the id
+// of a record it created.
+const maxAuditResponseBytes = 1 << 20
+
+type AuditLog struct {
+	ID        uint                   `gorm:"primarykey"`
+	CreatedAt time.Time              `gorm:"not null;index"`
+	ActorID   *uint                  `gorm:"type:int(10);index;default:NULL"`
+	Resource  string                 `gorm:"type:varchar(50);not null;index:idx_audit_record"`
+	RecordID  *uint                  `gorm:"type:int(10);index:idx_audit_record;default:NULL"`
+	Action    string                 `gorm:"type:varchar(100);not null"`
+	RequestID string                 `gorm:"type:varchar(100)"`
+	Changes   string                 `gorm:"type:longtext;not null" json:"-"`
+	PrevHash  string                 `gorm:"type:char(64);not null"`
+	Hash      string                 `gorm:"type:char(64);not null;uniqueIndex"`
+	Diff      map[string]AuditChange `gorm:"-"`
+}
+
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type AuditVerification struct {
+	Valid      bool   `json:"valid"`
+	Checked    int    `json:"checked"`
+	BrokenAt   *uint  `json:"broken_at,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Unrecorded int64  `json:"unrecorded,omitempty"`
+}
+
+// chainHash covers everything an entry records together with the hash of the
+// entry before it.
+func (a *AuditLog) chainHash() string {
+	optional := func(id *uint) string {
+		if id == nil {
+			return ""
+		}
+		return strconv.FormatUint(uint64(*id), 10)
+	}
+	hash := sha256.New()
+	for _, part := range []string{
+		a.PrevHash,
+		strconv.FormatInt(a.CreatedAt.UTC().Unix(), 10),
+		optional(a.ActorID),
+		a.Resource,
+		optional(a.RecordID),
+		a.Action,
+		a.RequestID,
+		a.Changes,
+	} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (a *AuditLog) decode() error {
+	if a.Changes == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(a.Changes), &a.Diff)
+}
+
+var auditMu sync.Mutex
+
+// appendAudit links the entry to the end of the chain and stores it. The
+// last entry is locked so concurrent writers cannot fork the chain.
+func appendAudit(entry *AuditLog) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	encoded, err := json.Marshal(entry.Diff)
+	if err != nil {
+		return err
+	}
+	entry.Changes = string(encoded)
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var last AuditLog
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Order("id DESC").Limit(1).Find(&last)
+		if result.Error != nil {
+			return result.Error
+		}
+		entry.PrevHash = auditGenesisHash
+		if result.RowsAffected > 0 {
+			entry.PrevHash = last.Hash
+		}
+		// Whole seconds survive any datetime precision, so the hash can be
+		// recomputed from what is read back.
+		entry.CreatedAt = time.Now().UTC().Truncate(time.Second)
+		entry.Hash = entry.chainHash()
+		return tx.Create(entry).Error
+	})
+}
+
+// auditSnapshot reads a record, trashed or not, as the API shows it. Records
+// that do not exist have no snapshot.
+func auditSnapshot(tx *gorm.DB, t Tables, id string) map[string]interface{} {
+	record := t.Struct()
+	if result := tx.Unscoped().First(record, id); result.Error != nil {
+		return nil
+	}
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return nil
+	}
+	var snapshot map[string]interface{}
+	if json.Unmarshal(encoded, &snapshot) != nil {
+		return nil
+	}
+	return snapshot
+}
+
+// auditDiff lists the fields whose value differs between two snapshots.
+// updated_at is left out as it changes on every write.
+func auditDiff(before, after map[string]interface{}) map[string]AuditChange {
+	diff := map[string]AuditChange{}
+	for _, snapshot := range []map[string]interface{}{before, after} {
+		for field := range snapshot {
+			if field == "updated_at" {
+				continue
+			}
+			if _, seen := diff[field]; seen || reflect.DeepEqual(before[field], after[field]) {
+				continue
+			}
+			diff[field] = AuditChange{Before: before[field], After: after[field]}
+		}
+	}
+	return diff
+}
+
+// requestTarget works out from the path which record a request is aimed at:
+// PUT /equipment/4 targets equipment 4 itself while POST /equipment/4/status
+// is a "status" action on it. Requests to the trash target the trashed
+// resource.
+type requestTarget struct {
+	table  Tables
+	id     string
+	action string
+	trash  bool
+}
+
+var targetAliases = map[string]Tables{
+	"images":  ImageAttachmentsTable,
+	"planner": MaintenancePlansTable,
+}
+
+func requestTargetOf(r *http.Request) (requestTarget, bool) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	trash := segments[0] == "trash" && len(segments) > 1
+	if trash {
+		segments = segments[1:]
+	}
+
+	table, ok := tableNamed(segments[0])
+	if !ok {
+		if table, ok = targetAliases[segments[0]]; !ok {
+			return requestTarget{}, false
+		}
+	}
+	rest := segments[1:]
+	if table == MaintenancePlansTable && len(rest) > 0 && rest[0] == "plans" {
+		rest = rest[1:]
+	}
+
+	target := requestTarget{table: table, action: strings.Join(rest, "/"), trash: trash}
+	if len(rest) > 0 {
+		if _, err := strconv.ParseUint(rest[0], 10, 64); err == nil {
+			target.id = rest[0]
+			target.action = strings.Join(rest[1:], "/")
+		}
+	}
+	return target, true
+}
+
+// auditAction names what a write does, its action path when it has one.
+func auditAction(r *http.Request, target requestTarget) string {
+	switch {
+	case target.action != "":
+		return target.action
+	case r.Method == http.MethodPost:
+		return "create"
+	case r.Method == http.MethodDelete && target.trash:
+		return "purge"
+	case r.Method == http.MethodDelete:
+		return "delete"
+	default:
+		return "update"
+	}
+}
+
+// requestActor reads the acting user from the X-User-ID header. Writes without
+// it are recorded without an actor.
+func requestActor(r *http.Request) (*uint, error) {
+	raw := r.Header.Get("X-User-ID")
+	if raw == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil || id == 0 {
+		return nil, withStatus(http.StatusBadRequest, errors.New("X-User-ID must be the id of a user"))
+	}
+	var count int64
+	if result := db.Model(&User{}).Where("id = ?", id).Count(&count); result.Error != nil {
+		return nil, result.Error
+	}
+	if count == 0 {
+		return nil, withStatus(http.StatusBadRequest, fmt.Errorf("X-User-ID %d is not a user", id))
+	}
+	actor := uint(id)
+	return &actor, nil
+}
+
+// createdID picks the id of the record a create answered with.
+func createdID(body []byte) string {
+	var response struct {
+		Data struct {
+			ID uint `json:"id"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(body, &response) != nil || response.Data.ID == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(response.Data.ID), 10)
+}
+
+// auditRecorder passes a response through while remembering its status and
+// the start of its body.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (a *auditRecorder) WriteHeader(status int) {
+	a.status = status
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditRecorder) Write(p []byte) (int, error) {
+	if room := maxAuditResponseBytes - a.body.Len(); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		a.body.Write(p[:room])
+	}
+	return a.ResponseWriter.Write(p)
+}
+
+// auditScope carries the acting user of a write to its handler, and lets a
+// handler that recorded its writes itself stop auditTrail from recording the
+// request again.
+type auditScope struct {
+	actorID  *uint
+	recorded bool
+}
+
+type auditScopeKey struct{}
+
+// auditTrail records every successful write. The response has already been
+// sent by the time the entry is stored, so a failure to store it is logged
+// rather than reported to the client.
+func auditTrail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// batches record an entry per item themselves
+		target, ok := requestTargetOf(r)
+		if !ok || (target.id == "" && target.action == "bulk") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		actorID, err := requestActor(r)
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+
+		var before map[string]interface{}
+		if target.id != "" {
+			before = auditSnapshot(db, target.table, target.id)
+		}
+
+		scope := &auditScope{actorID: actorID}
+		recorder := &auditRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditScopeKey{}, scope)))
+		if recorder.status >= http.StatusBadRequest || scope.recorded {
+			return
+		}
+
+		id := target.id
+		if id == "" {
+			id = createdID(recorder.body.Bytes())
+		}
+		var after map[string]interface{}
+		if id != "" {
+			after = auditSnapshot(db, target.table, id)
+		}
+		recordAudit(middleware.GetReqID(r.Context()), actorID, target.table, id, auditAction(r, target), before, after)
+	})
+}
+
+// auditFailures counts the writes since startup whose entry could not be
+// stored even after retrying. The chain still verifies without them, so the
+// count is published with expvar and reported by /audit-logs/verify.
+var auditFailures = expvar.NewInt("audit_failures")
+
+// auditRetryDelays spaces out the attempts to store an entry, to ride out a
+// lock wait timeout or a dropped connection.
+var auditRetryDelays = []time.Duration{100 * time.Millisecond, 500 * time.Millisecond, 2 * time.Second}
+
+// recordAudit stores the entry for one write, given the record as it was
+// before and after it. As the write has already been made, a failure is
+// retried in the background, so the request does not wait out the delays
+// while it holds its record lock, and then logged and counted in
+// auditFailures.
+func recordAudit(requestID string, actorID *uint, t Tables, id, action string, before, after map[string]interface{}) {
+	entry := AuditLog{
+		ActorID:   actorID,
+		Resource:  t.String(),
+		Action:    action,
+		RequestID: requestID,
+	}
+	if id != "" {
+		parsed, _ := strconv.ParseUint(id, 10, 64)
+		recordID := uint(parsed)
+		entry.RecordID = &recordID
+	}
+	entry.Diff = auditDiff(before, after)
+
+	if err := appendAudit(&entry); err != nil {
+		go retryAudit(entry, err)
+	}
+}
+
+func retryAudit(entry AuditLog, err error) {
+	for _, delay := range auditRetryDelays {
+		time.Sleep(delay)
+		if err = appendAudit(&entry); err == nil {
+			return
+		}
+	}
+	auditFailures.Add(1)
+	log.Printf("audit %s %s failed: %v", entry.Action, entry.Resource, err)
+}
+
+// recordChildAudit records a write a handler made to a record other than the
+// one its path names, such as the time entry started by
+// POST /maintenance-history/{id}/time-entries/start, in place of the entry
+// auditTrail would have recorded against the path's record.
+func recordChildAudit(r *http.Request, t Tables, id, action string, before, after map[string]interface{}) {
+	scope, ok := r.Context().Value(auditScopeKey{}).(*auditScope)
+	if !ok {
+		return
+	}
+	scope.recorded = true
+	recordAudit(middleware.GetReqID(r.Context()), scope.actorID, t, id, action, before, after)
+}
+
+// recordRelatedAudit records a write a handler made besides the one to the
+// record its path names, such as the schedules created by committing a plan.
+// auditTrail still records the path's record.
+func recordRelatedAudit(r *http.Request, t Tables, id, action string, before, after map[string]interface{}) {
+	scope, ok := r.Context().Value(auditScopeKey{}).(*auditScope)
+	if !ok {
+		return
+	}
+	recordAudit(middleware.GetReqID(r.Context()), scope.actorID, t, id, action, before, after)
+}
+
+func auditLogReadHandler(w http.ResponseWriter, r *http.Request) {
+	query := db.Order("id DESC")
+	if v := r.URL.Query().Get("resource"); v != "" {
+		t, ok := tableNamed(v)
+		if !ok {
+			responseWithError(w, r, &HTTPError{Status: http.StatusBadRequest, Field: "resource", Err: fmt.Errorf("there is no resource named %s", v)})
+			return
+		}
+		query = query.Where("resource = ?", t.String())
+	}
+	if v := r.URL.Query().Get("record_id"); v != "" {
+		query = query.Where("record_id = ?", v)
+	}
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		query = query.Where("actor_id = ?", v)
+	}
+	if v := r.URL.Query().Get("action"); v != "" {
+		query = query.Where("action = ?", v)
+	}
+
+	loc, err := loadZone(r.URL.Query().Get("tz"))
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	for _, bound := range []struct{ param, condition string }{{"from", "created_at >= ?"}, {"to", "created_at < ?"}} {
+		v := r.URL.Query().Get(bound.param)
+		if v == "" {
+			continue
+		}
+		at, err := parseLocalTime(v, loc)
+		if err != nil {
+			responseWithError(w, r, &HTTPError{Status: http.StatusBadRequest, Field: bound.param, Err: fmt.Errorf("%s %s", bound.param, err.Error())})
+			return
+		}
+		query = query.Where(bound.condition, at.UTC())
+	}
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 1000 {
+			responseWithError(w, r, &HTTPError{Status: http.StatusBadRequest, Field: "limit", Err: errors.New("limit must be between 1 and 1000")})
+			return
+		}
+	}
+
+	var data []AuditLog
+	result := query.Limit(limit).Find(&data)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	for i := range data {
+		if err := data[i].decode(); err != nil {
+			responseWithError(w, r, withStatus(http.StatusInternalServerError, err))
+			return
+		}
+	}
+
+	responseWithJSON(w, http.StatusOK, data, "audit log read")
+	return
+}
+
+func auditLogReadOneHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var data AuditLog
+	result := db.First(&data, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	if err = data.decode(); err != nil {
+		responseWithError(w, r, withStatus(http.StatusInternalServerError, err))
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, data, "audit log entry read")
+	return
+}
+
+// auditLogVerifyHandler walks the whole chain and reports the first entry
+// whose hash or link to its predecessor does not add up.
+func auditLogVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	report := AuditVerification{Valid: true, Unrecorded: auditFailures.Value()}
+	previous := auditGenesisHash
+
+	var batch []AuditLog
+	result := db.FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			entry := &batch[i]
+			switch {
+			case entry.PrevHash != previous:
+				report.Reason = "the entry before it was changed or removed"
+			case entry.chainHash() != entry.Hash:
+				report.Reason = "its content does not match its hash"
+			default:
+				previous = entry.Hash
+				report.Checked++
+				continue
+			}
+			brokenAt := entry.ID
+			report.Valid = false
+			report.BrokenAt = &brokenAt
+			return errAuditBroken
+		}
+		return nil
+	})
+	if result.Error != nil && !errors.Is(result.Error, errAuditBroken) {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	msg := fmt.Sprintf("audit chain of %d entries verified", report.Checked)
+	if !report.Valid {
+		msg = fmt.Sprintf("audit chain broken at entry %d", *report.BrokenAt)
+	}
+	if report.Unrecorded > 0 {
+		msg = fmt.Sprintf("%s, %d writes since startup could not be recorded", msg, report.Unrecorded)
+	}
+	responseWithJSON(w, http.StatusOK, report, msg)
+	return
+}
+
+var errAuditBroken = errors.New("audit chain broken")
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// WorkShift is a weekly recurring working window of a user, in the user's
+// timezone. An EndTime at or before StartTime runs past midnight.
+type WorkShift struct {
+	gorm.Model
+	UserID    uint   `gorm:"type:int(10);index;not null" validate:"required"`
+	User      *User  `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	Weekday   int    `gorm:"type:int(10);not null" validate:"gte=0,lte=6"`
+	StartTime string `gorm:"type:char(5);not null" validate:"required,datetime=15:04"`
+	EndTime   string `gorm:"type:char(5);not null" validate:"required,datetime=15:04"`
+}
+
+type Leave struct {
+	gorm.Model
+	UserID   uint      `gorm:"type:int(10);index;not null" validate:"required"`
+	User     *User     `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	Kind     string    `gorm:"type:ENUM('vacation','sick','training','other');not null;default:'vacation';column:kind" validate:"omitempty,oneof=vacation sick training other"`
+	StartsAt time.Time `gorm:"not null;index" validate:"required"`
+	EndsAt   time.Time `gorm:"not null;index" validate:"required,gtfield=StartsAt"`
+	Note     string    `gorm:"type:varchar(500)" validate:"max=500"`
+}
+
+type Interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type Availability struct {
+	UserID             uint                  `json:"user_id"`
+	Timezone           string                `json:"timezone"`
+	HasWorkingCalendar bool                  `json:"has_working_calendar"`
+	Available          []Interval            `json:"available"`
+	Leave              []Leave               `json:"leave"`
+	Bookings           []MaintenanceSchedule `json:"bookings"`
+}
+
+func clockOn(day time.Time, clock string) time.Time {
+	t, _ := time.Parse("15:04", clock)
+	return time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), 0, 0, day.Location())
+}
+
+// shiftIntervals expands weekly shifts into concrete intervals within
+// [from, to), in loc.
+func shiftIntervals(shifts []WorkShift, from, to time.Time, loc *time.Location) []Interval {
+	var intervals []Interval
+	start := from.In(loc).AddDate(0, 0, -1)
+	for day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+		for _, shift := range shifts {
+			if time.Weekday(shift.Weekday) != day.Weekday() {
+				continue
+			}
+			begin, end := clockOn(day, shift.StartTime), clockOn(day, shift.EndTime)
+			if !end.After(begin) {
+				end = clockOn(day.AddDate(0, 0, 1), shift.EndTime)
+			}
+			if begin.Before(from) {
+				begin = from
+			}
+			if end.After(to) {
+				end = to
+			}
+			if end.After(begin) {
+				intervals = append(intervals, Interval{Start: begin, End: end})
+			}
+		}
+	}
+	return mergeIntervals(intervals)
+}
+
+func mergeIntervals(intervals []Interval) []Interval {
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].Start.Before(intervals[j].Start) })
+	var merged []Interval
+	for _, in := range intervals {
+		if n := len(merged); n > 0 && !in.Start.After(merged[n-1].End) {
+			if in.End.After(merged[n-1].End) {
+				merged[n-1].End = in.End
+			}
+			continue
+		}
+		merged = append(merged, in)
+	}
+	return merged
+}
+
+// subtractIntervals removes every interval in cut from base.
+func subtractIntervals(base, cut []Interval) []Interval {
+	result := base
+	for _, c := range cut {
+		var next []Interval
+		for _, b := range result {
+			if !c.Start.Before(b.End) || !c.End.After(b.Start) {
+				next = append(next, b)
+				continue
+			}
+			if c.Start.After(b.Start) {
+				next = append(next, Interval{Start: b.Start, End: c.Start})
+			}
+			if c.End.Before(b.End) {
+				next = append(next, Interval{Start: c.End, End: b.End})
+			}
+		}
+		result = next
+	}
+	return result
+}
+
+func userLeave(userID uint, from, to time.Time) ([]Leave, error) {
+	var leave []Leave
+	result := db.Where("user_id = ? AND starts_at < ? AND ends_at > ?", userID, to, from).Order("starts_at").Find(&leave)
+	return leave, result.Error
+}
+
+// userBookings returns the schedules assigned to a user that overlap the
+// range, leaving out the one being checked.
+func userBookings(tx *gorm.DB, userID uint, from, to time.Time, exceptScheduleID uint) ([]MaintenanceSchedule, error) {
+	var schedules []MaintenanceSchedule
+	result := tx.Where("id IN (?)", tx.Table(ScheduleAssignmentsTable.String()).Select("maintenance_schedule_id").Where("user_id = ?", userID)).
+		Where("id <> ? AND scheduled_at < ?", exceptScheduleID, to).
+		Where("DATE_ADD(scheduled_at, INTERVAL duration_minutes MINUTE) > ?", from).
+		Order("scheduled_at").
+		Find(&schedules)
+	return schedules, result.Error
+}
+
+// userWorkingTime returns when a user works within the range, leave taken
+// out. Users without shifts have no working calendar; for them the fallback
+// shifts apply, or the whole range when there are none, and hasCalendar is
+// false.
+func userWorkingTime(user User, from, to time.Time, loc *time.Location, fallback []WorkShift) (intervals []Interval, hasCalendar bool, err error) {
+	var shifts []WorkShift
+	if result := db.Where("user_id = ?", user.ID).Find(&shifts); result.Error != nil {
+		return nil, false, result.Error
+	}
+	hasCalendar = len(shifts) > 0
+	if !hasCalendar {
+		shifts = fallback
+	}
+	intervals = []Interval{{Start: from, End: to}}
+	if len(shifts) > 0 {
+		intervals = shiftIntervals(shifts, from, to, loc)
+	}
+
+	leave, err := userLeave(user.ID, from, to)
+	if err != nil {
+		return nil, false, err
+	}
+	var off []Interval
+	for _, l := range leave {
+		off = append(off, Interval{Start: l.StartsAt, End: l.EndsAt})
+	}
+	return subtractIntervals(intervals, off), hasCalendar, nil
+}
+
+func userAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var user User
+	result := db.First(&user, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	loc := zones.forUser(user)
+	if zones.override != nil {
+		loc = zones.override
+	}
+	from, to, err := rangeParams(r, loc, 7)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	data := Availability{UserID: user.ID, Timezone: loc.String()}
+	available, hasCalendar, err := userWorkingTime(user, from, to, loc, nil)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if data.Leave, err = userLeave(user.ID, from, to); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if data.Bookings, err = userBookings(db, user.ID, from, to, 0); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	var booked []Interval
+	for i, s := range data.Bookings {
+		booked = append(booked, Interval{Start: s.ScheduledAt, End: s.ScheduledAt.Add(time.Duration(s.DurationMinutes) * time.Minute)})
+		data.Bookings[i].localize(loc)
+	}
+	data.HasWorkingCalendar = hasCalendar
+	data.Available = []Interval{}
+	for _, in := range subtractIntervals(available, booked) {
+		data.Available = append(data.Available, Interval{Start: in.Start.In(loc), End: in.End.In(loc)})
+	}
+	for i := range data.Leave {
+		data.Leave[i].StartsAt = data.Leave[i].StartsAt.In(loc)
+		data.Leave[i].EndsAt = data.Leave[i].EndsAt.In(loc)
+	}
+
+	responseWithJSON(w, http.StatusOK, data, fmt.Sprintf("availability of user %s read", id))
+	return
+}
+
+func workShiftCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if Create(w, r, WorkShiftsTable) {
+		fmt.Println("work shift created")
+		return
+	}
+	fmt.Println("work shift not created")
+	return
+}
+
+func workShiftReadHandler(w http.ResponseWriter, r *http.Request) {
+	if Read(w, r, WorkShiftsTable) {
+		fmt.Println("work shifts read")
+		return
+	}
+	fmt.Println("work shifts not read")
+	return
+}
+
+func workShiftReadOneHandler(w http.ResponseWriter, r *http.Request) {
+	if ReadOne(w, r, WorkShiftsTable) {
+		fmt.Println("work shift read")
+		return
+	}
+	fmt.Println("work shift not read")
+	return
+}
+
+func workShiftUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if Update(w, r, WorkShiftsTable) {
+		fmt.Println("work shift updated")
+		return
+	}
+	fmt.Println("work shift not updated")
+	return
+}
+
+func workShiftDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if Delete(w, r, WorkShiftsTable) {
+		fmt.Println("work shift deleted")
+		return
+	}
+	fmt.Println("work shift not deleted")
+	return
+}
+
+func leaveCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if Create(w, r, LeavesTable) {
+		fmt.Println("leave created")
+		return
+	}
+	fmt.Println("leave not created")
+	return
+}
+
+func leaveReadHandler(w http.ResponseWriter, r *http.Request) {
+	if Read(w, r, LeavesTable) {
+		fmt.Println("leaves read")
+		return
+	}
+	fmt.Println("leaves not read")
+	return
+}
+
+func leaveReadOneHandler(w http.ResponseWriter, r *http.Request) {
+	if ReadOne(w, r, LeavesTable) {
+		fmt.Println("leave read")
+		return
+	}
+	fmt.Println("leave not read")
+	return
+}
+
+func leaveUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if Update(w, r, LeavesTable) {
+		fmt.Println("leave updated")
+		return
+	}
+	fmt.Println("leave not updated")
+	return
+}
+
+func leaveDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if Delete(w, r, LeavesTable) {
+		fmt.Println("leave deleted")
+		return
+	}
+	fmt.Println("leave not deleted")
+	return
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5/middleware"
+	jsoniter "github.com/json-iterator/go"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Every resource takes batches at /<resource>/bulk: POST creates the records
+// in an array, PUT updates records that carry their id and DELETE trashes the
+// records whose ids it lists. Each item goes through the same validation and
+// rules as a single write and is answered with its own status and problem.
+// A batch is atomic by default: when any item fails none is kept, and the
+// items that had succeeded answer 424. With ?mode=best-effort every item is
+// written on its own and the ones that succeed are kept. Update and delete
+// items may carry the ETag they were read at in if_match.
+
+const (
+	bulkAtomic     = "atomic"
+	bulkBestEffort = "best-effort"
+)
+
+type BulkItemResult struct {
+	Index  int         `json:"index"`
+	ID     uint        `json:"id,omitempty"`
+	Status int         `json:"status"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  *Problem    `json:"error,omitempty"`
+}
+
+type BulkResult struct {
+	Mode       string           `json:"mode"`
+	Succeeded  int              `json:"succeeded"`
+	Failed     int              `json:"failed"`
+	RolledBack bool             `json:"rolled_back"`
+	Items      []BulkItemResult `json:"items"`
+}
+
+// bulkWriter creates and updates one record of a resource from its JSON,
+// returning the record as it should be answered.
+type bulkWriter struct {
+	create func(tx *gorm.DB, zones *zoneResolver, item []byte) (interface{}, error)
+	update func(tx *gorm.DB, zones *zoneResolver, id string, item []byte) (interface{}, error)
+}
+
+// decodeItem reads an item into a record and validates it.
+func decodeItem(item []byte, data interface{}) error {
+	if err := decodeJSON(item, data); err != nil {
+		return err
+	}
+	if validationErrors := Validate(data); len(validationErrors) > 0 {
+		return validationErrors
+	}
+	return nil
+}
+
+// genericWriter writes resources that have no rules beyond validation.
+func genericWriter(t Tables) bulkWriter {
+	return bulkWriter{
+		create: func(tx *gorm.DB, zones *zoneResolver, item []byte) (interface{}, error) {
+			data := t.Struct()
+			if err := decodeItem(item, data); err != nil {
+				return nil, err
+			}
+			return data, tx.Create(data).Error
+		},
+		update: func(tx *gorm.DB, zones *zoneResolver, id string, item []byte) (interface{}, error) {
+			data := t.Struct()
+			if result := tx.First(data, id); result.Error != nil {
+				return nil, result.Error
+			}
+			if err := decodeItem(item, data); err != nil {
+				return nil, err
+			}
+			return data, tx.Save(data).Error
+		},
+	}
+}
+
+// bulkWriters hold the resources whose single writes do more than store the
+// record, so that a batch follows the same rules.
+var bulkWriters = map[Tables]bulkWriter{
+	EquipmentTable: {
+		create: func(tx *gorm.DB, zones *zoneResolver, item []byte) (interface{}, error) {
+			var data Equipment
+			if err := decodeItem(item, &data); err != nil {
+				return nil, err
+			}
+			return &data, createEquipment(tx, &data)
+		},
+		update: func(tx *gorm.DB, zones *zoneResolver, id string, item []byte) (interface{}, error) {
+			var data Equipment
+			if result := tx.First(&data, id); result.Error != nil {
+				return nil, result.Error
+			}
+			previousStatus := data.Status
+			previousTag := data.AssetTag
+			if err := decodeItem(item, &data); err != nil {
+				return nil, err
+			}
+			return &data, saveEquipment(tx, &data, previousStatus, previousTag)
+		},
+	},
+	InventoryTable: {
+		create: func(tx *gorm.DB, zones *zoneResolver, item []byte) (interface{}, error) {
+			var data Inventory
+			if err := decodeItem(item, &data); err != nil {
+				return nil, err
+			}
+			return &data, createInventory(tx, &data)
+		},
+		update: func(tx *gorm.DB, zones *zoneResolver, id string, item []byte) (interface{}, error) {
+			var data Inventory
+			if result := tx.First(&data, id); result.Error != nil {
+				return nil, result.Error
+			}
+			previousTag := data.AssetTag
+			if err := decodeItem(item, &data); err != nil {
+				return nil, err
+			}
+			return &data, saveInventory(tx, &data, previousTag)
+		},
+	},
+	EquipmentDocsTable: {
+		create: genericWriter(EquipmentDocsTable).create,
+		update: func(tx *gorm.DB, zones *zoneResolver, id string, item []byte) (interface{}, error) {
+			var data EquipmentDoc
+			if result := tx.First(&data, id); result.Error != nil {
+				return nil, result.Error
+			}
+			currentVersion := data.CurrentVersion
+			if err := decodeJSON(item, &data); err != nil {
+				return nil, err
+			}
+			data.keepVersion(currentVersion)
+			if validationErrors := Validate(data); len(validationErrors) > 0 {
+				return nil, validationErrors
+			}
+			return &data, tx.Save(&data).Error
+		},
+	},
+	MaintenanceHistoryTable: {
+		create: func(tx *gorm.DB, zones *zoneResolver, item []byte) (interface{}, error) {
+			item, err := localizeBody(item, zones.ownerOf(equipmentIDInBody(item, 0)), "performed_at")
+			if err != nil {
+				return nil, err
+			}
+			var data MaintenanceHistory
+			if err = decodeItem(item, &data); err != nil {
+				return nil, err
+			}
+			if err = createMaintenanceHistory(tx, &data); err != nil {
+				return nil, err
+			}
+			data.localize(zones.forEquipment(data.EquipmentID))
+			return &data, nil
+		},
+		update: func(tx *gorm.DB, zones *zoneResolver, id string, item []byte) (interface{}, error) {
+			var data MaintenanceHistory
+			if result := tx.First(&data, id); result.Error != nil {
+				return nil, result.Error
+			}
+			item, err := localizeBody(item, zones.ownerOf(equipmentIDInBody(item, data.EquipmentID)), "performed_at")
+			if err != nil {
+				return nil, err
+			}
+			if err = decodeItem(item, &data); err != nil {
+				return nil, err
+			}
+			if err = saveMaintenanceHistory(tx, &data); err != nil {
+				return nil, err
+			}
+			data.localize(zones.forEquipment(data.EquipmentID))
+			return &data, nil
+		},
+	},
+	MaintenancePartsUsageTable: {
+		create: func(tx *gorm.DB, zones *zoneResolver, item []byte) (interface{}, error) {
+			var data MaintenancePartsUsage
+			if err := decodeItem(item, &data); err != nil {
+				return nil, err
+			}
+			return &data, createMaintenancePartsUsage(tx, &data)
+		},
+		update: func(tx *gorm.DB, zones *zoneResolver, id string, item []byte) (interface{}, error) {
+			var data MaintenancePartsUsage
+			if result := tx.First(&data, id); result.Error != nil {
+				return nil, result.Error
+			}
+			previousHistoryID := data.MaintenanceHistoryID
+			previousInventoryID := data.InventoryID
+			if err := decodeItem(item, &data); err != nil {
+				return nil, err
+			}
+			return &data, saveMaintenancePartsUsage(tx, &data, previousHistoryID, previousInventoryID)
+		},
+	},
+	MaintenanceScheduleTable: {
+		create: func(tx *gorm.DB, zones *zoneResolver, item []byte) (interface{}, error) {
+			item, err := localizeBody(item, zones.ownerOf(equipmentIDInBody(item, 0)), "scheduled_at")
+			if err != nil {
+				return nil, err
+			}
+			var data MaintenanceSchedule
+			if err = decodeItem(item, &data); err != nil {
+				return nil, err
+			}
+			if err = createMaintenanceSchedule(tx, &data); err != nil {
+				return nil, err
+			}
+			data.localize(zones.forEquipment(data.EquipmentID))
+			return &data, nil
+		},
+		update: func(tx *gorm.DB, zones *zoneResolver, id string, item []byte) (interface{}, error) {
+			var data MaintenanceSchedule
+			if result := tx.First(&data, id); result.Error != nil {
+				return nil, result.Error
+			}
+			item, err := localizeBody(item, zones.ownerOf(equipmentIDInBody(item, data.EquipmentID)), "scheduled_at")
+			if err != nil {
+				return nil, err
+			}
+			if err = decodeItem(item, &data); err != nil {
+				return nil, err
+			}
+			if err = saveMaintenanceSchedule(tx, &data); err != nil {
+				return nil, err
+			}
+			if data.Warnings, err = scheduleConflicts(data); err != nil {
+				return nil, err
+			}
+			data.localize(zones.forEquipment(data.EquipmentID))
+			return &data, nil
+		},
+	},
+	TimeEntriesTable: {
+		create: func(tx *gorm.DB, zones *zoneResolver, item []byte) (interface{}, error) {
+			var peek struct{ MaintenanceHistoryID uint }
+			_ = json.Unmarshal(item, &peek)
+			var history MaintenanceHistory
+			tx.Select("id", "equipment_id").First(&history, peek.MaintenanceHistoryID)
+			item, err := localizeBody(item, zones.ownerOf(history.EquipmentID), "started_at", "ended_at")
+			if err != nil {
+				return nil, err
+			}
+			var data TimeEntry
+			if err = decodeItem(item, &data); err != nil {
+				return nil, err
+			}
+			if err = createTimeEntry(tx, &data); err != nil {
+				return nil, err
+			}
+			data.localize(zones.forEquipment(history.EquipmentID))
+			return &data, nil
+		},
+		update: func(tx *gorm.DB, zones *zoneResolver, id string, item []byte) (interface{}, error) {
+			var data TimeEntry
+			if result := tx.First(&data, id); result.Error != nil {
+				return nil, result.Error
+			}
+			if data.EndedAt == nil {
+				return nil, withStatus(http.StatusConflict, fmt.Errorf("time entry %s is still running, stop it first", id))
+			}
+			previousHistoryID := data.MaintenanceHistoryID
+			item, err := localizeBody(item, timeEntryZone(newZones(), data.MaintenanceHistoryID), "started_at", "ended_at")
+			if err != nil {
+				return nil, err
+			}
+			if err = decodeItem(item, &data); err != nil {
+				return nil, err
+			}
+			if err = saveTimeEntry(tx, &data, previousHistoryID); err != nil {
+				return nil, err
+			}
+			data.localize(timeEntryZone(zones, data.MaintenanceHistoryID))
+			return &data, nil
+		},
+	},
+}
+
+func writerFor(t Tables) bulkWriter {
+	if writer, ok := bulkWriters[t]; ok {
+		return writer
+	}
+	return genericWriter(t)
+}
+
+// bulkItem is one entry of a batch as it goes through the write.
+type bulkItem struct {
+	id      string
+	ifMatch string
+	body    []byte
+	data    interface{}
+	before  map[string]interface{}
+	after   map[string]interface{}
+	err     error
+}
+
+// parseBulkItem reads the id and expected version of an update or delete
+// item. Delete items may be bare ids.
+func parseBulkItem(method string, raw []byte) bulkItem {
+	item := bulkItem{body: raw}
+	if method == http.MethodPost {
+		return item
+	}
+	var target struct {
+		ID      uint   `json:"id"`
+		IfMatch string `json:"if_match"`
+	}
+	if method != http.MethodDelete || json.Unmarshal(raw, &target.ID) != nil {
+		if err := json.Unmarshal(raw, &target); err != nil {
+			item.err = withStatus(http.StatusBadRequest, errors.New("items must be objects with an id"))
+			return item
+		}
+	}
+	if target.ID == 0 {
+		item.err = &HTTPError{Status: http.StatusBadRequest, Field: "id", Err: errors.New("id must be a positive integer")}
+		return item
+	}
+	item.id = strconv.FormatUint(uint64(target.ID), 10)
+	item.ifMatch = target.IfMatch
+	if item.ifMatch == "" && os.Getenv("REQUIRE_IF_MATCH") == "true" {
+		item.err = withStatus(http.StatusPreconditionRequired, fmt.Errorf("send the ETag of record %s in if_match to change it", item.id))
+	}
+	return item
+}
+
+// writeBulkItem makes the write of one item, checking the version it was
+// read at first.
+func writeBulkItem(tx *gorm.DB, t Tables, method string, zones *zoneResolver, item *bulkItem) error {
+	if item.ifMatch != "" {
+		etag, err := rowVersion(tx, t, item.id)
+		if err != nil {
+			return err
+		}
+		if etag == "" || !etagMatches(item.ifMatch, etag, false) {
+			return withStatus(http.StatusPreconditionFailed,
+				fmt.Errorf("%s %s was changed since it was read, fetch it again and retry", t, item.id))
+		}
+	}
+	if item.id != "" {
+		item.before = auditSnapshot(tx, t, item.id)
+	}
+
+	var err error
+	switch method {
+	case http.MethodPost:
+		if item.data, err = writerFor(t).create(tx, zones, item.body); err == nil {
+			item.id = strconv.FormatUint(uint64(recordID(item.data)), 10)
+		}
+	case http.MethodPut:
+		item.data, err = writerFor(t).update(tx, zones, item.id, item.body)
+	case http.MethodDelete:
+		err = trashRecord(tx, t, item.id)
+	}
+	if err != nil {
+		return err
+	}
+	item.after = auditSnapshot(tx, t, item.id)
+	return nil
+}
+
+var errBatchRolledBack = errors.New("the batch was rolled back")
+
+// runBatch writes count items through write, each in a transaction of its
+// own. An atomic batch runs them as savepoints of one transaction instead and
+// keeps nothing when any of them fails, nor when keep is false. It tells
+// whether the batch was rolled back.
+func runBatch(atomic, keep bool, count int, write func(tx *gorm.DB, i int) error) (bool, error) {
+	if !atomic && keep {
+		for i := 0; i < count; i++ {
+			_ = db.Transaction(func(tx *gorm.DB) error {
+				return write(tx, i)
+			})
+		}
+		return false, nil
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		failed := false
+		for i := 0; i < count; i++ {
+			err := tx.Transaction(func(tx *gorm.DB) error {
+				return write(tx, i)
+			})
+			failed = failed || err != nil
+		}
+		if failed || !keep {
+			return errBatchRolledBack
+		}
+		return nil
+	})
+	if errors.Is(err, errBatchRolledBack) {
+		return true, nil
+	}
+	return false, err
+}
+
+// itemProblem describes why an item of a batch failed, hiding server errors
+// the way responseWithError does.
+func itemProblem(requestID, item string, err error) *Problem {
+	problem := problemFor(err)
+	if problem.Status >= http.StatusInternalServerError {
+		problem.CorrelationID = requestID
+		problem.Detail = "an internal error occurred, quote the correlation ID when reporting it"
+		log.Printf("[%s] %s: %v", requestID, item, err)
+	}
+	return &problem
+}
+
+func bulkHandler(t Tables) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = bulkAtomic
+		}
+		if mode != bulkAtomic && mode != bulkBestEffort {
+			responseWithMsg(w, http.StatusBadRequest, fmt.Sprintf("mode must be %s or %s", bulkAtomic, bulkBestEffort))
+			return
+		}
+
+		zones, err := newZoneResolver(r)
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+		actorID, err := requestActor(r)
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+
+		body, err := Reader(r)
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+		var raw []jsoniter.RawMessage
+		if err = json.Unmarshal(body, &raw); err != nil {
+			responseWithMsg(w, http.StatusBadRequest, "the body must be a JSON array of items")
+			return
+		}
+		if len(raw) == 0 {
+			responseWithMsg(w, http.StatusBadRequest, "the batch has no items")
+			return
+		}
+		if limit := envInt("BULK_MAX_ITEMS", 1000); len(raw) > limit {
+			responseWithMsg(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("a batch takes at most %d items", limit))
+			return
+		}
+
+		items := make([]bulkItem, len(raw))
+		for i := range raw {
+			items[i] = parseBulkItem(r.Method, raw[i])
+		}
+
+		var locked []string
+		for _, item := range items {
+			if item.id != "" {
+				locked = append(locked, item.id)
+			}
+		}
+		var rolledBack bool
+		err = withRecordLocks(t, locked, func() error {
+			rolledBack, err = runBatch(mode == bulkAtomic, true, len(items), func(tx *gorm.DB, i int) error {
+				if items[i].err == nil {
+					items[i].err = writeBulkItem(tx, t, r.Method, zones, &items[i])
+				}
+				return items[i].err
+			})
+			return err
+		})
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+
+		result := BulkResult{Mode: mode, RolledBack: rolledBack, Items: make([]BulkItemResult, len(items))}
+		action := auditAction(r, requestTarget{table: t})
+		requestID := middleware.GetReqID(r.Context())
+		for i, item := range items {
+			itemResult := BulkItemResult{Index: i, Status: http.StatusOK}
+			if id, err := strconv.ParseUint(item.id, 10, 64); err == nil {
+				itemResult.ID = uint(id)
+			}
+			switch {
+			case item.err != nil:
+				itemResult.Error = itemProblem(requestID, fmt.Sprintf("%s %s item %d", r.Method, r.URL.Path, i), item.err)
+				itemResult.Status = itemResult.Error.Status
+				result.Failed++
+			case rolledBack:
+				problem := newProblem(http.StatusFailedDependency, "the item was rolled back because another item of the batch failed")
+				itemResult.Status = problem.Status
+				itemResult.Error = &problem
+				if r.Method == http.MethodPost {
+					itemResult.ID = 0
+				}
+			default:
+				itemResult.Data = item.data
+				result.Succeeded++
+				recordAudit(requestID, actorID, t, item.id, action, item.before, item.after)
+			}
+			result.Items[i] = itemResult
+		}
+
+		status := http.StatusOK
+		if result.Failed > 0 || rolledBack {
+			status = http.StatusMultiStatus
+		}
+		responseWithJSON(w, status, result, fmt.Sprintf("%d of %d %s items written", result.Succeeded, len(items), t))
+		return
+	}
+}
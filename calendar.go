@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CalendarFeed struct {
+	gorm.Model
+	Token         string     `gorm:"type:char(64);uniqueIndex;not null"`
+	UserID        *uint      `gorm:"type:int(10);index;default:NULL"`
+	User          *User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	EquipmentID   *uint      `gorm:"type:int(10);index;default:NULL"`
+	Equipment     *Equipment `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	LastFetchedAt *time.Time
+	URL           string `gorm:"-"`
+}
+
+type CalendarImportResult struct {
+	Created []MaintenanceSchedule `json:"created"`
+	Skipped []string              `json:"skipped"`
+}
+
+const icsTimeFormat = "20060102T150405Z"
+
+func calendarUIDDomain() string {
+	if domain := os.Getenv("CALENDAR_UID_DOMAIN"); domain != "" {
+		return domain
+	}
+	return "maintenance-tracker"
+}
+
+func scheduleUID(id uint) string {
+	return fmt.Sprintf("schedule-%d@%s", id, calendarUIDDomain())
+}
+
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+func icsUnescape(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(s)
+}
+
+// icsLine writes a content line folded at 75 octets as RFC 5545 requires,
+// without splitting UTF-8 sequences.
+func icsLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+func scheduleEvent(b *strings.Builder, s MaintenanceSchedule) {
+	start := s.ScheduledAt.UTC()
+	summary := "Maintenance"
+	if s.MaintenanceType != nil {
+		summary = s.MaintenanceType.TypeName
+	}
+	if s.Equipment != nil && s.Equipment.Name != "" {
+		summary = fmt.Sprintf("%s: %s", summary, s.Equipment.Name)
+	}
+
+	icsLine(b, "BEGIN:VEVENT")
+	icsLine(b, "UID:"+scheduleUID(s.ID))
+	// Every write moves UpdatedAt forward and a cancellation sets DeletedAt
+	// after it, so the seconds from creation to the later of the two give
+	// calendar clients an increasing SEQUENCE without storing one.
+	modified := s.UpdatedAt
+	if s.DeletedAt.Valid && s.DeletedAt.Time.After(modified) {
+		modified = s.DeletedAt.Time
+	}
+	icsLine(b, "DTSTAMP:"+modified.UTC().Format(icsTimeFormat))
+	icsLine(b, "LAST-MODIFIED:"+modified.UTC().Format(icsTimeFormat))
+	icsLine(b, "SEQUENCE:"+strconv.FormatInt(int64(modified.Sub(s.CreatedAt)/time.Second), 10))
+	icsLine(b, "DTSTART:"+start.Format(icsTimeFormat))
+	icsLine(b, "DTEND:"+start.Add(time.Duration(s.DurationMinutes)*time.Minute).Format(icsTimeFormat))
+	icsLine(b, "SUMMARY:"+icsEscape(summary))
+	if s.Notes.Valid && s.Notes.String != "" {
+		icsLine(b, "DESCRIPTION:"+icsEscape(s.Notes.String))
+	}
+	if s.DeletedAt.Valid {
+		icsLine(b, "STATUS:CANCELLED")
+	} else {
+		icsLine(b, "STATUS:CONFIRMED")
+	}
+	icsLine(b, fmt.Sprintf("X-EQUIPMENT-ID:%d", s.EquipmentID))
+	icsLine(b, fmt.Sprintf("X-MAINTENANCE-TYPE-ID:%d", s.MaintenanceTypeID))
+	icsLine(b, "END:VEVENT")
+}
+
+// feedSchedules returns the upcoming schedules a feed covers, plus the ones
+// deleted recently so subscribed calendars drop them as cancelled events.
+// User feeds cover the schedules the user is assigned to.
+func feedSchedules(feed CalendarFeed) ([]MaintenanceSchedule, error) {
+	since := time.Now().AddDate(0, 0, -envInt("CALENDAR_PAST_DAYS", 30))
+	query := db.Unscoped().Preload("Equipment").Preload("MaintenanceType").
+		Where("scheduled_at >= ?", since).
+		Where("deleted_at IS NULL OR deleted_at >= ?", since)
+	switch {
+	case feed.EquipmentID != nil:
+		query = query.Where("equipment_id = ?", *feed.EquipmentID)
+	case feed.UserID != nil:
+		query = query.Where("id IN (?)", db.Table(ScheduleAssignmentsTable.String()).
+			Select("maintenance_schedule_id").Where("user_id = ?", *feed.UserID))
+	default:
+		return nil, errors.New("calendar feed has no owner")
+	}
+
+	var schedules []MaintenanceSchedule
+	result := query.Order("scheduled_at").Find(&schedules)
+	return schedules, result.Error
+}
+
+func calendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	var feed CalendarFeed
+	result := db.Where("token = ?", chi.URLParam(r, "token")).First(&feed)
+	if result.Error != nil {
+		responseWithMsg(w, http.StatusNotFound, "calendar feed not found")
+		return
+	}
+
+	schedules, err := feedSchedules(feed)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	name := "Maintenance schedule"
+	if feed.EquipmentID != nil {
+		var equipment Equipment
+		if db.Select("name").First(&equipment, *feed.EquipmentID).Error == nil {
+			name = fmt.Sprintf("Maintenance: %s", equipment.Name)
+		}
+	}
+
+	var b strings.Builder
+	icsLine(&b, "BEGIN:VCALENDAR")
+	icsLine(&b, "VERSION:2.0")
+	icsLine(&b, "PRODID:-//maintenanceTracker//schedules//EN")
+	icsLine(&b, "CALSCALE:GREGORIAN")
+	icsLine(&b, "METHOD:PUBLISH")
+	icsLine(&b, "X-WR-CALNAME:"+icsEscape(name))
+	for _, s := range schedules {
+		scheduleEvent(&b, s)
+	}
+	icsLine(&b, "END:VCALENDAR")
+
+	now := time.Now()
+	db.Model(&feed).UpdateColumn("last_fetched_at", now)
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="schedule.ics"`)
+	_, _ = io.WriteString(w, b.String())
+}
+
+func calendarToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func withFeedURL(feed CalendarFeed) CalendarFeed {
+	feed.URL = fmt.Sprintf("/calendar/%s.ics", feed.Token)
+	return feed
+}
+
+// calendarFeedCreateHandler issues a new secret feed URL for a user or a
+// piece of equipment. Anyone holding the URL can read the feed, so it can be
+// revoked by deleting the feed.
+func calendarFeedCreateHandler(t Tables) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw, err := pathID(r, "id")
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+		id, _ := strconv.ParseUint(raw, 10, 64)
+		owner := uint(id)
+
+		var feed CalendarFeed
+		switch t {
+		case UsersTable:
+			result := db.Select("id").First(&User{}, owner)
+			if result.Error != nil {
+				responseWithError(w, r, result.Error)
+				return
+			}
+			feed.UserID = &owner
+		case EquipmentTable:
+			result := db.Select("id").First(&Equipment{}, owner)
+			if result.Error != nil {
+				responseWithError(w, r, result.Error)
+				return
+			}
+			feed.EquipmentID = &owner
+		}
+
+		feed.Token, err = calendarToken()
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+		result := db.Create(&feed)
+		if result.Error != nil {
+			responseWithError(w, r, result.Error)
+			return
+		}
+		feedID := strconv.FormatUint(uint64(feed.ID), 10)
+		recordChildAudit(r, CalendarFeedsTable, feedID, "create", nil, auditSnapshot(db, CalendarFeedsTable, feedID))
+
+		responseWithJSON(w, http.StatusOK, withFeedURL(feed), "calendar feed created")
+		return
+	}
+}
+
+func calendarFeedReadHandler(w http.ResponseWriter, r *http.Request) {
+	var data []CalendarFeed
+	query, err := includeQuery(r, &CalendarFeed{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	query = query.Order("id")
+	if userID := r.URL.Query().Get("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if equipmentID := r.URL.Query().Get("equipment_id"); equipmentID != "" {
+		query = query.Where("equipment_id = ?", equipmentID)
+	}
+	result := query.Find(&data)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	for i := range data {
+		data[i] = withFeedURL(data[i])
+	}
+	responseWithJSON(w, http.StatusOK, data, "calendar feeds read")
+	return
+}
+
+func calendarFeedDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := db.Unscoped().Delete(&CalendarFeed{}, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		responseWithMsg(w, http.StatusNotFound, fmt.Sprintf("calendar feed with id %s not found", id))
+		return
+	}
+
+	responseWithMsg(w, http.StatusOK, fmt.Sprintf("calendar feed with id %s revoked", id))
+	return
+}
+
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+func parseICSLine(line string) (icsProperty, bool) {
+	colon := -1
+	quoted := false
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		}
+		if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return icsProperty{}, false
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	p := icsProperty{Name: strings.ToUpper(parts[0]), Params: map[string]string{}, Value: line[colon+1:]}
+	for _, param := range parts[1:] {
+		if k, v, ok := strings.Cut(param, "="); ok {
+			p.Params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return p, true
+}
+
+// parseICSEvents unfolds the calendar and returns the properties of every
+// VEVENT in it.
+func parseICSEvents(r io.Reader) ([]map[string]icsProperty, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, readError(err)
+	}
+
+	var events []map[string]icsProperty
+	var current map[string]icsProperty
+	depth := 0
+	for _, line := range lines {
+		p, ok := parseICSLine(line)
+		if !ok {
+			continue
+		}
+		switch {
+		case p.Name == "BEGIN" && strings.EqualFold(p.Value, "VEVENT"):
+			current = map[string]icsProperty{}
+		case p.Name == "END" && strings.EqualFold(p.Value, "VEVENT"):
+			if current != nil {
+				events = append(events, current)
+			}
+			current = nil
+		case p.Name == "BEGIN" && current != nil:
+			// Nested components such as VALARM carry their own properties.
+			depth++
+		case p.Name == "END" && current != nil:
+			depth--
+		case current != nil && depth == 0:
+			if _, seen := current[p.Name]; !seen {
+				current[p.Name] = p
+			}
+		}
+	}
+	if len(events) == 0 {
+		return nil, withStatus(http.StatusBadRequest, errors.New("calendar contains no events"))
+	}
+	return events, nil
+}
+
+// parseICSTime reads a DATE or DATE-TIME value. Floating times without a
+// TZID are read in loc.
+func parseICSTime(p icsProperty, loc *time.Location) (time.Time, error) {
+	if p.Params["VALUE"] == "DATE" || len(p.Value) == 8 {
+		return time.ParseInLocation("20060102", p.Value, loc)
+	}
+	if strings.HasSuffix(p.Value, "Z") {
+		return time.Parse(icsTimeFormat, p.Value)
+	}
+	if tzid := p.Params["TZID"]; tzid != "" {
+		l, err := time.LoadLocation(tzid)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unknown time zone %s", tzid)
+		}
+		loc = l
+	}
+	return time.ParseInLocation("20060102T150405", p.Value, loc)
+}
+
+// parseICSDuration reads the day and time parts of an RFC 5545 duration
+// such as PT1H30M or P1D.
+func parseICSDuration(value string) (time.Duration, error) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(value, "+"), "P")
+	if rest == value || rest == "" {
+		return 0, fmt.Errorf("invalid duration %s", value)
+	}
+	var total time.Duration
+	units := map[byte]time.Duration{'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour, 'H': time.Hour, 'M': time.Minute, 'S': time.Second}
+	number := ""
+	for i := 0; i < len(rest); i++ {
+		c := rest[i]
+		switch {
+		case c == 'T':
+		case c >= '0' && c <= '9':
+			number += string(c)
+		default:
+			unit, ok := units[c]
+			n, err := strconv.Atoi(number)
+			if !ok || err != nil {
+				return 0, fmt.Errorf("invalid duration %s", value)
+			}
+			total += time.Duration(n) * unit
+			number = ""
+		}
+	}
+	return total, nil
+}
+
+func icsUint(event map[string]icsProperty, name string, fallback uint) uint {
+	p, ok := event[name]
+	if !ok {
+		return fallback
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(p.Value), 10, 64)
+	if err != nil {
+		return fallback
+	}
+	return uint(v)
+}
+
+// calendarImportHandler creates schedules from an uploaded .ics file, sent
+// either as the "file" part of a multipart form or as a text/calendar body.
+// equipment_id and maintenance_type_id apply to events that do not carry the
+// X-EQUIPMENT-ID and X-MAINTENANCE-TYPE-ID properties of our own feeds.
+// Cancelled events and events already exported from this system are skipped.
+func calendarImportHandler(w http.ResponseWriter, r *http.Request) {
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes())
+	fields := map[string]string{}
+	var source io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			responseWithError(w, r, readError(err))
+			return
+		}
+		source = nil
+		for source == nil {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				responseWithMsg(w, http.StatusBadRequest, "multipart field file is required")
+				return
+			}
+			if err != nil {
+				responseWithError(w, r, readError(err))
+				return
+			}
+			if part.FormName() == "file" {
+				source = part
+				continue
+			}
+			value, _ := io.ReadAll(io.LimitReader(part, 1024))
+			fields[part.FormName()] = string(value)
+		}
+	}
+
+	events, err := parseICSEvents(source)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	defaultID := func(name string) uint {
+		raw := fields[name]
+		if raw == "" {
+			raw = r.URL.Query().Get(name)
+		}
+		v, _ := strconv.ParseUint(raw, 10, 64)
+		return uint(v)
+	}
+	equipmentID, typeID := defaultID("equipment_id"), defaultID("maintenance_type_id")
+	ownSuffix := "@" + calendarUIDDomain()
+
+	importResult := CalendarImportResult{Created: []MaintenanceSchedule{}, Skipped: []string{}}
+	var schedules []MaintenanceSchedule
+	var labels []string
+	for i, event := range events {
+		label := fmt.Sprintf("event %d", i+1)
+		if uid, ok := event["UID"]; ok {
+			label = uid.Value
+			if strings.HasPrefix(uid.Value, "schedule-") && strings.HasSuffix(uid.Value, ownSuffix) {
+				importResult.Skipped = append(importResult.Skipped, label+": already a schedule here")
+				continue
+			}
+		}
+		if strings.EqualFold(event["STATUS"].Value, "CANCELLED") {
+			importResult.Skipped = append(importResult.Skipped, label+": cancelled")
+			continue
+		}
+
+		s := MaintenanceSchedule{
+			EquipmentID:       icsUint(event, "X-EQUIPMENT-ID", equipmentID),
+			MaintenanceTypeID: icsUint(event, "X-MAINTENANCE-TYPE-ID", typeID),
+			DurationMinutes:   60,
+		}
+		if s.EquipmentID == 0 || s.MaintenanceTypeID == 0 {
+			responseWithMsg(w, http.StatusBadRequest, label+": equipment_id and maintenance_type_id are required")
+			return
+		}
+
+		start, ok := event["DTSTART"]
+		if !ok {
+			responseWithMsg(w, http.StatusBadRequest, label+": DTSTART is required")
+			return
+		}
+		loc := zones.ownerOf(s.EquipmentID)
+		s.ScheduledAt, err = parseICSTime(start, loc)
+		if err != nil {
+			responseWithMsg(w, http.StatusBadRequest, fmt.Sprintf("%s: %s", label, err.Error()))
+			return
+		}
+		if end, ok := event["DTEND"]; ok {
+			until, err := parseICSTime(end, loc)
+			if err != nil {
+				responseWithMsg(w, http.StatusBadRequest, fmt.Sprintf("%s: %s", label, err.Error()))
+				return
+			}
+			s.DurationMinutes = int(until.Sub(s.ScheduledAt) / time.Minute)
+		} else if duration, ok := event["DURATION"]; ok {
+			d, err := parseICSDuration(duration.Value)
+			if err != nil {
+				responseWithMsg(w, http.StatusBadRequest, fmt.Sprintf("%s: %s", label, err.Error()))
+				return
+			}
+			s.DurationMinutes = int(d / time.Minute)
+		}
+		if s.DurationMinutes < 0 {
+			responseWithMsg(w, http.StatusBadRequest, label+": DTEND is before DTSTART")
+			return
+		}
+		notes := icsUnescape(event["SUMMARY"].Value)
+		if description := icsUnescape(event["DESCRIPTION"].Value); description != "" {
+			notes = strings.TrimSpace(notes + "\n" + description)
+		}
+		if runes := []rune(notes); len(runes) > 500 {
+			notes = string(runes[:500])
+		}
+		s.Notes.String, s.Notes.Valid = notes, notes != ""
+		schedules = append(schedules, s)
+		labels = append(labels, label)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for i := range schedules {
+			if err := createMaintenanceSchedule(tx, &schedules[i]); err != nil {
+				return fmt.Errorf("%s: %w", labels[i], err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	for i := range schedules {
+		schedules[i].localize(zones.forEquipment(schedules[i].EquipmentID))
+	}
+	importResult.Created = append(importResult.Created, schedules...)
+	responseWithJSON(w, http.StatusOK, importResult, fmt.Sprintf("%d maintenance schedules imported", len(schedules)))
+	return
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const importCalendar = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:abc@example.com\r\n" +
+	"DTSTART;TZID=Europe/Berlin:20240531T083000\r\n" +
+	"DURATION:PT1H30M\r\n" +
+	"SUMMARY:Filter change\\, hall 2\r\n" +
+	"DESCRIPTION:Bring the long\r\n" +
+	"  ladder\r\n" +
+	"X-EQUIPMENT-ID:7\r\n" +
+	"BEGIN:VALARM\r\n" +
+	"ACTION:DISPLAY\r\n" +
+	"DESCRIPTION:Reminder\r\n" +
+	"END:VALARM\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART;VALUE=DATE:20240601\r\n" +
+	"STATUS:CANCELLED\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseICSEvents(t *testing.T) {
+	events, err := parseICSEvents(strings.NewReader(importCalendar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("%d events, want 2", len(events))
+	}
+
+	first := events[0]
+	if got := first["DESCRIPTION"].Value; got != "Bring the long ladder" {
+		t.Errorf("DESCRIPTION = %q, want the folded line joined and the alarm's left out", got)
+	}
+	if got := icsUnescape(first["SUMMARY"].Value); got != "Filter change, hall 2" {
+		t.Errorf("SUMMARY = %q, want the comma unescaped", got)
+	}
+	if got := first["DTSTART"].Params["TZID"]; got != "Europe/Berlin" {
+		t.Errorf("DTSTART TZID = %q, want Europe/Berlin", got)
+	}
+	if _, ok := first["ACTION"]; ok {
+		t.Error("a property of the alarm was read as one of the event")
+	}
+	if got := icsUint(first, "X-EQUIPMENT-ID", 3); got != 7 {
+		t.Errorf("X-EQUIPMENT-ID = %d, want 7", got)
+	}
+	if got := icsUint(first, "X-MAINTENANCE-TYPE-ID", 3); got != 3 {
+		t.Errorf("a missing X-MAINTENANCE-TYPE-ID gave %d, want the fallback 3", got)
+	}
+	if got := events[1]["STATUS"].Value; got != "CANCELLED" {
+		t.Errorf("STATUS = %q, want CANCELLED", got)
+	}
+
+	_, err = parseICSEvents(strings.NewReader("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n"))
+	var httpError *HTTPError
+	if !errors.As(err, &httpError) || httpError.Status != http.StatusBadRequest {
+		t.Errorf("a calendar without events gave %v, want a 400", err)
+	}
+}
+
+func TestParseICSLine(t *testing.T) {
+	p, ok := parseICSLine(`attendee;cn="Doe: Jane";role=CHAIR:mailto:jane@example.com`)
+	if !ok {
+		t.Fatal("the line was not read")
+	}
+	if p.Name != "ATTENDEE" || p.Value != "mailto:jane@example.com" {
+		t.Errorf("read %s = %q, want ATTENDEE = mailto:jane@example.com", p.Name, p.Value)
+	}
+	if p.Params["CN"] != "Doe: Jane" || p.Params["ROLE"] != "CHAIR" {
+		t.Errorf("params = %v, want the quoted colon kept in CN", p.Params)
+	}
+	if _, ok = parseICSLine("no colon here"); ok {
+		t.Error("a line without a value was read")
+	}
+}
+
+func TestParseICSTime(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+	tests := []struct {
+		name string
+		p    icsProperty
+		want time.Time
+		bad  bool
+	}{
+		{"UTC", icsProperty{Value: "20240531T083000Z"}, time.Date(2024, time.May, 31, 8, 30, 0, 0, time.UTC), false},
+		{"TZID", icsProperty{Params: map[string]string{"TZID": "Europe/Berlin"}, Value: "20240531T083000"}, time.Date(2024, time.May, 31, 6, 30, 0, 0, time.UTC), false},
+		{"floating in the owner's zone", icsProperty{Value: "20240531T083000"}, time.Date(2024, time.May, 31, 6, 30, 0, 0, time.UTC), false},
+		{"date", icsProperty{Params: map[string]string{"VALUE": "DATE"}, Value: "20240531"}, time.Date(2024, time.May, 30, 22, 0, 0, 0, time.UTC), false},
+		{"unknown TZID", icsProperty{Params: map[string]string{"TZID": "Mars/Olympus"}, Value: "20240531T083000"}, time.Time{}, true},
+		{"garbage", icsProperty{Value: "tomorrow"}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseICSTime(tt.p, berlin)
+			if tt.bad {
+				if err == nil {
+					t.Errorf("parseICSTime = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil || !got.Equal(tt.want) {
+				t.Errorf("parseICSTime = %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseICSDuration(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		bad   bool
+	}{
+		{value: "PT1H30M", want: 90 * time.Minute},
+		{value: "P1D", want: 24 * time.Hour},
+		{value: "+P1W", want: 7 * 24 * time.Hour},
+		{value: "P1DT2H", want: 26 * time.Hour},
+		{value: "PT45S", want: 45 * time.Second},
+		{value: "1H", bad: true},
+		{value: "P", bad: true},
+		{value: "PT1X", bad: true},
+	}
+	for _, tt := range tests {
+		got, err := parseICSDuration(tt.value)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("parseICSDuration(%q) = %s, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseICSDuration(%q) = %s, %v, want %s", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestICSLine(t *testing.T) {
+	var b strings.Builder
+	icsLine(&b, "DESCRIPTION:"+strings.Repeat("ä", 60))
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n")
+	if len(lines) < 2 {
+		t.Fatalf("a %d octet line was not folded", len("DESCRIPTION:")+120)
+	}
+	unfolded := lines[0]
+	for _, line := range lines {
+		if len(line) > 75 {
+			t.Errorf("line of %d octets: %q", len(line), line)
+		}
+	}
+	for _, line := range lines[1:] {
+		if !strings.HasPrefix(line, " ") {
+			t.Errorf("continuation %q does not start with a space", line)
+		}
+		unfolded += line[1:]
+	}
+	if unfolded != "DESCRIPTION:"+strings.Repeat("ä", 60) {
+		t.Errorf("unfolded to %q, a UTF-8 sequence was split", unfolded)
+	}
+
+	if got := icsUnescape(icsEscape("a,b;c\\d\ne")); got != "a,b;c\\d\ne" {
+		t.Errorf("escaping did not round trip: %q", got)
+	}
+}
+
+func TestScheduleEventSequence(t *testing.T) {
+	created := time.Date(2024, time.May, 1, 8, 0, 0, 0, time.UTC)
+	s := MaintenanceSchedule{EquipmentID: 7, MaintenanceTypeID: 3, ScheduledAt: created.AddDate(0, 1, 0), DurationMinutes: 60}
+	s.ID, s.CreatedAt, s.UpdatedAt = 12, created, created.Add(time.Minute)
+
+	event := func() (sequence, status string) {
+		var b strings.Builder
+		scheduleEvent(&b, s)
+		for _, line := range strings.Split(b.String(), "\r\n") {
+			if v, ok := strings.CutPrefix(line, "SEQUENCE:"); ok {
+				sequence = v
+			}
+			if v, ok := strings.CutPrefix(line, "STATUS:"); ok {
+				status = v
+			}
+		}
+		return sequence, status
+	}
+
+	if sequence, status := event(); sequence != "60" || status != "CONFIRMED" {
+		t.Errorf("SEQUENCE %s STATUS %s, want 60 CONFIRMED", sequence, status)
+	}
+	s.DeletedAt = gorm.DeletedAt{Time: created.Add(time.Hour), Valid: true}
+	if sequence, status := event(); sequence != "3600" || status != "CANCELLED" {
+		t.Errorf("after cancelling SEQUENCE %s STATUS %s, want 3600 CANCELLED", sequence, status)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+)
+
+// code128Values reads the symbol values back from module widths.
+func code128Values(t *testing.T, widths []int) []int {
+	t.Helper()
+	patterns := map[string]int{}
+	for value, pattern := range code128Patterns {
+		patterns[pattern] = value
+	}
+	var values []int
+	for i := 0; i < len(widths); i += 6 {
+		n := 6
+		if len(widths)-i == 7 {
+			n = 7
+		}
+		var pattern []byte
+		sum := 0
+		for _, w := range widths[i : i+n] {
+			pattern = append(pattern, byte('0'+w))
+			sum += w
+		}
+		if want := 11 + 2*(n-6); sum != want {
+			t.Fatalf("symbol %d is %d modules wide, want %d", len(values), sum, want)
+		}
+		value, ok := patterns[string(pattern)]
+		if !ok {
+			t.Fatalf("symbol %d has the unknown pattern %s", len(values), pattern)
+		}
+		values = append(values, value)
+		i += n - 6
+	}
+	return values
+}
+
+func TestEncodeCode128(t *testing.T) {
+	tests := []struct {
+		data   string
+		values []int
+	}{
+		// E=37 Q=49 -=13 0=16 1=17, check (104+37+98+39+64+80+96+112+128+153)%103 = 87
+		{"EQ-000001", []int{104, 37, 49, 13, 16, 16, 16, 16, 16, 17, 87, 106}},
+		// I=41 N=46 V=54 -=13 4=20 2=18 1=17 7=23, check 962%103 = 35
+		{"INV-4217", []int{104, 41, 46, 54, 13, 20, 18, 17, 23, 35, 106}},
+		{" ", []int{104, 0, 1, 106}},
+		{"", []int{104, 1, 106}},
+	}
+	for _, tt := range tests {
+		widths, err := EncodeCode128(tt.data)
+		if err != nil {
+			t.Errorf("%q: %v", tt.data, err)
+			continue
+		}
+		values := code128Values(t, widths)
+		if len(values) != len(tt.values) {
+			t.Errorf("%q: values %v, want %v", tt.data, values, tt.values)
+			continue
+		}
+		for i := range values {
+			if values[i] != tt.values[i] {
+				t.Errorf("%q: values %v, want %v", tt.data, values, tt.values)
+				break
+			}
+		}
+	}
+}
+
+func TestEncodeCode128Patterns(t *testing.T) {
+	known := map[int]string{0: "212222", code128StartB: "211214", code128Stop: "2331112"}
+	for value, want := range known {
+		if code128Patterns[value] != want {
+			t.Errorf("value %d: pattern %s, want %s", value, code128Patterns[value], want)
+		}
+	}
+	for value, pattern := range code128Patterns[:code128Stop] {
+		bars := 0
+		for i, w := range pattern {
+			if i%2 == 0 {
+				bars += int(w - '0')
+			}
+		}
+		if bars%2 != 0 {
+			t.Errorf("value %d: pattern %s has an odd number of bar modules", value, pattern)
+		}
+	}
+}
+
+func TestEncodeCode128Rejects(t *testing.T) {
+	for _, data := range []string{"EQ\n1", "é"} {
+		if _, err := EncodeCode128(data); err == nil {
+			t.Errorf("%q: want an error", data)
+		}
+	}
+}
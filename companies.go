@@ -9,10 +9,11 @@ import (
 
 type Company struct {
 	gorm.Model
-	Name    string `gorm:"type:varchar(255);not null;" validate:"required,max=255"`
-	Address string `gorm:"type:varchar(500);" validate:"max=500"`
-	Email   string `gorm:"type:varchar(255);unique;not null" validate:"required,max=255,email"`
-	Phone   string `gorm:"type:varchar(255);unique;not null" validate:"required,max=255,e164"`
+	Name     string `gorm:"type:varchar(255);not null;" validate:"required,max=255"`
+	Address  string `gorm:"type:varchar(500);" validate:"max=500"`
+	Email    string `gorm:"type:varchar(255);unique;not null" validate:"required,max=255,email"`
+	Phone    string `gorm:"type:varchar(255);unique;not null" validate:"required,max=255,e164"`
+	Timezone string `gorm:"type:varchar(64);not null;default:'UTC'" validate:"omitempty,timezone"`
 }
 
 func companyCreateHandler(w http.ResponseWriter, r *http.Request) {
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 	"net/http"
 	"time"
@@ -10,15 +9,18 @@ import (
 
 type ComplianceDocument struct {
 	gorm.Model
-	EquipmentID  uint      `gorm:"type:int(10);index;not null" validate:"required"`
-	Equipment    Equipment `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"omitempty"`
-	DocumentName string    `gorm:"type:varchar(255);not null" validate:"required"`
-	DocumentURL  string    `gorm:"type:varchar(255)"`
-	ExpiryDate   time.Time `gorm:"type:date;not null" validate:"required,datetime"`
+	EquipmentID        uint                `gorm:"type:int(10);index;not null" validate:"required"`
+	Equipment          *Equipment          `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	DocumentName       string              `gorm:"type:varchar(255);not null" validate:"required"`
+	DocumentURL        string              `gorm:"type:varchar(255)"`
+	ExpiryDate         time.Time           `gorm:"type:date;not null" validate:"required"`
+	PreviousDocumentID *uint               `gorm:"type:int(10);index;default:NULL"`
+	PreviousDocument   *ComplianceDocument `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:",omitempty"`
+	SupersededAt       *time.Time          `gorm:"default:NULL;index"`
 }
 
 func (c *ComplianceDocument) Decode(data []byte) (ComplianceDocument, error) {
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return ComplianceDocument{}, err
 	}
@@ -32,26 +34,26 @@ func (c *ComplianceDocument) Encode() ([]byte, error) {
 func complianceDocumentCreateHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	var c ComplianceDocument
 	data, err := c.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result := db.Create(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -61,9 +63,14 @@ func complianceDocumentCreateHandler(w http.ResponseWriter, r *http.Request) {
 
 func complianceDocumentReadHandler(w http.ResponseWriter, r *http.Request) {
 	var data []ComplianceDocument
-	result := db.Find(&data)
+	query, err := includeQuery(r, &ComplianceDocument{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.Find(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -72,16 +79,21 @@ func complianceDocumentReadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func complianceDocumentReadOneHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	if id == "" {
-		responseWithMsg(w, http.StatusBadRequest, "id is required")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
 	var data ComplianceDocument
-	result := db.First(&data, id)
+	query, err := includeQuery(r, &ComplianceDocument{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -90,35 +102,39 @@ func complianceDocumentReadOneHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func complianceDocumentUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data ComplianceDocument
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	data, err = data.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result = db.Save(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -127,16 +143,14 @@ func complianceDocumentUpdateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func complianceDocumentDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	if id == "" {
-		responseWithMsg(w, http.StatusBadRequest, "id is required")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
-	var data ComplianceDocument
-	result := db.Delete(&data, id)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	if err = trashRecord(db, ComplianceDocumentsTable, id); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
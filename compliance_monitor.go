@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ComplianceValid    = "valid"
+	ComplianceExpiring = "expiring"
+	ComplianceLapsed   = "lapsed"
+	complianceOverdue  = "overdue"
+)
+
+// ComplianceNotice remembers which escalation stage has already been sent for
+// a document so each stage notifies only once.
+type ComplianceNotice struct {
+	gorm.Model
+	ComplianceDocumentID uint                `gorm:"type:int(10);not null;uniqueIndex:idx_document_stage"`
+	ComplianceDocument   *ComplianceDocument `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	Stage                string              `gorm:"type:varchar(20);not null;uniqueIndex:idx_document_stage"`
+	SentAt               time.Time           `gorm:"not null"`
+}
+
+type ComplianceRenewal struct {
+	DocumentName string    `json:"document_name" validate:"max=255"`
+	DocumentURL  string    `json:"document_url" validate:"max=255"`
+	ExpiryDate   time.Time `json:"expiry_date" validate:"required"`
+}
+
+type ComplianceStatusEntry struct {
+	ComplianceDocument
+	ComplianceStatus string `json:"compliance_status"`
+	DaysRemaining    int    `json:"days_remaining"`
+}
+
+type ComplianceStatusReport struct {
+	Valid     int                     `json:"valid"`
+	Expiring  int                     `json:"expiring"`
+	Lapsed    int                     `json:"lapsed"`
+	Documents []ComplianceStatusEntry `json:"documents"`
+}
+
+// complianceOffsets reads COMPLIANCE_NOTICE_DAYS ("90,30,7" by default) and
+// returns the offsets largest first.
+func complianceOffsets() []int {
+	raw := os.Getenv("COMPLIANCE_NOTICE_DAYS")
+	if raw == "" {
+		raw = "90,30,7"
+	}
+	var offsets []int
+	for _, part := range strings.Split(raw, ",") {
+		days, err := strconv.Atoi(strings.TrimSpace(part))
+		if err == nil && days > 0 {
+			offsets = append(offsets, days)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(offsets)))
+	return offsets
+}
+
+func daysUntil(t time.Time) int {
+	today := time.Now().Truncate(24 * time.Hour)
+	return int(t.Truncate(24*time.Hour).Sub(today).Hours() / 24)
+}
+
+// complianceStage returns the most urgent stage a document has reached, or an
+// empty string when it is not yet inside any notice window.
+func complianceStage(expiry time.Time, offsets []int) string {
+	days := daysUntil(expiry)
+	if days < 0 {
+		return complianceOverdue
+	}
+	stage := ""
+	for _, offset := range offsets {
+		if days <= offset {
+			stage = fmt.Sprintf("%dd", offset)
+		}
+	}
+	return stage
+}
+
+func complianceStatus(expiry time.Time, offsets []int) string {
+	days := daysUntil(expiry)
+	switch {
+	case days < 0:
+		return ComplianceLapsed
+	case len(offsets) > 0 && days <= offsets[0]:
+		return ComplianceExpiring
+	default:
+		return ComplianceValid
+	}
+}
+
+// monitorComplianceDocuments escalates notifications for current documents as
+// they pass each configured offset and once more when they become overdue.
+func monitorComplianceDocuments() error {
+	offsets := complianceOffsets()
+	horizon := time.Now().AddDate(0, 0, 1)
+	if len(offsets) > 0 {
+		horizon = time.Now().AddDate(0, 0, offsets[0]+1)
+	}
+
+	var documents []ComplianceDocument
+	result := db.Preload("Equipment").
+		Where("superseded_at IS NULL AND expiry_date <= ?", horizon).
+		Find(&documents)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	for _, document := range documents {
+		stage := complianceStage(document.ExpiryDate, offsets)
+		if stage == "" || document.Equipment == nil {
+			continue
+		}
+
+		var sent int64
+		result := db.Model(&ComplianceNotice{}).
+			Where("compliance_document_id = ? AND stage = ?", document.ID, stage).
+			Count(&sent)
+		if result.Error != nil {
+			return result.Error
+		}
+		if sent > 0 {
+			continue
+		}
+
+		var users []User
+		if result := db.Where("company_id = ?", document.Equipment.CompanyID).Find(&users); result.Error != nil {
+			return result.Error
+		}
+
+		message := fmt.Sprintf("%s of %s expires on %s", document.DocumentName, document.Equipment.Name,
+			document.ExpiryDate.Format("2006-01-02"))
+		if stage == complianceOverdue {
+			message = fmt.Sprintf("%s of %s lapsed on %s", document.DocumentName, document.Equipment.Name,
+				document.ExpiryDate.Format("2006-01-02"))
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for _, user := range users {
+				notification := Notification{
+					UserID:           user.ID,
+					RelatedID:        document.ID,
+					RelatedType:      "documents",
+					NotificationType: "compliance_" + stage,
+					Message:          &message,
+					Status:           "Unread",
+				}
+				if result := tx.Create(&notification); result.Error != nil {
+					return result.Error
+				}
+			}
+			notice := ComplianceNotice{ComplianceDocumentID: document.ID, Stage: stage, SentAt: time.Now()}
+			return tx.Create(&notice).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// complianceDocumentRenewHandler replaces a document with its renewal. The old
+// row is kept and marked as superseded so the renewal trail stays intact.
+func complianceDocumentRenewHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var previous ComplianceDocument
+	result := db.First(&previous, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	if previous.SupersededAt != nil {
+		responseWithMsg(w, http.StatusBadRequest, fmt.Sprintf("compliance document with id %s was already renewed", id))
+		return
+	}
+
+	body, err := Reader(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	var renewal ComplianceRenewal
+	if err = decodeJSON(body, &renewal); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	validationErrors := Validate(renewal)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
+		return
+	}
+
+	data := ComplianceDocument{
+		EquipmentID:        previous.EquipmentID,
+		DocumentName:       previous.DocumentName,
+		DocumentURL:        renewal.DocumentURL,
+		ExpiryDate:         renewal.ExpiryDate,
+		PreviousDocumentID: &previous.ID,
+	}
+	if renewal.DocumentName != "" {
+		data.DocumentName = renewal.DocumentName
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if result := tx.Create(&data); result.Error != nil {
+			return result.Error
+		}
+		return tx.Model(&previous).UpdateColumn("superseded_at", time.Now()).Error
+	})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, data, fmt.Sprintf("compliance document with id %s renewed", id))
+	return
+}
+
+// complianceDocumentHistoryHandler walks the renewal chain back from the given
+// document, newest first.
+func complianceDocumentHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var current ComplianceDocument
+	result := db.First(&current, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	history := []ComplianceDocument{current}
+	for current.PreviousDocumentID != nil {
+		var previous ComplianceDocument
+		if result := db.First(&previous, *current.PreviousDocumentID); result.Error != nil {
+			break
+		}
+		history = append(history, previous)
+		current = previous
+	}
+
+	responseWithJSON(w, http.StatusOK, history, "compliance document history read")
+	return
+}
+
+func complianceReport(query *gorm.DB) (ComplianceStatusReport, error) {
+	var documents []ComplianceDocument
+	result := query.Where("compliance_documents.superseded_at IS NULL").
+		Order("compliance_documents.expiry_date").
+		Find(&documents)
+	if result.Error != nil {
+		return ComplianceStatusReport{}, result.Error
+	}
+
+	offsets := complianceOffsets()
+	report := ComplianceStatusReport{Documents: []ComplianceStatusEntry{}}
+	for _, document := range documents {
+		entry := ComplianceStatusEntry{
+			ComplianceDocument: document,
+			ComplianceStatus:   complianceStatus(document.ExpiryDate, offsets),
+			DaysRemaining:      daysUntil(document.ExpiryDate),
+		}
+		switch entry.ComplianceStatus {
+		case ComplianceValid:
+			report.Valid++
+		case ComplianceExpiring:
+			report.Expiring++
+		case ComplianceLapsed:
+			report.Lapsed++
+		}
+		report.Documents = append(report.Documents, entry)
+	}
+	return report, nil
+}
+
+func equipmentComplianceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	report, err := complianceReport(db.Where("equipment_id = ?", id))
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, report, fmt.Sprintf("compliance status of equipment %s read", id))
+	return
+}
+
+func companyComplianceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	report, err := complianceReport(db.
+		Joins("JOIN equipment ON equipment.id = compliance_documents.equipment_id").
+		Where("equipment.company_id = ?", id))
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, report, fmt.Sprintf("compliance status of company %s read", id))
+	return
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	DepreciationStraightLine      = "straight_line"
+	DepreciationDecliningBalance  = "declining_balance"
+	DepreciationUnitsOfProduction = "units_of_production"
+)
+
+type MeterReading struct {
+	gorm.Model
+	EquipmentID uint       `gorm:"type:int(10);index;not null" validate:"required"`
+	Equipment   *Equipment `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	UserID      *uint      `gorm:"type:int(10);index;default:NULL"`
+	User        *User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:",omitempty"`
+	Reading     float64    `gorm:"type:decimal(14,2);not null" validate:"gte=0"`
+	Unit        string     `gorm:"type:varchar(20)" validate:"max=20"`
+	ReadAt      time.Time  `gorm:"not null;index" validate:"required"`
+}
+
+// DepreciationPolicy is the effective depreciation setup of one piece of
+// equipment once its category defaults have been applied.
+type DepreciationPolicy struct {
+	Method          string  `json:"method"`
+	Cost            float64 `json:"cost"`
+	SalvageValue    float64 `json:"salvage_value"`
+	UsefulLifeYears int     `json:"useful_life_years"`
+	DecliningRate   float64 `json:"declining_rate"`
+	LifetimeUnits   float64 `json:"lifetime_units"`
+}
+
+type DepreciationPeriod struct {
+	Period       int       `json:"period"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	OpeningValue float64   `json:"opening_value"`
+	Depreciation float64   `json:"depreciation"`
+	Accumulated  float64   `json:"accumulated"`
+	ClosingValue float64   `json:"closing_value"`
+	Units        float64   `json:"units,omitempty"`
+}
+
+type DepreciationReport struct {
+	EquipmentID      uint                 `json:"equipment_id"`
+	Name             string               `json:"name"`
+	Policy           DepreciationPolicy   `json:"policy"`
+	AsOf             time.Time            `json:"as_of"`
+	AccumulatedToNow float64              `json:"accumulated_depreciation"`
+	BookValue        float64              `json:"book_value"`
+	Schedule         []DepreciationPeriod `json:"schedule,omitempty"`
+}
+
+type FixedAssetReport struct {
+	CompanyID              uint                 `json:"company_id"`
+	AsOf                   time.Time            `json:"as_of"`
+	TotalCost              float64              `json:"total_cost"`
+	TotalAccumulated       float64              `json:"total_accumulated_depreciation"`
+	TotalBookValue         float64              `json:"total_book_value"`
+	Assets                 []DepreciationReport `json:"assets"`
+	EquipmentWithoutPolicy []uint               `json:"equipment_without_policy"`
+}
+
+func depreciationPolicy(e Equipment) (DepreciationPolicy, error) {
+	p := DepreciationPolicy{
+		Method:          e.DepreciationMethod,
+		Cost:            e.PurchaseCost,
+		SalvageValue:    e.SalvageValue,
+		UsefulLifeYears: e.UsefulLifeYears,
+		DecliningRate:   e.DecliningRate,
+		LifetimeUnits:   e.LifetimeUnits,
+	}
+	// a category that was not loaded or is in the trash gives no defaults
+	if c := e.EquipmentCategory; c != nil {
+		if p.Method == "" {
+			p.Method = c.DepreciationMethod
+		}
+		if p.UsefulLifeYears == 0 {
+			p.UsefulLifeYears = c.UsefulLifeYears
+		}
+		if p.DecliningRate == 0 {
+			p.DecliningRate = c.DecliningRate
+		}
+		if p.LifetimeUnits == 0 {
+			p.LifetimeUnits = c.LifetimeUnits
+		}
+		if p.SalvageValue == 0 && c.SalvageRate > 0 {
+			p.SalvageValue = p.Cost * c.SalvageRate
+		}
+	}
+
+	switch p.Method {
+	case DepreciationStraightLine:
+		if p.UsefulLifeYears <= 0 {
+			return p, withStatus(http.StatusUnprocessableEntity, errors.New("straight line depreciation needs a useful life"))
+		}
+	case DepreciationDecliningBalance:
+		if p.UsefulLifeYears <= 0 {
+			return p, withStatus(http.StatusUnprocessableEntity, errors.New("declining balance depreciation needs a useful life"))
+		}
+		if p.DecliningRate == 0 {
+			p.DecliningRate = 2 / float64(p.UsefulLifeYears)
+		}
+	case DepreciationUnitsOfProduction:
+		if p.LifetimeUnits <= 0 {
+			return p, withStatus(http.StatusUnprocessableEntity, errors.New("units of production depreciation needs lifetime units"))
+		}
+	case "":
+		return p, withStatus(http.StatusUnprocessableEntity, errors.New("no depreciation method set on equipment or category"))
+	default:
+		return p, withStatus(http.StatusUnprocessableEntity, fmt.Errorf("unknown depreciation method %s", p.Method))
+	}
+	if p.Cost <= 0 {
+		return p, withStatus(http.StatusUnprocessableEntity, errors.New("purchase cost is not set"))
+	}
+	return p, nil
+}
+
+// unitsBetween returns how much the meter advanced between two instants,
+// using the last reading taken before each of them.
+func unitsBetween(readings []MeterReading, from, to time.Time) float64 {
+	at := func(t time.Time) float64 {
+		value := math.NaN()
+		for _, r := range readings {
+			if r.ReadAt.After(t) {
+				break
+			}
+			value = r.Reading
+		}
+		if math.IsNaN(value) && len(readings) > 0 {
+			value = readings[0].Reading
+		}
+		return value
+	}
+	if len(readings) == 0 {
+		return 0
+	}
+	return math.Max(0, at(to)-at(from))
+}
+
+// depreciationSchedule builds yearly periods starting at the purchase date
+// until the asset reaches its salvage value or its useful life ends. Units of
+// production periods run until asOf, since future usage is unknown.
+func depreciationSchedule(p DepreciationPolicy, purchased, asOf time.Time, readings []MeterReading) []DepreciationPeriod {
+	var periods []DepreciationPeriod
+	value := p.Cost
+	depreciable := p.Cost - p.SalvageValue
+	years := p.UsefulLifeYears
+	if p.Method == DepreciationUnitsOfProduction {
+		years = int(asOf.Sub(purchased).Hours()/(24*365)) + 1
+	}
+
+	for i := 0; i < years && value > p.SalvageValue; i++ {
+		start := purchased.AddDate(i, 0, 0)
+		end := purchased.AddDate(i+1, 0, 0)
+		period := DepreciationPeriod{Period: i + 1, Start: start, End: end, OpeningValue: value}
+
+		switch p.Method {
+		case DepreciationStraightLine:
+			period.Depreciation = depreciable / float64(p.UsefulLifeYears)
+		case DepreciationDecliningBalance:
+			period.Depreciation = value * p.DecliningRate
+			if i == years-1 {
+				period.Depreciation = value - p.SalvageValue
+			}
+		case DepreciationUnitsOfProduction:
+			period.Units = unitsBetween(readings, start, end)
+			period.Depreciation = depreciable * period.Units / p.LifetimeUnits
+		}
+
+		period.Depreciation = math.Min(period.Depreciation, value-p.SalvageValue)
+		value -= period.Depreciation
+		period.ClosingValue = value
+		period.Accumulated = p.Cost - value
+		periods = append(periods, period)
+	}
+	return periods
+}
+
+// accumulatedAt prorates the schedule linearly within the period containing
+// asOf. Units of production is already measured, so no proration applies.
+func accumulatedAt(p DepreciationPolicy, schedule []DepreciationPeriod, asOf time.Time, readings []MeterReading) float64 {
+	var accumulated float64
+	for _, period := range schedule {
+		if !asOf.After(period.Start) {
+			break
+		}
+		if !asOf.Before(period.End) {
+			accumulated = period.Accumulated
+			continue
+		}
+		if p.Method == DepreciationUnitsOfProduction {
+			units := unitsBetween(readings, period.Start, asOf)
+			accumulated += math.Min((p.Cost-p.SalvageValue)*units/p.LifetimeUnits, period.OpeningValue-p.SalvageValue)
+		} else {
+			share := asOf.Sub(period.Start).Seconds() / period.End.Sub(period.Start).Seconds()
+			accumulated += period.Depreciation * share
+		}
+		break
+	}
+	return accumulated
+}
+
+func depreciationReport(e Equipment, asOf time.Time, withSchedule bool) (DepreciationReport, error) {
+	p, err := depreciationPolicy(e)
+	if err != nil {
+		return DepreciationReport{}, err
+	}
+
+	var readings []MeterReading
+	if p.Method == DepreciationUnitsOfProduction {
+		result := db.Where("equipment_id = ?", e.ID).Order("read_at").Find(&readings)
+		if result.Error != nil {
+			return DepreciationReport{}, result.Error
+		}
+	}
+
+	schedule := depreciationSchedule(p, e.PurchaseDate, asOf, readings)
+	accumulated := accumulatedAt(p, schedule, asOf, readings)
+	report := DepreciationReport{
+		EquipmentID:      e.ID,
+		Name:             e.Name,
+		Policy:           p,
+		AsOf:             asOf,
+		AccumulatedToNow: accumulated,
+		BookValue:        p.Cost - accumulated,
+	}
+	if withSchedule {
+		report.Schedule = schedule
+	}
+	return report, nil
+}
+
+func asOfParam(r *http.Request) (time.Time, error) {
+	v := r.URL.Query().Get("as_of")
+	if v == "" {
+		return time.Now(), nil
+	}
+	asOf, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return asOf, &HTTPError{Status: http.StatusBadRequest, Field: "as_of", Err: errors.New("as_of must be a date like 2006-01-02")}
+	}
+	return asOf, nil
+}
+
+func equipmentDepreciationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	asOf, err := asOfParam(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	var equipment Equipment
+	result := db.Preload("EquipmentCategory").First(&equipment, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	report, err := depreciationReport(equipment, asOf, true)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, report, fmt.Sprintf("depreciation of equipment %s read", id))
+	return
+}
+
+func companyFixedAssetReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	asOf, err := asOfParam(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	var equipment []Equipment
+	result := db.Preload("EquipmentCategory").
+		Where("company_id = ? AND status <> ?", id, EquipmentDisposed).
+		Find(&equipment)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	report := FixedAssetReport{AsOf: asOf, Assets: []DepreciationReport{}, EquipmentWithoutPolicy: []uint{}}
+	for _, e := range equipment {
+		report.CompanyID = e.CompanyID
+		asset, err := depreciationReport(e, asOf, false)
+		if err != nil {
+			report.EquipmentWithoutPolicy = append(report.EquipmentWithoutPolicy, e.ID)
+			continue
+		}
+		report.TotalCost += asset.Policy.Cost
+		report.TotalAccumulated += asset.AccumulatedToNow
+		report.TotalBookValue += asset.BookValue
+		report.Assets = append(report.Assets, asset)
+	}
+
+	responseWithJSON(w, http.StatusOK, report, fmt.Sprintf("fixed asset report of company %s read", id))
+	return
+}
+
+func meterReadingCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if Create(w, r, MeterReadingsTable) {
+		fmt.Println("meter reading created")
+		return
+	}
+	fmt.Println("meter reading not created")
+	return
+}
+
+func meterReadingReadHandler(w http.ResponseWriter, r *http.Request) {
+	if Read(w, r, MeterReadingsTable) {
+		fmt.Println("meter readings read")
+		return
+	}
+	fmt.Println("meter readings not read")
+	return
+}
+
+func meterReadingReadOneHandler(w http.ResponseWriter, r *http.Request) {
+	if ReadOne(w, r, MeterReadingsTable) {
+		fmt.Println("meter reading read")
+		return
+	}
+	fmt.Println("meter reading not read")
+	return
+}
+
+func meterReadingUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if Update(w, r, MeterReadingsTable) {
+		fmt.Println("meter reading updated")
+		return
+	}
+	fmt.Println("meter reading not updated")
+	return
+}
+
+func meterReadingDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if Delete(w, r, MeterReadingsTable) {
+		fmt.Println("meter reading deleted")
+		return
+	}
+	fmt.Println("meter reading not deleted")
+	return
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestDepreciationPolicy(t *testing.T) {
+	category := &EquipmentCategory{DepreciationMethod: DepreciationStraightLine, UsefulLifeYears: 8, SalvageRate: 0.1}
+	tests := []struct {
+		name      string
+		equipment Equipment
+		want      DepreciationPolicy
+		status    int
+	}{
+		{
+			name:      "the category fills what the equipment leaves unset",
+			equipment: Equipment{PurchaseCost: 1000, EquipmentCategory: category},
+			want:      DepreciationPolicy{Method: DepreciationStraightLine, Cost: 1000, SalvageValue: 100, UsefulLifeYears: 8},
+		},
+		{
+			name:      "the equipment's own values win over the category",
+			equipment: Equipment{PurchaseCost: 1000, UsefulLifeYears: 4, SalvageValue: 50, EquipmentCategory: category},
+			want:      DepreciationPolicy{Method: DepreciationStraightLine, Cost: 1000, SalvageValue: 50, UsefulLifeYears: 4},
+		},
+		{
+			name:      "without a loaded category the equipment's own values are used",
+			equipment: Equipment{PurchaseCost: 1000, DepreciationMethod: DepreciationDecliningBalance, UsefulLifeYears: 5},
+			want:      DepreciationPolicy{Method: DepreciationDecliningBalance, Cost: 1000, UsefulLifeYears: 5, DecliningRate: 0.4},
+		},
+		{
+			name:      "without a loaded category and a method of its own there is no policy",
+			equipment: Equipment{PurchaseCost: 1000, UsefulLifeYears: 5},
+			status:    http.StatusUnprocessableEntity,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := depreciationPolicy(tt.equipment)
+			if tt.status != 0 {
+				var httpError *HTTPError
+				if !errors.As(err, &httpError) || httpError.Status != tt.status {
+					t.Errorf("depreciationPolicy = %+v, %v, want status %d", got, err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("depreciationPolicy = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
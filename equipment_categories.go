@@ -1,23 +1,28 @@
 package main
 
 import (
-	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 	"net/http"
 )
 
 type EquipmentCategory struct {
 	gorm.Model
-	CompanyID        uint               `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	Company          Company            `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	ParentCategoryID uint               `gorm:"default:null" validate:"alphanum"`
-	ParentCategory   *EquipmentCategory `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	CompanyID        uint               `gorm:"type:int(10);index;not null" validate:"required"`
+	Company          *Company           `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	ParentCategoryID uint               `gorm:"default:null"`
+	ParentCategory   *EquipmentCategory `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
 	CategoryName     string             `gorm:"type:varchar(255);not null" validate:"required,max=255"`
 	IsMainCategory   bool               `gorm:"default:false;not null" validate:"required,boolean"`
+	// Depreciation defaults used by equipment that does not set its own.
+	DepreciationMethod string  `gorm:"type:varchar(30)" validate:"omitempty,oneof=straight_line declining_balance units_of_production"`
+	UsefulLifeYears    int     `gorm:"type:int(10);not null;default:0" validate:"gte=0"`
+	DecliningRate      float64 `gorm:"type:decimal(5,4);not null;default:0" validate:"gte=0,lte=1"`
+	SalvageRate        float64 `gorm:"type:decimal(5,4);not null;default:0" validate:"gte=0,lte=1"`
+	LifetimeUnits      float64 `gorm:"type:decimal(14,2);not null;default:0" validate:"gte=0"`
 }
 
 func (c *EquipmentCategory) Decode(data []byte) (EquipmentCategory, error) {
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return EquipmentCategory{}, err
 	}
@@ -31,26 +36,26 @@ func (c *EquipmentCategory) Encode() ([]byte, error) {
 func equipmentCategoryCreateHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	var c EquipmentCategory
 	data, err := c.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result := db.Create(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -60,9 +65,14 @@ func equipmentCategoryCreateHandler(w http.ResponseWriter, r *http.Request) {
 
 func equipmentCategoryReadHandler(w http.ResponseWriter, r *http.Request) {
 	var data []EquipmentCategory
-	result := db.Find(&data)
+	query, err := includeQuery(r, &EquipmentCategory{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.Find(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -71,16 +81,21 @@ func equipmentCategoryReadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func equipmentCategoryReadOneHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	if id == "" {
-		responseWithMsg(w, http.StatusBadRequest, "id is required")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
 	var data EquipmentCategory
-	result := db.First(&data, id)
+	query, err := includeQuery(r, &EquipmentCategory{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -90,35 +105,39 @@ func equipmentCategoryReadOneHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func equipmentCategoryUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data EquipmentCategory
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	data, err = data.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result = db.Save(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -127,15 +146,14 @@ func equipmentCategoryUpdateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func equipmentCategoryDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	if id == "" {
-		responseWithMsg(w, http.StatusBadRequest, "id is required")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
-	result := db.Delete(&EquipmentCategory{}, id)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	if err = trashRecord(db, EquipmentCategoriesTable, id); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type EquipmentDocVersion struct {
+	gorm.Model
+	EquipmentDocID uint          `gorm:"type:int(10);not null;uniqueIndex:idx_doc_version"`
+	EquipmentDoc   *EquipmentDoc `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	Version        int           `gorm:"type:int(10);not null;uniqueIndex:idx_doc_version"`
+	StoredFileID   uint          `gorm:"type:int(10);index;not null"`
+	StoredFile     *StoredFile   `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	UploadedByID   *uint         `gorm:"type:int(10);index;default:NULL"`
+	UploadedBy     *User         `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:",omitempty"`
+	SHA256         string        `gorm:"type:char(64);not null;column:sha256"`
+	ChangeNote     string        `gorm:"type:varchar(500)"`
+}
+
+func formUserID(fields map[string]string, r *http.Request) *uint {
+	raw := fields["uploaded_by"]
+	if raw == "" {
+		raw = r.URL.Query().Get("uploaded_by")
+	}
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil || id == 0 {
+		return nil
+	}
+	uploader := uint(id)
+	return &uploader
+}
+
+// addEquipmentDocVersion appends a version pointing at the stored file and
+// makes it the current one.
+func addEquipmentDocVersion(tx *gorm.DB, doc *EquipmentDoc, file StoredFile, uploadedBy *uint, note string) (EquipmentDocVersion, error) {
+	version := EquipmentDocVersion{
+		EquipmentDocID: doc.ID,
+		Version:        doc.CurrentVersion + 1,
+		StoredFileID:   file.ID,
+		UploadedByID:   uploadedBy,
+		SHA256:         file.SHA256,
+		ChangeNote:     note,
+	}
+	if result := tx.Create(&version); result.Error != nil {
+		return EquipmentDocVersion{}, result.Error
+	}
+
+	doc.CurrentVersion = version.Version
+	doc.DocURL = fileDownloadURL(file)
+	doc.UploadDate = time.Now()
+	result := tx.Model(doc).UpdateColumns(map[string]interface{}{
+		"current_version": doc.CurrentVersion,
+		"doc_url":         doc.DocURL,
+		"upload_date":     doc.UploadDate,
+	})
+	return version, result.Error
+}
+
+// equipmentDocUploadHandler stores a new revision of the document. Earlier
+// revisions are kept; "change_note" and "uploaded_by" may be sent as form
+// fields before the file.
+func equipmentDocUploadHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var doc EquipmentDoc
+	result := db.First(&doc, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	file, fields, err := storeUpload(w, r, EquipmentDocsTable, doc.ID, fileOwners[EquipmentDocsTable].types)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			responseWithError(w, r, withStatus(http.StatusRequestEntityTooLarge, err))
+			return
+		}
+		responseWithError(w, r, err)
+		return
+	}
+
+	var version EquipmentDocVersion
+	err = db.Transaction(func(tx *gorm.DB) error {
+		version, err = addEquipmentDocVersion(tx, &doc, file, formUserID(fields, r), fields["change_note"])
+		return err
+	})
+	if err != nil {
+		_ = store.Delete(file.StorageKey)
+		db.Unscoped().Delete(&file)
+		responseWithError(w, r, err)
+		return
+	}
+
+	version.StoredFile = &file
+	responseWithJSON(w, http.StatusOK, version, fmt.Sprintf("equipment doc with id %s is now at version %d", id, version.Version))
+	return
+}
+
+func equipmentDocVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var data []EquipmentDocVersion
+	result := db.Preload("StoredFile").Where("equipment_doc_id = ?", id).Order("version DESC").Find(&data)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, data, "equipment doc versions read")
+	return
+}
+
+// findEquipmentDocVersion loads a revision with its file. A revision whose
+// file is gone is as missing as one that never existed.
+func findEquipmentDocVersion(r *http.Request) (EquipmentDocVersion, error) {
+	var version EquipmentDocVersion
+	result := db.Preload("StoredFile").
+		Where("equipment_doc_id = ? AND version = ?", chi.URLParam(r, "id"), chi.URLParam(r, "version")).
+		First(&version)
+	if result.Error != nil {
+		return version, result.Error
+	}
+	if version.StoredFile == nil {
+		return version, withStatus(http.StatusNotFound, fmt.Errorf("the file of version %d is gone", version.Version))
+	}
+	return version, nil
+}
+
+func equipmentDocVersionDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := findEquipmentDocVersion(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	serveStoredFile(w, r, *version.StoredFile)
+}
+
+// equipmentDocVersionRestoreHandler makes an earlier revision current again by
+// appending it as a new version, so the history is never rewritten.
+func equipmentDocVersionRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	version, err := findEquipmentDocVersion(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	var doc EquipmentDoc
+	result := db.First(&doc, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	var restored EquipmentDocVersion
+	err = db.Transaction(func(tx *gorm.DB) error {
+		restored, err = addEquipmentDocVersion(tx, &doc, *version.StoredFile, formUserID(nil, r),
+			fmt.Sprintf("restored from version %d", version.Version))
+		return err
+	})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	restored.StoredFile = version.StoredFile
+	responseWithJSON(w, http.StatusOK, restored, fmt.Sprintf("equipment doc with id %s restored to version %d", id, version.Version))
+	return
+}
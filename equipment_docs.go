@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 	"net/http"
 	"time"
@@ -10,15 +9,17 @@ import (
 
 type EquipmentDoc struct {
 	gorm.Model
-	EquipmentID uint      `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	Equipment   Equipment `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	DocName     string    `gorm:"varchar(255);not null" validate:"required,max=255"`
-	DocURL      string    `gorm:"varchar(255);not null" validate:"required,max=255"`
-	UploadDate  time.Time `gorm:"not null" validate:"required,datetime"`
+	EquipmentID    uint                  `gorm:"type:int(10);index;not null" validate:"required"`
+	Equipment      *Equipment            `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	DocName        string                `gorm:"varchar(255);not null" validate:"required,max=255"`
+	DocURL         string                `gorm:"varchar(255);not null" validate:"required,max=255"`
+	UploadDate     time.Time             `gorm:"not null" validate:"required"`
+	CurrentVersion int                   `gorm:"type:int(10);not null;default:0"`
+	Versions       []EquipmentDocVersion `gorm:"foreignKey:EquipmentDocID" json:",omitempty"`
 }
 
 func (c *EquipmentDoc) Decode(data []byte) (EquipmentDoc, error) {
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return EquipmentDoc{}, err
 	}
@@ -29,29 +30,36 @@ func (c *EquipmentDoc) Encode() ([]byte, error) {
 	return json.Marshal(c)
 }
 
+// keepVersion stops an update from touching the version history, which only
+// uploads and restores change.
+func (c *EquipmentDoc) keepVersion(currentVersion int) {
+	c.CurrentVersion = currentVersion
+	c.Versions = nil
+}
+
 func equipmentDocCreateHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	var c EquipmentDoc
 	data, err := c.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result := db.Create(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -61,9 +69,17 @@ func equipmentDocCreateHandler(w http.ResponseWriter, r *http.Request) {
 
 func equipmentDocReadHandler(w http.ResponseWriter, r *http.Request) {
 	var data []EquipmentDoc
-	result := db.Find(&data)
+	query, err := includeQuery(r, &EquipmentDoc{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if r.URL.Query().Get("versions") == "true" {
+		query = query.Preload("Versions", func(db *gorm.DB) *gorm.DB { return db.Order("version DESC") })
+	}
+	result := query.Find(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -72,11 +88,23 @@ func equipmentDocReadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func equipmentDocReadOneHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data EquipmentDoc
-	result := db.First(&data, id)
+	query, err := includeQuery(r, &EquipmentDoc{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if r.URL.Query().Get("versions") == "true" {
+		query = query.Preload("Versions", func(db *gorm.DB) *gorm.DB { return db.Order("version DESC") })
+	}
+	result := query.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -85,35 +113,41 @@ func equipmentDocReadOneHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func equipmentDocUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data EquipmentDoc
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
+	currentVersion := data.CurrentVersion
 
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	data, err = data.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
+	data.keepVersion(currentVersion)
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result = db.Save(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -122,16 +156,14 @@ func equipmentDocUpdateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func equipmentDocDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	if id == "" {
-		responseWithMsg(w, http.StatusBadRequest, "id is required")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
-	var data EquipmentDoc
-	result := db.Delete(&data, id)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	if err = trashRecord(db, EquipmentDocsTable, id); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
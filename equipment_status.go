@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+const (
+	EquipmentCommissioning  = "commissioning"
+	EquipmentInService      = "in_service"
+	EquipmentDown           = "down"
+	EquipmentUnderRepair    = "under_repair"
+	EquipmentStandby        = "standby"
+	EquipmentDecommissioned = "decommissioned"
+	EquipmentDisposed       = "disposed"
+)
+
+var equipmentStatusTransitions = map[string][]string{
+	EquipmentCommissioning:  {EquipmentInService, EquipmentStandby, EquipmentDecommissioned},
+	EquipmentInService:      {EquipmentDown, EquipmentUnderRepair, EquipmentStandby, EquipmentDecommissioned},
+	EquipmentDown:           {EquipmentUnderRepair, EquipmentInService, EquipmentStandby, EquipmentDecommissioned},
+	EquipmentUnderRepair:    {EquipmentInService, EquipmentDown, EquipmentStandby, EquipmentDecommissioned},
+	EquipmentStandby:        {EquipmentInService, EquipmentCommissioning, EquipmentUnderRepair, EquipmentDecommissioned},
+	EquipmentDecommissioned: {EquipmentDisposed, EquipmentCommissioning},
+	EquipmentDisposed:       {},
+}
+
+type EquipmentStatusHistory struct {
+	gorm.Model
+	EquipmentID uint       `gorm:"type:int(10);index;not null" validate:"required"`
+	Equipment   *Equipment `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	UserID      *uint      `gorm:"type:int(10);index;default:NULL"`
+	User        *User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:",omitempty"`
+	FromStatus  string     `gorm:"type:varchar(20)"`
+	ToStatus    string     `gorm:"type:varchar(20);not null" validate:"required"`
+	Reason      string     `gorm:"type:varchar(500)" validate:"max=500"`
+	ChangedAt   time.Time  `gorm:"not null"`
+}
+
+type EquipmentStatusChange struct {
+	Status string `json:"status" validate:"required,oneof=commissioning in_service down under_repair standby decommissioned disposed"`
+	Reason string `json:"reason" validate:"max=500"`
+	UserID *uint  `json:"user_id"`
+}
+
+func canTransitionEquipment(from, to string) bool {
+	if from == "" || from == to {
+		return true
+	}
+	for _, next := range equipmentStatusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// equipmentAcceptsWork reports an error when the equipment has left service
+// for good and must not receive new schedules or parts usage.
+func equipmentAcceptsWork(tx *gorm.DB, equipmentID uint) error {
+	var equipment Equipment
+	result := tx.Select("id", "status").First(&equipment, equipmentID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if equipment.Status == EquipmentDecommissioned || equipment.Status == EquipmentDisposed {
+		return withStatus(http.StatusConflict, fmt.Errorf("equipment %d is %s and cannot receive new work", equipmentID, equipment.Status))
+	}
+	return nil
+}
+
+// changeEquipmentStatus validates the transition and records it in the
+// equipment status history within the given transaction.
+func changeEquipmentStatus(tx *gorm.DB, equipment *Equipment, change EquipmentStatusChange) error {
+	if !canTransitionEquipment(equipment.Status, change.Status) {
+		return withStatus(http.StatusConflict, fmt.Errorf("equipment cannot move from %s to %s", equipment.Status, change.Status))
+	}
+	if equipment.Status == change.Status {
+		return nil
+	}
+
+	entry := EquipmentStatusHistory{
+		EquipmentID: equipment.ID,
+		UserID:      change.UserID,
+		FromStatus:  equipment.Status,
+		ToStatus:    change.Status,
+		Reason:      change.Reason,
+		ChangedAt:   time.Now(),
+	}
+	if result := tx.Create(&entry); result.Error != nil {
+		return result.Error
+	}
+
+	equipment.Status = change.Status
+	return tx.Model(equipment).UpdateColumn("status", change.Status).Error
+}
+
+func equipmentStatusChangeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var equipment Equipment
+	result := db.First(&equipment, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	body, err := Reader(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	var change EquipmentStatusChange
+	if err = decodeJSON(body, &change); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	validationErrors := Validate(change)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return changeEquipmentStatus(tx, &equipment, change)
+	})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, equipment, fmt.Sprintf("equipment with id %s is now %s", id, equipment.Status))
+	return
+}
+
+func equipmentStatusHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var data []EquipmentStatusHistory
+	result := db.Where("equipment_id = ?", id).Order("changed_at").Find(&data)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, data, "equipment status history read")
+	return
+}
+
+func maintenanceHistoryAcceptsWork(tx *gorm.DB, historyID uint) error {
+	var history MaintenanceHistory
+	result := tx.Select("id", "equipment_id").First(&history, historyID)
+	if result.Error != nil {
+		return result.Error
+	}
+	return equipmentAcceptsWork(tx, history.EquipmentID)
+}
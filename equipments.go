@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 	"net/http"
 	"time"
@@ -10,20 +9,31 @@ import (
 
 type Equipment struct {
 	gorm.Model
-	CompanyID           uint              `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	Company             Company           `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	EquipmentCategoryID uint              `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	EquipmentCategory   EquipmentCategory `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	Name                string            `gorm:"varchar(255);not null" validate:"required,max=255"`
-	PurchaseDate        time.Time         `gorm:"not null" validate:"required,datetime"`
-	WarrantyExpiry      time.Time         `gorm:"not null" validate:"required,datetime"`
-	LastMaintenanceDate time.Time         `gorm:"not null" validate:"required,datetime"`
-	ImageURL            string            `gorm:"varchar(255);" validate:"max=255"`
-	AdditionalNotes     string            `gorm:"varchar(500);" validate:"max=500"`
+	CompanyID           uint               `gorm:"type:int(10);index;not null" validate:"required"`
+	Company             *Company           `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	EquipmentCategoryID uint               `gorm:"type:int(10);index;not null" validate:"required"`
+	EquipmentCategory   *EquipmentCategory `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	Name                string             `gorm:"varchar(255);not null" validate:"required,max=255"`
+	PurchaseDate        time.Time          `gorm:"not null" validate:"required"`
+	WarrantyExpiry      time.Time          `gorm:"not null" validate:"required"`
+	LastMaintenanceDate time.Time          `gorm:"not null" validate:"required"`
+	ImageURL            string             `gorm:"varchar(255);" validate:"max=255"`
+	AdditionalNotes     string             `gorm:"varchar(500);" validate:"max=500"`
+	Status              string             `gorm:"type:ENUM('commissioning','in_service','down','under_repair','standby','decommissioned','disposed');not null;default:'commissioning';column:status" validate:"omitempty,oneof=commissioning in_service down under_repair standby decommissioned disposed"`
+	SerialNumber        string             `gorm:"type:varchar(255);index" validate:"max=255"`
+	Manufacturer        string             `gorm:"type:varchar(255)" validate:"max=255"`
+	ModelName           string             `gorm:"type:varchar(255)" validate:"max=255"`
+	PurchaseCost        float64            `gorm:"type:decimal(14,2);not null;default:0" validate:"gte=0"`
+	SalvageValue        float64            `gorm:"type:decimal(14,2);not null;default:0" validate:"gte=0"`
+	DepreciationMethod  string             `gorm:"type:varchar(30)" validate:"omitempty,oneof=straight_line declining_balance units_of_production"`
+	UsefulLifeYears     int                `gorm:"type:int(10);not null;default:0" validate:"gte=0"`
+	DecliningRate       float64            `gorm:"type:decimal(5,4);not null;default:0" validate:"gte=0,lte=1"`
+	LifetimeUnits       float64            `gorm:"type:decimal(14,2);not null;default:0" validate:"gte=0"`
+	AssetTag            *string            `gorm:"type:varchar(64);uniqueIndex;default:NULL" validate:"omitempty,max=64"`
 }
 
 func (c *Equipment) Decode(data []byte) (Equipment, error) {
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return Equipment{}, err
 	}
@@ -34,29 +44,72 @@ func (c *Equipment) Encode() ([]byte, error) {
 	return json.Marshal(c)
 }
 
+// createEquipment stores new equipment with its asset tag and opens its
+// status history with the status it starts in, commissioning unless another
+// one is given, so the history shows when it entered the register.
+func createEquipment(tx *gorm.DB, data *Equipment) error {
+	if data.Status == "" {
+		data.Status = EquipmentCommissioning
+	}
+	if result := tx.Create(data); result.Error != nil {
+		return result.Error
+	}
+	tag, err := assignAssetTag(tx, EquipmentTable, data.ID, data.AssetTag)
+	if err != nil {
+		return err
+	}
+	data.AssetTag = &tag
+	entry := EquipmentStatusHistory{
+		EquipmentID: data.ID,
+		ToStatus:    data.Status,
+		Reason:      "created",
+		ChangedAt:   time.Now(),
+	}
+	return tx.Create(&entry).Error
+}
+
+// saveEquipment stores changed equipment. An empty asset tag keeps the
+// previous one and a new status goes through the status history.
+func saveEquipment(tx *gorm.DB, data *Equipment, previousStatus string, previousTag *string) error {
+	if data.AssetTag == nil || *data.AssetTag == "" {
+		data.AssetTag = previousTag
+	}
+	requestedStatus := data.Status
+	data.Status = previousStatus
+	if result := tx.Save(data); result.Error != nil {
+		return result.Error
+	}
+	if requestedStatus == "" {
+		return nil
+	}
+	return changeEquipmentStatus(tx, data, EquipmentStatusChange{Status: requestedStatus})
+}
+
 func equipmentCreateHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	var c Equipment
 	data, err := c.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
-	result := db.Create(&data)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return createEquipment(tx, &data)
+	})
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
@@ -66,9 +119,14 @@ func equipmentCreateHandler(w http.ResponseWriter, r *http.Request) {
 
 func equipmentReadHandler(w http.ResponseWriter, r *http.Request) {
 	var data []Equipment
-	result := db.Find(&data)
+	query, err := includeQuery(r, &Equipment{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.Find(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 	responseWithJSON(w, http.StatusOK, data, "equipment read")
@@ -76,11 +134,20 @@ func equipmentReadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func equipmentReadOneHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data Equipment
-	result := db.First(&data, id)
+	query, err := includeQuery(r, &Equipment{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 	responseWithJSON(w, http.StatusOK, data, "equipment read")
@@ -88,35 +155,44 @@ func equipmentReadOneHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func equipmentUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data Equipment
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
+	previousStatus := data.Status
+	previousTag := data.AssetTag
+
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	data, err = data.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
-	result = db.Save(&data)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return saveEquipment(tx, &data, previousStatus, previousTag)
+	})
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
@@ -125,16 +201,14 @@ func equipmentUpdateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func equipmentDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	if id == "" {
-		responseWithMsg(w, http.StatusBadRequest, "id is required")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
-	var data Equipment
-	result := db.Delete(&data, id)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	if err = trashRecord(db, EquipmentTable, id); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Single records carry an ETag holding their version, a digest of the stored
+// row, so any change to it gives a new tag, including changes made behind the
+// API such as recalculated totals. Reads with a query or in a spreadsheet
+// format add a digest of those to the tag, as they answer with a different
+// body. Reads answer 304 when If-None-Match still matches. Writes honour
+// If-Match and answer 412 when the record changed since the client read it;
+// with REQUIRE_IF_MATCH=true writes without it are refused with 428. Every
+// write aimed at a record, action routes such as /equipment/{id}/status
+// included, holds the record's lock while it runs, so none of them can slip in
+// between a version check and the write it guards.
+
+// rowVersion returns the ETag of a live record, or an empty string when there
+// is no such record.
+func rowVersion(tx *gorm.DB, t Tables, id string) (string, error) {
+	var row map[string]interface{}
+	result := tx.Model(t.Struct()).Where("id = ?", id).Take(&row)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	if result.Error != nil {
+		return "", result.Error
+	}
+	encoded, err := json.Marshal(row)
+	if err != nil {
+		return "", err
+	}
+	return `"` + sha256Hex(encoded)[:32] + `"`, nil
+}
+
+// representationTag turns a record's version into the ETag of the body a read
+// asks for. ?include=, ?fields=, ?tz= and the negotiated format all change the
+// body, so the normalized query and the format are folded into the tag. The
+// plain JSON record keeps the bare version.
+func representationTag(r *http.Request, version string) string {
+	query, format := r.URL.Query().Encode(), exportFormat(r)
+	if query == "" && format == "" {
+		return version
+	}
+	return strings.TrimSuffix(version, `"`) + "-" + sha256Hex([]byte(query + "\x00" + format))[:16] + `"`
+}
+
+// tagVersion takes the record version back out of a representation's tag.
+func tagVersion(etag string) string {
+	if i := strings.IndexByte(etag, '-'); i >= 0 {
+		return etag[:i] + `"`
+	}
+	return etag
+}
+
+// etagMatches checks an If-Match or If-None-Match header against a tag. Weak
+// comparison, used for If-None-Match, ignores the W/ prefix. Strong
+// comparison, used for If-Match, compares record versions only, so the tag of
+// any representation of the record can guard a write.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		} else {
+			candidate = tagVersion(candidate)
+		}
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// withRecordLock runs fn holding a database lock named after the record, so
+// checking its version and writing it cannot interleave with another write
+// to it, even one served by another instance.
+func withRecordLock(t Tables, id string, fn func() error) error {
+	return withRecordLocks(t, []string{id}, fn)
+}
+
+// withRecordLocks holds the locks of several records at once. They are taken
+// in order so two requests over the same records cannot deadlock.
+func withRecordLocks(t Tables, ids []string, fn func() error) error {
+	ids = append([]string(nil), ids...)
+	sort.Strings(ids)
+	return db.Connection(func(conn *gorm.DB) error {
+		for i, id := range ids {
+			if i > 0 && id == ids[i-1] {
+				continue
+			}
+			name := fmt.Sprintf("%s:%s", t, id)
+			var acquired int
+			if result := conn.Raw("SELECT GET_LOCK(?, ?)", name, envInt("RECORD_LOCK_TIMEOUT_SECONDS", 10)).Scan(&acquired); result.Error != nil {
+				return result.Error
+			}
+			if acquired != 1 {
+				return withStatus(http.StatusConflict, fmt.Errorf("%s %s is being changed by another request, try again", t, id))
+			}
+			defer conn.Exec("SELECT RELEASE_LOCK(?)", name)
+		}
+		return fn()
+	})
+}
+
+// versionWriter tags a successful write with the version it produced.
+type versionWriter struct {
+	http.ResponseWriter
+	target requestTarget
+}
+
+func (v *versionWriter) WriteHeader(status int) {
+	if status < http.StatusBadRequest {
+		if etag, err := rowVersion(db, v.target.table, v.target.id); err == nil && etag != "" {
+			v.Header().Set("ETag", etag)
+		}
+	}
+	v.ResponseWriter.WriteHeader(status)
+}
+
+func conditionalRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, ok := requestTargetOf(r)
+		if !ok || target.id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// only the record itself is versioned, not its actions or its trash
+		conditional := !target.trash && target.action == ""
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			if !conditional {
+				next.ServeHTTP(w, r)
+				return
+			}
+			version, err := rowVersion(db, target.table, target.id)
+			if err != nil {
+				responseWithError(w, r, err)
+				return
+			}
+			if version != "" {
+				etag := representationTag(r, version)
+				w.Header().Set("ETag", etag)
+				if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag, true) {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+			if !conditional || r.Method == http.MethodPost {
+				err := withRecordLock(target.table, target.id, func() error {
+					next.ServeHTTP(w, r)
+					return nil
+				})
+				if err != nil {
+					responseWithError(w, r, err)
+				}
+				return
+			}
+
+			writer := &versionWriter{ResponseWriter: w, target: target}
+			match := r.Header.Get("If-Match")
+			if match == "" && os.Getenv("REQUIRE_IF_MATCH") == "true" {
+				responseWithMsg(w, http.StatusPreconditionRequired,
+					fmt.Sprintf("send the ETag of %s %s in If-Match to change it", target.table, target.id))
+				return
+			}
+
+			err := withRecordLock(target.table, target.id, func() error {
+				if match != "" {
+					etag, err := rowVersion(db, target.table, target.id)
+					if err != nil {
+						return err
+					}
+					if etag == "" || !etagMatches(match, etag, false) {
+						return withStatus(http.StatusPreconditionFailed,
+							fmt.Errorf("%s %s was changed since it was read, fetch it again and retry", target.table, target.id))
+					}
+				}
+				next.ServeHTTP(writer, r)
+				return nil
+			})
+			if err != nil {
+				responseWithError(w, r, err)
+			}
+
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+const testVersion = `"0123456789abcdef0123456789abcdef"`
+
+func representationOf(target string, accept string) string {
+	r := httptest.NewRequest("GET", target, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	return representationTag(r, testVersion)
+}
+
+func TestRepresentationTag(t *testing.T) {
+	plain := representationOf("/equipment/4", "")
+	if plain != testVersion {
+		t.Fatalf("plain record tagged %s, want the bare version %s", plain, testVersion)
+	}
+
+	tags := map[string]string{}
+	for _, variant := range []struct{ target, accept string }{
+		{"/equipment/4", ""},
+		{"/equipment/4?include=company", ""},
+		{"/equipment/4?fields=id,name", ""},
+		{"/equipment/4?tz=Europe/Berlin", ""},
+		{"/equipment/4?format=csv", ""},
+		{"/equipment/4?format=xlsx", ""},
+		{"/equipment/4", csvContentType},
+		{"/equipment/4", xlsxContentType},
+	} {
+		tag := representationOf(variant.target, variant.accept)
+		key := variant.target + " Accept: " + variant.accept
+		for other, otherTag := range tags {
+			if tag == otherTag {
+				t.Errorf("%s and %s share the tag %s", key, other, tag)
+			}
+		}
+		tags[key] = tag
+		if version := tagVersion(tag); version != testVersion {
+			t.Errorf("%s: tag %s holds version %s, want %s", key, tag, version, testVersion)
+		}
+	}
+
+	if a, b := representationOf("/equipment/4?tz=UTC&include=company", ""), representationOf("/equipment/4?include=company&tz=UTC", ""); a != b {
+		t.Errorf("the order of query parameters changed the tag: %s and %s", a, b)
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	withInclude := representationOf("/equipment/4?include=company", "")
+	tests := []struct {
+		name   string
+		header string
+		etag   string
+		weak   bool
+		want   bool
+	}{
+		{"If-Match with the bare version", testVersion, testVersion, false, true},
+		{"If-Match with the tag of a representation", withInclude, testVersion, false, true},
+		{"If-Match with another version", `"ffffffffffffffffffffffffffffffff"`, testVersion, false, false},
+		{"If-Match with a list", `"x", ` + testVersion, testVersion, false, true},
+		{"If-Match with any", "*", testVersion, false, true},
+		{"If-None-Match with the same representation", "W/" + withInclude, withInclude, true, true},
+		{"If-None-Match with another representation", testVersion, withInclude, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatches(tt.header, tt.etag, tt.weak); got != tt.want {
+				t.Errorf("etagMatches(%s, %s, %v) = %v, want %v", tt.header, tt.etag, tt.weak, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"sort"
+)
+
+type FailureCode struct {
+	gorm.Model
+	CompanyID   uint     `gorm:"type:int(10);index;not null" validate:"required"`
+	Company     *Company `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	Kind        string   `gorm:"type:ENUM('problem','cause','remedy');not null;column:kind" validate:"required,oneof=problem cause remedy"`
+	Code        string   `gorm:"type:varchar(50);not null" validate:"required,max=50"`
+	Description string   `gorm:"type:varchar(500)" validate:"max=500"`
+}
+
+type FailureParetoRow struct {
+	EquipmentCategoryID uint    `json:"equipment_category_id"`
+	CategoryName        string  `json:"category_name"`
+	FailureCodeID       uint    `json:"failure_code_id"`
+	Code                string  `json:"code"`
+	Description         string  `json:"description"`
+	Occurrences         int64   `json:"occurrences"`
+	Percent             float64 `json:"percent"`
+	CumulativePercent   float64 `json:"cumulative_percent"`
+}
+
+var failureCodeColumns = map[string]string{
+	"problem": "problem_code_id",
+	"cause":   "cause_code_id",
+	"remedy":  "remedy_code_id",
+}
+
+func failureCodeCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if Create(w, r, FailureCodesTable) {
+		fmt.Println("failure code created")
+		return
+	}
+	fmt.Println("failure code not created")
+	return
+}
+
+func failureCodeReadHandler(w http.ResponseWriter, r *http.Request) {
+	if Read(w, r, FailureCodesTable) {
+		fmt.Println("failure codes read")
+		return
+	}
+	fmt.Println("failure codes not read")
+	return
+}
+
+func failureCodeReadOneHandler(w http.ResponseWriter, r *http.Request) {
+	if ReadOne(w, r, FailureCodesTable) {
+		fmt.Println("failure code read")
+		return
+	}
+	fmt.Println("failure code not read")
+	return
+}
+
+func failureCodeUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if Update(w, r, FailureCodesTable) {
+		fmt.Println("failure code updated")
+		return
+	}
+	fmt.Println("failure code not updated")
+	return
+}
+
+func failureCodeDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if Delete(w, r, FailureCodesTable) {
+		fmt.Println("failure code deleted")
+		return
+	}
+	fmt.Println("failure code not deleted")
+	return
+}
+
+// failureCodeParetoHandler ranks failure codes of the requested kind (cause by
+// default) by how often they were recorded on maintenance history, per
+// equipment category, with the cumulative share used for Pareto charts.
+func failureCodeParetoHandler(w http.ResponseWriter, r *http.Request) {
+	companyID := r.URL.Query().Get("company_id")
+	if companyID == "" {
+		responseWithMsg(w, http.StatusBadRequest, "company_id is required")
+		return
+	}
+
+	kind := r.URL.Query().Get("kind")
+	if kind == "" {
+		kind = "cause"
+	}
+	column, ok := failureCodeColumns[kind]
+	if !ok {
+		responseWithMsg(w, http.StatusBadRequest, "kind must be one of problem, cause, remedy")
+		return
+	}
+
+	query := db.Table("maintenance_history").
+		Select("equipment_categories.id AS equipment_category_id, equipment_categories.category_name, "+
+			"failure_codes.id AS failure_code_id, failure_codes.code, failure_codes.description, "+
+			"COUNT(*) AS occurrences").
+		Joins("JOIN equipment ON equipment.id = maintenance_history.equipment_id").
+		Joins("JOIN equipment_categories ON equipment_categories.id = equipment.equipment_category_id").
+		Joins("JOIN failure_codes ON failure_codes.id = maintenance_history."+column).
+		Where("equipment.company_id = ? AND maintenance_history.deleted_at IS NULL", companyID)
+	if categoryID := r.URL.Query().Get("equipment_category_id"); categoryID != "" {
+		query = query.Where("equipment_categories.id = ?", categoryID)
+	}
+
+	var rows []FailureParetoRow
+	result := query.
+		Group("equipment_categories.id, equipment_categories.category_name, failure_codes.id, failure_codes.code, failure_codes.description").
+		Scan(&rows)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, paretoRank(rows), fmt.Sprintf("%s pareto read", kind))
+	return
+}
+
+func paretoRank(rows []FailureParetoRow) []FailureParetoRow {
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].EquipmentCategoryID != rows[j].EquipmentCategoryID {
+			return rows[i].EquipmentCategoryID < rows[j].EquipmentCategoryID
+		}
+		return rows[i].Occurrences > rows[j].Occurrences
+	})
+
+	totals := map[uint]int64{}
+	for _, row := range rows {
+		totals[row.EquipmentCategoryID] += row.Occurrences
+	}
+
+	running := map[uint]int64{}
+	for i := range rows {
+		total := totals[rows[i].EquipmentCategoryID]
+		running[rows[i].EquipmentCategoryID] += rows[i].Occurrences
+		rows[i].Percent = float64(rows[i].Occurrences) * 100 / float64(total)
+		rows[i].CumulativePercent = float64(running[rows[i].EquipmentCategoryID]) * 100 / float64(total)
+	}
+	return rows
+}
+
+// checkFailureCodes makes sure every code attached to a history entry is of
+// the matching kind and belongs to the company owning the equipment.
+func checkFailureCodes(h MaintenanceHistory) error {
+	codes := map[string]*uint{
+		"problem": h.ProblemCodeID,
+		"cause":   h.CauseCodeID,
+		"remedy":  h.RemedyCodeID,
+	}
+	for kind, id := range codes {
+		if id == nil {
+			continue
+		}
+		var code FailureCode
+		result := db.Table("failure_codes").
+			Joins("JOIN equipment ON equipment.company_id = failure_codes.company_id").
+			Where("failure_codes.id = ? AND failure_codes.kind = ? AND equipment.id = ?", *id, kind, h.EquipmentID).
+			First(&code)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return &HTTPError{Status: http.StatusUnprocessableEntity, Field: kind + "_code_id",
+				Err: fmt.Errorf("%s code %d is not a %s code of the equipment's company", kind, *id, kind)}
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type StoredFile struct {
+	gorm.Model
+	OwnerType   string `gorm:"type:varchar(50);not null;index:idx_owner"`
+	OwnerID     uint   `gorm:"type:int(10);not null;index:idx_owner"`
+	StorageKey  string `gorm:"type:varchar(500);not null"`
+	FileName    string `gorm:"type:varchar(255);not null"`
+	ContentType string `gorm:"type:varchar(255);not null"`
+	Size        int64  `gorm:"not null"`
+	SHA256      string `gorm:"type:char(64);not null;column:sha256"`
+}
+
+type fileOwner struct {
+	column string
+	types  []string
+}
+
+var documentContentTypes = []string{
+	"application/pdf",
+	"application/zip",
+	"application/msword",
+	"application/vnd.",
+	"application/octet-stream",
+	"image/",
+	"text/",
+}
+
+// fileOwners lists which records accept uploads, the column pointing at the
+// stored file and the sniffed content types that are accepted.
+var fileOwners = map[Tables]fileOwner{
+	EquipmentDocsTable:       {column: "doc_url", types: documentContentTypes}, // versioned, see equipmentDocUploadHandler
+	ComplianceDocumentsTable: {column: "document_url", types: documentContentTypes},
+	EquipmentTable:           {column: "image_url", types: []string{"image/jpeg", "image/png", "image/gif", "image/webp"}},
+}
+
+func maxUploadBytes() int64 {
+	return int64(envInt("UPLOAD_MAX_BYTES", 20<<20))
+}
+
+func allowedContentType(contentType string, allowed []string) bool {
+	for _, prefix := range allowed {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func randomKey() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// storeUpload sniffs, checksums and stores the "file" part of a multipart
+// request for the given owner. The body is spooled to a temporary file first
+// so the size limit is enforced before anything reaches the storage backend.
+// Plain form fields sent before the file are returned alongside it.
+func storeUpload(w http.ResponseWriter, r *http.Request, owner Tables, ownerID uint, allowed []string) (StoredFile, map[string]string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes())
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return StoredFile{}, nil, readError(err)
+	}
+
+	fields := map[string]string{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return StoredFile{}, nil, &HTTPError{Status: http.StatusBadRequest, Field: "file", Err: errors.New("multipart field file is required")}
+		}
+		if err != nil {
+			return StoredFile{}, nil, readError(err)
+		}
+		if part.FormName() != "file" {
+			value, _ := io.ReadAll(io.LimitReader(part, 1024))
+			fields[part.FormName()] = string(value)
+			part.Close()
+			continue
+		}
+		defer part.Close()
+
+		buffered := bufio.NewReaderSize(part, 512)
+		head, err := buffered.Peek(512)
+		if err != nil && err != io.EOF && !errors.Is(err, bufio.ErrBufferFull) {
+			return StoredFile{}, nil, readError(err)
+		}
+		contentType := http.DetectContentType(head)
+		if !allowedContentType(contentType, allowed) {
+			return StoredFile{}, nil, &HTTPError{Status: http.StatusUnsupportedMediaType, Field: "file", Err: fmt.Errorf("content type %s is not accepted here", contentType)}
+		}
+
+		tmp, err := os.CreateTemp("", "upload-*")
+		if err != nil {
+			return StoredFile{}, nil, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(tmp, hash), buffered)
+		if err != nil {
+			return StoredFile{}, nil, err
+		}
+		if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+			return StoredFile{}, nil, err
+		}
+
+		file := StoredFile{
+			OwnerType:   owner.String(),
+			OwnerID:     ownerID,
+			StorageKey:  fmt.Sprintf("%s/%d/%d-%s", owner.String(), ownerID, time.Now().UnixNano(), randomKey()),
+			FileName:    part.FileName(),
+			ContentType: contentType,
+			Size:        size,
+			SHA256:      hex.EncodeToString(hash.Sum(nil)),
+		}
+		if err = store.Put(file.StorageKey, tmp, size, contentType); err != nil {
+			return StoredFile{}, nil, err
+		}
+		if result := db.Create(&file); result.Error != nil {
+			_ = store.Delete(file.StorageKey)
+			return StoredFile{}, nil, result.Error
+		}
+		return file, fields, nil
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func fileDownloadURL(file StoredFile) string {
+	return fmt.Sprintf("/files/%d/download", file.ID)
+}
+
+// uploadHandler accepts a file for a record of the given table, replacing any
+// file it held before and pointing the record's URL column at the download.
+func uploadHandler(t Tables) http.HandlerFunc {
+	owner := fileOwners[t]
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+		ownerID, _ := strconv.ParseUint(id, 10, 64)
+
+		var data = t.Struct()
+		result := db.Table(t.String()).First(data, id)
+		if result.Error != nil {
+			responseWithError(w, r, result.Error)
+			return
+		}
+
+		var previous []StoredFile
+		result = db.Where("owner_type = ? AND owner_id = ?", t.String(), ownerID).Find(&previous)
+		if result.Error != nil {
+			responseWithError(w, r, result.Error)
+			return
+		}
+
+		file, _, err := storeUpload(w, r, t, uint(ownerID), owner.types)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				responseWithError(w, r, withStatus(http.StatusRequestEntityTooLarge, err))
+				return
+			}
+			responseWithError(w, r, err)
+			return
+		}
+
+		result = db.Table(t.String()).Where("id = ?", ownerID).UpdateColumn(owner.column, fileDownloadURL(file))
+		if result.Error != nil {
+			responseWithError(w, r, result.Error)
+			return
+		}
+
+		for _, old := range previous {
+			_ = store.Delete(old.StorageKey)
+			db.Unscoped().Delete(&old)
+		}
+
+		responseWithJSON(w, http.StatusOK, file, fmt.Sprintf("file uploaded to %s %s", t.String(), id))
+		return
+	}
+}
+
+func fileReadOneHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var data StoredFile
+	query, err := includeQuery(r, &StoredFile{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, data, "file read")
+	return
+}
+
+// fileDownloadHandler streams a stored file. http.ServeContent takes care of
+// Range, If-Range and conditional requests using the checksum as ETag.
+func fileDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var data StoredFile
+	result := db.First(&data, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	serveStoredFile(w, r, data)
+}
+
+func serveStoredFile(w http.ResponseWriter, r *http.Request, data StoredFile) {
+	content, err := store.Open(data.StorageKey)
+	if errors.Is(err, os.ErrNotExist) {
+		responseWithError(w, r, withStatus(http.StatusNotFound, fmt.Errorf("file %s is missing from storage", data.FileName)))
+		return
+	}
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", data.ContentType)
+	w.Header().Set("ETag", `"`+data.SHA256+`"`)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", data.FileName))
+	http.ServeContent(w, r, data.FileName, data.UpdatedAt, content)
+}
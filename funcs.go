@@ -1,12 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"github.com/go-chi/chi/v5"
 	jsoniter "github.com/json-iterator/go"
 	"io"
 	"net/http"
 	"reflect"
+	"strconv"
 )
 
 type Response struct {
@@ -16,6 +17,10 @@ type Response struct {
 }
 
 func responseWithMsg(w http.ResponseWriter, statusCode int, msg string) {
+	if statusCode >= http.StatusBadRequest {
+		writeProblem(w, newProblem(statusCode, msg))
+		return
+	}
 	w.WriteHeader(statusCode)
 	res := Response{
 		Message: msg,
@@ -36,11 +41,40 @@ func responseWithJSON(w http.ResponseWriter, statusCode int, data interface{}, m
 	w.Header().Set("Content-Type", "application/json")
 }
 
+// responseWithValidationErrors answers 422 with every field that failed
+// validation, not just the first one.
+func responseWithValidationErrors(w http.ResponseWriter, errs ValidationErrors) {
+	writeProblem(w, problemFor(errs))
+}
+
 func Reader(r *http.Request) ([]byte, error) {
 	if r.Body == nil {
 		return nil, nil
 	}
-	return io.ReadAll(r.Body)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, readError(err)
+	}
+	return body, nil
+}
+
+// readError gives a failure to read the request the status it is answered
+// with: 413 when the body is over the size limit, 400 otherwise.
+func readError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return withStatus(http.StatusRequestEntityTooLarge, err)
+	}
+	return withStatus(http.StatusBadRequest, err)
+}
+
+// decodeJSON decodes a request body. Malformed JSON is the client's fault, so
+// the error is answered with 400.
+func decodeJSON(body []byte, v interface{}) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+	return nil
 }
 
 func EmptyFields(data interface{}) (emptyFields []string) {
@@ -91,7 +125,7 @@ func Encode(data interface{}) ([]byte, error) {
 
 func Decode(data []byte, c interface{}) (interface{}, error) {
 	fmt.Println("Decode")
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return nil, err
 	}
@@ -99,39 +133,42 @@ func Decode(data []byte, c interface{}) (interface{}, error) {
 }
 
 func Update(w http.ResponseWriter, r *http.Request, t Tables) bool {
-	id := chi.URLParam(r, "id")
-	if id == "" || id == "0" || id == " " || len(id) == 0 || id == "null" || id == "undefined" || id == "NaN" {
-		responseWithMsg(w, http.StatusBadRequest, "id is required")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
 		return false
 	}
 
 	var data = t.Struct()
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return false
 	}
 
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return false
 	}
 
-	if err = json.Unmarshal(body, &data); err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+	if err = decodeJSON(body, &data); err != nil {
+		responseWithError(w, r, err)
 		return false
 	}
+	// The record written is the one in the path, whatever id the body holds.
+	n, _ := strconv.ParseUint(id, 10, 64)
+	reflect.ValueOf(data).Elem().FieldByName("ID").SetUint(n)
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return false
 	}
 
 	result = db.Table(t.String()).Updates(data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return false
 	}
 
@@ -142,25 +179,25 @@ func Update(w http.ResponseWriter, r *http.Request, t Tables) bool {
 func Create(w http.ResponseWriter, r *http.Request, t Tables) bool {
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return false
 	}
 
 	var data = t.Struct()
-	if err = json.Unmarshal(body, &data); err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+	if err = decodeJSON(body, &data); err != nil {
+		responseWithError(w, r, err)
 		return false
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return false
 	}
 
 	result := db.Table(t.String()).Create(data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return false
 	}
 
@@ -169,10 +206,17 @@ func Create(w http.ResponseWriter, r *http.Request, t Tables) bool {
 }
 
 func Read(w http.ResponseWriter, r *http.Request, t Tables) bool {
-	var data = t.Slice()
-	result := db.Table(t.String()).Find(&data)
+	query, err := includeQuery(r, t.Struct())
+	if err != nil {
+		responseWithError(w, r, err)
+		return false
+	}
+
+	// preloading needs a typed destination rather than an interface
+	var data = reflect.New(reflect.TypeOf(t.Slice())).Interface()
+	result := query.Table(t.String()).Find(data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return false
 	}
 
@@ -181,16 +225,22 @@ func Read(w http.ResponseWriter, r *http.Request, t Tables) bool {
 }
 
 func ReadOne(w http.ResponseWriter, r *http.Request, t Tables) bool {
-	id := chi.URLParam(r, "id")
-	if id == "" || id == "0" || id == " " || len(id) == 0 || id == "null" || id == "undefined" || id == "NaN" {
-		responseWithMsg(w, http.StatusBadRequest, "id is required")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return false
+	}
+
+	query, err := includeQuery(r, t.Struct())
+	if err != nil {
+		responseWithError(w, r, err)
 		return false
 	}
 
 	var data = t.Struct()
-	result := db.Table(t.String()).First(&data, id)
+	result := query.Table(t.String()).First(data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return false
 	}
 
@@ -199,16 +249,14 @@ func ReadOne(w http.ResponseWriter, r *http.Request, t Tables) bool {
 }
 
 func Delete(w http.ResponseWriter, r *http.Request, t Tables) bool {
-	id := chi.URLParam(r, "id")
-	if id == "" || id == "0" || id == " " || len(id) == 0 || id == "null" || id == "undefined" || id == "NaN" {
-		responseWithMsg(w, http.StatusBadRequest, "id is required")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
 		return false
 	}
 
-	var data = t.Struct()
-	result := db.Table(t.String()).Delete(&data, id)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	if err = trashRecord(db, t, id); err != nil {
+		responseWithError(w, r, err)
 		return false
 	}
 
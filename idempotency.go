@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// POST requests carrying an Idempotency-Key header are executed once per key
+// and acting user. The first response is stored for IDEMPOTENCY_KEY_TTL (24h
+// by default) and replayed to retries with the same key, so a client on a bad
+// connection can resend a create without making a duplicate. Reusing a key
+// for a different request is refused, as is a retry while the first attempt
+// is still running. Server errors are not stored, so they can be retried.
+// Responses too large to keep are not replayed: the key stays claimed and
+// retries are refused with the status the first request got, so the write is
+// still made only once.
+
+const maxIdempotentResponseBytes = 1 << 20
+
+type IdempotencyKey struct {
+	ID          uint      `gorm:"primarykey"`
+	CreatedAt   time.Time `gorm:"not null"`
+	Key         string    `gorm:"type:varchar(255);not null;column:idempotency_key;uniqueIndex:idx_idempotency_key_user"`
+	UserID      uint      `gorm:"type:int(10);not null;default:0;uniqueIndex:idx_idempotency_key_user"`
+	Fingerprint string    `gorm:"type:char(64);not null"`
+	Status      int       `gorm:"type:int(10);not null;default:0"`
+	ContentType string    `gorm:"type:varchar(255)"`
+	Location    string    `gorm:"type:varchar(2048)"`
+	ETag        string    `gorm:"type:varchar(100);column:etag"`
+	Response    []byte    `gorm:"type:longblob"`
+	Oversized   bool      `gorm:"not null;default:false"`
+	ExpiresAt   time.Time `gorm:"not null;index"`
+}
+
+// claimIdempotencyKey reserves the key for this request. When it is taken,
+// the stored claim is returned instead. Expired claims, and pending ones whose
+// request died without finishing, are freed first.
+func claimIdempotencyKey(key string, userID uint, fingerprint string) (IdempotencyKey, bool, error) {
+	now := time.Now().UTC()
+	abandoned := now.Add(-envDuration("IDEMPOTENCY_PENDING_TIMEOUT", 5*time.Minute))
+	result := db.Where("idempotency_key = ? AND user_id = ?", key, userID).
+		Where("expires_at <= ? OR (status = 0 AND created_at <= ?)", now, abandoned).
+		Delete(&IdempotencyKey{})
+	if result.Error != nil {
+		return IdempotencyKey{}, false, result.Error
+	}
+
+	claim := IdempotencyKey{
+		Key:         key,
+		UserID:      userID,
+		Fingerprint: fingerprint,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(envDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour)),
+	}
+	result = db.Create(&claim)
+	if result.Error == nil {
+		return claim, true, nil
+	}
+	var mysqlError *mysql.MySQLError
+	if !errors.As(result.Error, &mysqlError) || mysqlError.Number != 1062 {
+		return IdempotencyKey{}, false, result.Error
+	}
+
+	var existing IdempotencyKey
+	if result := db.Where("idempotency_key = ? AND user_id = ?", key, userID).First(&existing); result.Error != nil {
+		return IdempotencyKey{}, false, result.Error
+	}
+	return existing, false, nil
+}
+
+// idempotencyRecorder passes a response through while keeping a copy to
+// replay.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (i *idempotencyRecorder) WriteHeader(status int) {
+	i.status = status
+	i.ResponseWriter.WriteHeader(status)
+}
+
+func (i *idempotencyRecorder) Write(p []byte) (int, error) {
+	if i.body.Len()+len(p) > maxIdempotentResponseBytes {
+		i.truncated = true
+	} else {
+		i.body.Write(p)
+	}
+	return i.ResponseWriter.Write(p)
+}
+
+// finishIdempotencyKey stores the response for replay, or releases the key
+// after a server error. Of a response too large to keep only the status and
+// headers are stored, marked as oversized.
+func finishIdempotencyKey(claim IdempotencyKey, recorder *idempotencyRecorder) error {
+	if recorder.status >= http.StatusInternalServerError {
+		return db.Delete(&claim).Error
+	}
+	response := recorder.body.Bytes()
+	if recorder.truncated {
+		response = nil
+	}
+	return db.Model(&claim).Updates(map[string]interface{}{
+		"status":       recorder.status,
+		"content_type": recorder.Header().Get("Content-Type"),
+		"location":     recorder.Header().Get("Location"),
+		"etag":         recorder.Header().Get("ETag"),
+		"response":     response,
+		"oversized":    recorder.truncated,
+	}).Error
+}
+
+func purgeExpiredIdempotencyKeys() error {
+	return db.Where("expires_at <= ?", time.Now().UTC()).Delete(&IdempotencyKey{}).Error
+}
+
+func idempotentPosts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			responseWithMsg(w, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		actorID, err := requestActor(r)
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+		var userID uint
+		if actorID != nil {
+			userID = *actorID
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadBytes()+1<<20))
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256Hex(append([]byte(r.Method+" "+r.URL.RequestURI()+"\n"), body...))
+
+		claim, claimed, err := claimIdempotencyKey(key, userID, fingerprint)
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+		if !claimed {
+			switch {
+			case claim.Fingerprint != fingerprint:
+				responseWithMsg(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+			case claim.Status == 0:
+				responseWithMsg(w, http.StatusConflict, "a request with this Idempotency-Key is still being processed")
+			case claim.Oversized:
+				if claim.Location != "" {
+					w.Header().Set("Location", claim.Location)
+				}
+				responseWithMsg(w, http.StatusConflict, fmt.Sprintf(
+					"the request with this Idempotency-Key was already answered with %d %s, its response was too large to keep for replay",
+					claim.Status, http.StatusText(claim.Status)))
+			default:
+				if claim.ContentType != "" {
+					w.Header().Set("Content-Type", claim.ContentType)
+				}
+				if claim.Location != "" {
+					w.Header().Set("Location", claim.Location)
+				}
+				if claim.ETag != "" {
+					w.Header().Set("ETag", claim.ETag)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(claim.Status)
+				_, _ = w.Write(claim.Response)
+			}
+			return
+		}
+
+		recorder := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		if err := finishIdempotencyKey(claim, recorder); err != nil {
+			log.Printf("idempotency key %q: %v", key, err)
+		}
+	})
+}
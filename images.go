@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+type ImageAttachment struct {
+	gorm.Model
+	OwnerType    string           `gorm:"type:varchar(50);not null;index:idx_owner"`
+	OwnerID      uint             `gorm:"type:int(10);not null;index:idx_owner"`
+	StoredFileID *uint            `gorm:"type:int(10);index;default:NULL"`
+	StoredFile   *StoredFile      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:",omitempty"`
+	Caption      string           `gorm:"type:varchar(500)"`
+	Width        int              `gorm:"type:int(10);not null;default:0"`
+	Height       int              `gorm:"type:int(10);not null;default:0"`
+	Orientation  int              `gorm:"type:tinyint;not null;default:1"`
+	Thumbnails   []ImageThumbnail `gorm:"foreignKey:ImageAttachmentID" json:",omitempty"`
+}
+
+type ImageThumbnail struct {
+	gorm.Model
+	ImageAttachmentID uint        `gorm:"type:int(10);not null;uniqueIndex:idx_attachment_size"`
+	Size              string      `gorm:"type:varchar(10);not null;uniqueIndex:idx_attachment_size"`
+	StoredFileID      uint        `gorm:"type:int(10);index;not null"`
+	StoredFile        *StoredFile `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	Width             int         `gorm:"type:int(10);not null"`
+	Height            int         `gorm:"type:int(10);not null"`
+	URL               string      `gorm:"-"`
+}
+
+// thumbnailSizes maps each fixed thumbnail size to the length of its longest
+// side in pixels.
+var thumbnailSizes = map[string]int{
+	"small":  160,
+	"medium": 480,
+	"large":  1024,
+}
+
+var imageContentTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+const maxImagePixels = 50_000_000
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 when the
+// file carries none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return 1
+		}
+		if marker == 0xE1 {
+			if o := exifOrientation(data[i+4 : i+2+size]); o > 0 {
+				return o
+			}
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+func exifOrientation(segment []byte) int {
+	if len(segment) < 14 || string(segment[:6]) != "Exif\x00\x00" {
+		return 0
+	}
+	tiff := segment[6:]
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for k := 0; k < entries; k++ {
+		entry := offset + 2 + k*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// orient returns the image as it should be displayed for the given EXIF
+// orientation.
+func orient(src image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// resize scales the image down so its longest side is at most maxSide, using
+// area averaging. Images already small enough are returned unchanged.
+func resize(src image.Image, maxSide int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxSide && h <= maxSide {
+		return src
+	}
+
+	dw, dh := maxSide, h*maxSide/w
+	if h > w {
+		dw, dh = w*maxSide/h, maxSide
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// encodeThumbnail keeps photos as JPEG and everything else as PNG so that
+// transparency survives.
+func encodeThumbnail(img image.Image, format string) ([]byte, string, string, error) {
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), "image/jpeg", "jpg", err
+	}
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), "image/png", "png", err
+}
+
+// generateThumbnails decodes the original, applies its EXIF orientation and
+// stores one thumbnail per fixed size.
+func generateThumbnails(attachment *ImageAttachment, original StoredFile) error {
+	content, err := store.Open(original.StorageKey)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return withStatus(http.StatusUnprocessableEntity, err)
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return withStatus(http.StatusUnprocessableEntity, fmt.Errorf("image of %dx%d pixels is too large", config.Width, config.Height))
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return withStatus(http.StatusUnprocessableEntity, err)
+	}
+
+	attachment.Orientation = 1
+	if format == "jpeg" {
+		attachment.Orientation = jpegOrientation(data)
+	}
+	upright := orient(img, attachment.Orientation)
+	attachment.Width, attachment.Height = upright.Bounds().Dx(), upright.Bounds().Dy()
+
+	for size, side := range thumbnailSizes {
+		thumb := resize(upright, side)
+		encoded, contentType, ext, err := encodeThumbnail(thumb, format)
+		if err != nil {
+			return err
+		}
+
+		file := StoredFile{
+			OwnerType:   ImageAttachmentsTable.String(),
+			OwnerID:     attachment.ID,
+			StorageKey:  fmt.Sprintf("%s/%d/%s-%s", ImageAttachmentsTable.String(), attachment.ID, size, randomKey()),
+			FileName:    fmt.Sprintf("%s-%s.%s", size, original.FileName, ext),
+			ContentType: contentType,
+			Size:        int64(len(encoded)),
+			SHA256:      sha256Hex(encoded),
+		}
+		if err = store.Put(file.StorageKey, bytes.NewReader(encoded), file.Size, contentType); err != nil {
+			return err
+		}
+		if result := db.Create(&file); result.Error != nil {
+			return result.Error
+		}
+
+		thumbnail := ImageThumbnail{
+			ImageAttachmentID: attachment.ID,
+			Size:              size,
+			StoredFileID:      file.ID,
+			Width:             thumb.Bounds().Dx(),
+			Height:            thumb.Bounds().Dy(),
+		}
+		if result := db.Create(&thumbnail); result.Error != nil {
+			return result.Error
+		}
+		attachment.Thumbnails = append(attachment.Thumbnails, thumbnail)
+	}
+
+	return db.Model(attachment).UpdateColumns(map[string]interface{}{
+		"width":       attachment.Width,
+		"height":      attachment.Height,
+		"orientation": attachment.Orientation,
+	}).Error
+}
+
+func withImageURLs(attachment *ImageAttachment) {
+	for i := range attachment.Thumbnails {
+		attachment.Thumbnails[i].URL = fmt.Sprintf("/images/%d/thumbnails/%s", attachment.ID, attachment.Thumbnails[i].Size)
+	}
+}
+
+// imageUploadHandler adds a photo to the gallery of an equipment or
+// maintenance history record. A "caption" form field may precede the file.
+func imageUploadHandler(t Tables) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+		ownerID, _ := strconv.ParseUint(id, 10, 64)
+
+		var owner = t.Struct()
+		result := db.Table(t.String()).First(owner, id)
+		if result.Error != nil {
+			responseWithError(w, r, result.Error)
+			return
+		}
+
+		attachment := ImageAttachment{OwnerType: t.String(), OwnerID: uint(ownerID)}
+		if result := db.Create(&attachment); result.Error != nil {
+			responseWithError(w, r, result.Error)
+			return
+		}
+
+		file, fields, err := storeUpload(w, r, ImageAttachmentsTable, attachment.ID, imageContentTypes)
+		if err == nil {
+			attachment.StoredFileID = &file.ID
+			attachment.Caption = fields["caption"]
+			err = db.Model(&attachment).UpdateColumns(map[string]interface{}{
+				"stored_file_id": file.ID,
+				"caption":        attachment.Caption,
+			}).Error
+		}
+		if err == nil {
+			err = generateThumbnails(&attachment, file)
+		}
+		if err != nil {
+			// The original and the thumbnails stored so far are files owned
+			// by the attachment, so purging it leaves nothing behind.
+			_ = purgeRecord(ImageAttachmentsTable, attachment.ID)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				responseWithError(w, r, withStatus(http.StatusRequestEntityTooLarge, err))
+				return
+			}
+			responseWithError(w, r, err)
+			return
+		}
+
+		attachmentID := strconv.FormatUint(uint64(attachment.ID), 10)
+		recordChildAudit(r, ImageAttachmentsTable, attachmentID, "create", nil, auditSnapshot(db, ImageAttachmentsTable, attachmentID))
+
+		attachment.StoredFile = &file
+		withImageURLs(&attachment)
+		responseWithJSON(w, http.StatusOK, attachment, fmt.Sprintf("image added to %s %s", t.String(), id))
+		return
+	}
+}
+
+func galleryHandler(t Tables) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+		var data []ImageAttachment
+		result := db.Preload("StoredFile").Preload("Thumbnails").
+			Where("owner_type = ? AND owner_id = ? AND stored_file_id IS NOT NULL", t.String(), id).
+			Order("created_at").
+			Find(&data)
+		if result.Error != nil {
+			responseWithError(w, r, result.Error)
+			return
+		}
+		for i := range data {
+			withImageURLs(&data[i])
+		}
+
+		responseWithJSON(w, http.StatusOK, data, fmt.Sprintf("gallery of %s %s read", t.String(), id))
+		return
+	}
+}
+
+func imageThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	// Thumbnails of an image in the trash are not served either.
+	var attachment ImageAttachment
+	result := db.Select("id").First(&attachment, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	var thumbnail ImageThumbnail
+	result = db.Preload("StoredFile").
+		Where("image_attachment_id = ? AND size = ?", attachment.ID, chi.URLParam(r, "size")).
+		First(&thumbnail)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	if thumbnail.StoredFile == nil {
+		responseWithMsg(w, http.StatusNotFound, "thumbnail not found")
+		return
+	}
+
+	serveStoredFile(w, r, *thumbnail.StoredFile)
+}
+
+func imageDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var attachment ImageAttachment
+	result := db.Preload("StoredFile").First(&attachment, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	if attachment.StoredFile == nil {
+		responseWithMsg(w, http.StatusNotFound, "image not found")
+		return
+	}
+
+	serveStoredFile(w, r, *attachment.StoredFile)
+}
+
+func imageDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	if err = trashRecord(db, ImageAttachmentsTable, id); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	responseWithMsg(w, http.StatusOK, fmt.Sprintf("image with id %s deleted", id))
+	return
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// exifSegment builds an APP1 payload holding a single orientation entry.
+func exifSegment(order binary.ByteOrder, orientation uint16) []byte {
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(&tiff, order, uint16(42))
+	binary.Write(&tiff, order, uint32(8))
+	binary.Write(&tiff, order, uint16(1))
+	binary.Write(&tiff, order, uint16(0x0112))
+	binary.Write(&tiff, order, uint16(3))
+	binary.Write(&tiff, order, uint32(1))
+	binary.Write(&tiff, order, orientation)
+	binary.Write(&tiff, order, uint16(0))
+	binary.Write(&tiff, order, uint32(0))
+	return append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+}
+
+// jpegWithSegment encodes a small JPEG and inserts an APP1 segment right
+// after its start of image marker.
+func jpegWithSegment(t *testing.T, segment []byte) []byte {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 4, 2)), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := encoded.Bytes()
+	if segment == nil {
+		return data
+	}
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	out := append([]byte{}, data[:2]...)
+	out = append(out, app1...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"little endian", jpegWithSegment(t, exifSegment(binary.LittleEndian, 6)), 6},
+		{"big endian", jpegWithSegment(t, exifSegment(binary.BigEndian, 8)), 8},
+		{"no EXIF", jpegWithSegment(t, nil), 1},
+		{"orientation out of range", jpegWithSegment(t, exifSegment(binary.LittleEndian, 9)), 1},
+		{"APP1 that is not EXIF", jpegWithSegment(t, []byte("http://ns.adobe.com/xap/1.0/\x00")), 1},
+		{"truncated EXIF", jpegWithSegment(t, exifSegment(binary.BigEndian, 3)[:16]), 1},
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n"), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jpegOrientation(tt.data); got != tt.want {
+				t.Errorf("jpegOrientation = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// the decoder must still read the file the segment was added to
+	if _, err := jpeg.Decode(bytes.NewReader(tests[0].data)); err != nil {
+		t.Errorf("the test JPEG does not decode: %v", err)
+	}
+}
+
+// cornerImage is 3 by 2 pixels with a distinct colour in each corner.
+func cornerImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(10, 20, 13, 22))
+	img.Set(10, 20, color.RGBA{R: 255, A: 255})         // top left
+	img.Set(12, 20, color.RGBA{G: 255, A: 255})         // top right
+	img.Set(10, 21, color.RGBA{B: 255, A: 255})         // bottom left
+	img.Set(12, 21, color.RGBA{R: 255, G: 255, A: 255}) // bottom right
+	return img
+}
+
+func TestOrient(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+	green := color.RGBA{G: 255, A: 255}
+	blue := color.RGBA{B: 255, A: 255}
+	yellow := color.RGBA{R: 255, G: 255, A: 255}
+	tests := []struct {
+		orientation int
+		w, h        int
+		topLeft     color.RGBA
+		topRight    color.RGBA
+	}{
+		{1, 3, 2, red, green},
+		{2, 3, 2, green, red},
+		{3, 3, 2, yellow, blue},
+		{4, 3, 2, blue, yellow},
+		{5, 2, 3, red, blue},
+		{6, 2, 3, blue, red},
+		{7, 2, 3, yellow, green},
+		{8, 2, 3, green, yellow},
+	}
+	for _, tt := range tests {
+		got := orient(cornerImage(), tt.orientation)
+		b := got.Bounds()
+		if b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orientation %d gave %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		topLeft := color.RGBAModel.Convert(got.At(b.Min.X, b.Min.Y)).(color.RGBA)
+		topRight := color.RGBAModel.Convert(got.At(b.Max.X-1, b.Min.Y)).(color.RGBA)
+		if topLeft != tt.topLeft || topRight != tt.topRight {
+			t.Errorf("orientation %d has %v and %v on top, want %v and %v", tt.orientation, topLeft, topRight, tt.topLeft, tt.topRight)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		w, h, side int
+		wantW      int
+		wantH      int
+	}{
+		{1000, 500, 160, 160, 80},
+		{500, 1000, 160, 80, 160},
+		{100, 40, 160, 100, 40},
+		{2000, 1, 160, 160, 1},
+	}
+	for _, tt := range tests {
+		got := resize(image.NewGray(image.Rect(0, 0, tt.w, tt.h)), tt.side).Bounds()
+		if got.Dx() != tt.wantW || got.Dy() != tt.wantH {
+			t.Errorf("resize %dx%d to %d gave %dx%d, want %dx%d", tt.w, tt.h, tt.side, got.Dx(), got.Dy(), tt.wantW, tt.wantH)
+		}
+	}
+
+	// each pixel is the average of the area it covers
+	src := image.NewGray(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		src.SetGray(0, y, color.Gray{Y: 255})
+		src.SetGray(1, y, color.Gray{Y: 255})
+		src.SetGray(2, y, color.Gray{Y: 255})
+	}
+	got := resize(src, 2)
+	if b := got.Bounds(); b.Dx() != 2 || b.Dy() != 1 {
+		t.Fatalf("resize 4x2 to 2 gave %dx%d, want 2x1", b.Dx(), b.Dy())
+	}
+	left := color.GrayModel.Convert(got.At(0, 0)).(color.Gray).Y
+	right := color.GrayModel.Convert(got.At(1, 0)).(color.Gray).Y
+	if left != 255 || right < 126 || right > 128 {
+		t.Errorf("averaged to %d and %d, want 255 and 127", left, right)
+	}
+}
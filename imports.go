@@ -0,0 +1,705 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"gorm.io/gorm"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Equipment, inventory, suppliers and service providers can be loaded from
+// spreadsheets. POST a CSV or XLSX file to /imports/{resource}, as the "file"
+// part of a multipart form or as the body, and it is queued as a job whose
+// progress and per-row outcome are read from /imports/{id}. Each column is
+// matched to the field of the same name unless mapping says otherwise, e.g.
+// mapping={"Asset":"name","Site":"company_id"}; a column mapped to "" is left
+// out. Rows update the record that has the same natural key, such as the name
+// and company of equipment, and create one otherwise, going through the same
+// validation and rules as single writes. Jobs run like batches, atomic unless
+// mode=best-effort, and with dry_run=true every row is checked and then rolled
+// back, so the report shows what the import would do.
+
+const (
+	ImportQueued    = "queued"
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed"
+)
+
+// importKeys are the fields that identify an existing record of each
+// importable resource.
+var importKeys = map[Tables][]string{
+	EquipmentTable:        {"name", "company_id"},
+	InventoryTable:        {"name", "company_id"},
+	SuppliersTable:        {"supplier_name"},
+	ServiceProvidersTable: {"name"},
+}
+
+type ImportJob struct {
+	ID             uint              `gorm:"primarykey"`
+	CreatedAt      time.Time         `gorm:"not null;index"`
+	UpdatedAt      time.Time         `gorm:"not null"`
+	Resource       string            `gorm:"type:varchar(50);not null;index"`
+	ActorID        *uint             `gorm:"type:int(10);index;default:NULL"`
+	RequestID      string            `gorm:"type:varchar(100)"`
+	FileName       string            `gorm:"type:varchar(255)"`
+	Mode           string            `gorm:"type:varchar(20);not null"`
+	DryRun         bool              `gorm:"not null;default:false"`
+	Status         string            `gorm:"type:ENUM('queued','running','completed','failed');not null;default:'queued';index"`
+	Total          int               `gorm:"type:int(10);not null;default:0"`
+	Processed      int               `gorm:"type:int(10);not null;default:0"`
+	Created        int               `gorm:"type:int(10);not null;default:0"`
+	Updated        int               `gorm:"type:int(10);not null;default:0"`
+	Failed         int               `gorm:"type:int(10);not null;default:0"`
+	RolledBack     bool              `gorm:"not null;default:false"`
+	Error          string            `gorm:"type:varchar(500)"`
+	StartedAt      *time.Time        `gorm:"default:NULL"`
+	FinishedAt     *time.Time        `gorm:"default:NULL"`
+	Mapping        string            `gorm:"type:text;not null" json:"-"`
+	Source         string            `gorm:"type:longtext;not null" json:"-"`
+	Results        string            `gorm:"type:longtext" json:"-"`
+	Columns        map[string]string `gorm:"-"`
+	IgnoredColumns []string          `gorm:"-"`
+	Rows           []ImportRowResult `gorm:"-"`
+}
+
+type ImportRowResult struct {
+	Row    int      `json:"row"`
+	Action string   `json:"action,omitempty"`
+	ID     uint     `json:"id,omitempty"`
+	Status int      `json:"status"`
+	Error  *Problem `json:"error,omitempty"`
+}
+
+// importRow is a row of the sheet with its cells keyed by field.
+type importRow struct {
+	Row    int               `json:"row"`
+	Values map[string]string `json:"values"`
+}
+
+type importMapping struct {
+	Columns map[string]string `json:"columns"`
+	Ignored []string          `json:"ignored"`
+}
+
+func (j *ImportJob) decode(withRows bool) error {
+	var mapping importMapping
+	if j.Mapping != "" {
+		if err := json.Unmarshal([]byte(j.Mapping), &mapping); err != nil {
+			return err
+		}
+	}
+	j.Columns, j.IgnoredColumns = mapping.Columns, mapping.Ignored
+	if withRows && j.Results != "" {
+		return json.Unmarshal([]byte(j.Results), &j.Rows)
+	}
+	return nil
+}
+
+// importFields lists the fields a sheet can fill, by the name the API gives
+// them, with their Go type.
+func importFields(t Tables) (map[string]reflect.Type, error) {
+	s, err := modelSchema(t.Struct())
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]reflect.Type{}
+	for _, field := range s.Fields {
+		if field.DBName == "" || field.PrimaryKey || field.AutoCreateTime != 0 || field.AutoUpdateTime != 0 || field.Name == "DeletedAt" {
+			continue
+		}
+		if name := jsonFieldName(field.StructField); name != "" {
+			fields[name] = field.FieldType
+		}
+	}
+	return fields, nil
+}
+
+// headerField spells a column header the way fields are named, so that
+// "Purchase Date" matches purchase_date.
+func headerField(header string) string {
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(strings.ToLower(strings.TrimSpace(header)))
+}
+
+// mapColumns works out which field each column of the header fills.
+func mapColumns(header []string, mapping map[string]string, fields map[string]reflect.Type, keys []string) (map[int]string, importMapping, error) {
+	for column, field := range mapping {
+		if _, ok := fields[field]; field != "" && !ok {
+			return nil, importMapping{}, &HTTPError{Status: http.StatusBadRequest, Field: "mapping",
+				Err: fmt.Errorf("column %q is mapped to %s, which is not a field that can be imported", column, field)}
+		}
+	}
+
+	byIndex := map[int]string{}
+	described := importMapping{Columns: map[string]string{}, Ignored: []string{}}
+	usedBy := map[string]string{}
+	for i, column := range header {
+		field, mapped := mapping[column]
+		if !mapped {
+			field = headerField(column)
+			if _, ok := fields[field]; !ok {
+				field = ""
+			}
+		}
+		if field == "" {
+			if strings.TrimSpace(column) != "" {
+				described.Ignored = append(described.Ignored, column)
+			}
+			continue
+		}
+		if other, taken := usedBy[field]; taken {
+			return nil, importMapping{}, &HTTPError{Status: http.StatusBadRequest, Field: "mapping",
+				Err: fmt.Errorf("columns %q and %q both fill %s", other, column, field)}
+		}
+		usedBy[field] = column
+		byIndex[i] = field
+		described.Columns[column] = field
+	}
+
+	var missing []string
+	for _, key := range keys {
+		if _, ok := usedBy[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, importMapping{}, &HTTPError{Status: http.StatusBadRequest, Field: "mapping",
+			Err: fmt.Errorf("map a column to %s, which identify the records to update", strings.Join(missing, " and "))}
+	}
+	return byIndex, described, nil
+}
+
+// sheetTime reads a date as ISO 8601 text or as the serial number
+// spreadsheets store dates as, counting days from 30 December 1899.
+func sheetTime(raw string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	serial, err := strconv.ParseFloat(raw, 64)
+	if err != nil || serial <= 0 || serial >= 2958466 {
+		return time.Time{}, errors.New("not a date")
+	}
+	seconds := int64(serial*86400 + 0.5)
+	return time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC).Add(time.Duration(seconds) * time.Second), nil
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	nullStringType = reflect.TypeOf(sql.NullString{})
+)
+
+// cellValue converts the text of a cell to the JSON value of a field of the
+// given type.
+func cellValue(typ reflect.Type, raw string) (interface{}, string) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ {
+	case timeType:
+		t, err := sheetTime(raw)
+		if err != nil {
+			return nil, "a date like 2024-05-31 or 2024-05-31T08:00:00Z"
+		}
+		return t.Format(time.RFC3339), ""
+	case nullStringType:
+		return map[string]interface{}{"string": raw, "valid": true}, ""
+	}
+
+	switch typ.Kind() {
+	case reflect.String:
+		return raw, ""
+	case reflect.Bool:
+		switch strings.ToLower(raw) {
+		case "1", "true", "yes", "y":
+			return true, ""
+		case "0", "false", "no", "n":
+			return false, ""
+		}
+		return nil, "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil || n != float64(int64(n)) {
+			return nil, "a whole number"
+		}
+		return int64(n), ""
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil || n < 0 || n != float64(uint64(n)) {
+			return nil, "a whole number that is not negative"
+		}
+		return uint64(n), ""
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, "a number"
+		}
+		return n, ""
+	}
+	return nil, "left out, it cannot be imported"
+}
+
+// rowItem turns a row into the JSON body a single write would get. Empty
+// cells are left out so that updates keep what the record has.
+func rowItem(row importRow, fields map[string]reflect.Type) ([]byte, map[string]interface{}, error) {
+	item := map[string]interface{}{}
+	var invalid ValidationErrors
+	names := make([]string, 0, len(row.Values))
+	for name := range row.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		raw := strings.TrimSpace(row.Values[name])
+		if raw == "" {
+			continue
+		}
+		value, expected := cellValue(fields[name], raw)
+		if expected != "" {
+			invalid = append(invalid, ValidationError{
+				Field:   name,
+				Tag:     "type",
+				Kind:    fields[name].Kind().String(),
+				Type:    fields[name].String(),
+				Value:   raw,
+				Message: fmt.Sprintf("%s must be %s", name, expected),
+			})
+			continue
+		}
+		item[name] = value
+	}
+	if len(invalid) > 0 {
+		return nil, nil, invalid
+	}
+	body, err := json.Marshal(item)
+	return body, item, err
+}
+
+// importTarget finds the record a row updates by its natural key. Rows
+// without a complete key create a record.
+func importTarget(tx *gorm.DB, t Tables, item map[string]interface{}) (string, error) {
+	conditions := map[string]interface{}{}
+	for _, key := range importKeys[t] {
+		value, ok := item[key]
+		if !ok {
+			return "", nil
+		}
+		conditions[key] = value
+	}
+	var ids []uint
+	if result := tx.Model(t.Struct()).Where(conditions).Limit(2).Pluck("id", &ids); result.Error != nil {
+		return "", result.Error
+	}
+	switch len(ids) {
+	case 0:
+		return "", nil
+	case 1:
+		return strconv.FormatUint(uint64(ids[0]), 10), nil
+	}
+	return "", withStatus(http.StatusConflict,
+		fmt.Errorf("more than one %s has this %s, the row cannot tell which to update", t, strings.Join(importKeys[t], " and ")))
+}
+
+// sheetRows keys the cells of each row below the header by the field their
+// column fills, numbering rows as the spreadsheet does. Blank rows are left
+// out.
+func sheetRows(sheet [][]string, columns map[int]string) []importRow {
+	var rows []importRow
+	for i, cells := range sheet[1:] {
+		row := importRow{Row: i + 2, Values: map[string]string{}}
+		blank := true
+		for index, field := range columns {
+			if index < len(cells) {
+				row.Values[field] = cells[index]
+				blank = blank && strings.TrimSpace(cells[index]) == ""
+			}
+		}
+		if !blank {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// importJobStale is the time before which a running job that reported no
+// progress is taken to have lost its worker.
+func importJobStale() time.Time {
+	return time.Now().UTC().Add(-envDuration("IMPORT_STALE_AFTER", 30*time.Minute))
+}
+
+// runImport works through a queued job. The job is claimed first, so it runs
+// once even when several instances look for work.
+func runImport(id uint) error {
+	now := time.Now().UTC()
+	claim := db.Model(&ImportJob{}).Where("id = ? AND status = ?", id, ImportQueued).
+		Updates(map[string]interface{}{"status": ImportRunning, "started_at": now})
+	if claim.Error != nil || claim.RowsAffected == 0 {
+		return claim.Error
+	}
+
+	var job ImportJob
+	if result := db.First(&job, id); result.Error != nil {
+		return result.Error
+	}
+	err := processImportSafely(&job)
+	finished := time.Now().UTC()
+	update := map[string]interface{}{
+		"status":      ImportCompleted,
+		"finished_at": finished,
+		"processed":   job.Processed,
+		"created":     job.Created,
+		"updated":     job.Updated,
+		"failed":      job.Failed,
+		"rolled_back": job.RolledBack,
+		"results":     job.Results,
+	}
+	if err != nil {
+		log.Printf("[%s] import %d: %v", job.RequestID, id, err)
+		update["status"] = ImportFailed
+		update["error"] = "the import could not be run, quote the correlation ID when reporting it"
+	}
+	return db.Model(&ImportJob{}).Where("id = ?", id).Updates(update).Error
+}
+
+// processImportSafely runs the job off any request, so a panic while it runs
+// is turned into a failed job rather than taking the server down.
+func processImportSafely(job *ImportJob) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v\n%s", p, debug.Stack())
+		}
+	}()
+	return processImport(job)
+}
+
+func processImport(job *ImportJob) error {
+	t, ok := tableNamed(job.Resource)
+	if !ok {
+		return fmt.Errorf("%s cannot be imported", job.Resource)
+	}
+	fields, err := importFields(t)
+	if err != nil {
+		return err
+	}
+	var rows []importRow
+	if err = json.Unmarshal([]byte(job.Source), &rows); err != nil {
+		return err
+	}
+
+	zones := newZones()
+	items := make([]bulkItem, len(rows))
+	values := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		items[i].body, values[i], items[i].err = rowItem(row, fields)
+	}
+	methods := make([]string, len(rows))
+	progress := envInt("IMPORT_PROGRESS_ROWS", 100)
+
+	rolledBack, err := runBatch(job.Mode == bulkAtomic, !job.DryRun, len(items), func(tx *gorm.DB, i int) error {
+		defer func() {
+			if job.Processed = i + 1; job.Processed%progress == 0 {
+				db.Model(&ImportJob{}).Where("id = ?", job.ID).Update("processed", job.Processed)
+			}
+		}()
+		if items[i].err != nil {
+			return items[i].err
+		}
+		id, err := importTarget(tx, t, values[i])
+		if err != nil {
+			items[i].err = err
+			return err
+		}
+		methods[i], items[i].id = http.MethodPost, id
+		if id != "" {
+			methods[i] = http.MethodPut
+		}
+		items[i].err = writeBulkItem(tx, t, methods[i], zones, &items[i])
+		return items[i].err
+	})
+	if err != nil {
+		return err
+	}
+	job.RolledBack = rolledBack && !job.DryRun
+
+	results := make([]ImportRowResult, len(rows))
+	for i, item := range items {
+		result := ImportRowResult{Row: rows[i].Row, Action: map[string]string{http.MethodPost: "create", http.MethodPut: "update"}[methods[i]], Status: http.StatusOK}
+		if n, err := strconv.ParseUint(item.id, 10, 64); err == nil && (methods[i] == http.MethodPut || !job.DryRun) {
+			result.ID = uint(n)
+		}
+		switch {
+		case item.err != nil:
+			result.Error = itemProblem(job.RequestID, fmt.Sprintf("import %d row %d", job.ID, rows[i].Row), item.err)
+			result.Status = result.Error.Status
+			job.Failed++
+		case job.RolledBack:
+			problem := newProblem(http.StatusFailedDependency, "the row was rolled back because another row of the import failed")
+			result.Status = problem.Status
+			result.Error = &problem
+			if methods[i] == http.MethodPost {
+				result.ID = 0
+			}
+		default:
+			if methods[i] == http.MethodPut {
+				job.Updated++
+			} else {
+				job.Created++
+			}
+			if !job.DryRun {
+				recordAudit(job.RequestID, job.ActorID, t, item.id, result.Action, item.before, item.after)
+			}
+		}
+		results[i] = result
+	}
+	encoded, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	job.Results = string(encoded)
+	return nil
+}
+
+// runQueuedImports picks up jobs left queued, for instance by a restart, and
+// gives up on jobs whose worker stopped reporting progress. Finished jobs are
+// removed after IMPORT_JOB_RETENTION_DAYS.
+func runQueuedImports() error {
+	result := db.Model(&ImportJob{}).Where("status = ? AND updated_at <= ?", ImportRunning, importJobStale()).
+		Updates(map[string]interface{}{"status": ImportFailed, "error": "the import stopped before it finished, send the file again", "finished_at": time.Now().UTC()})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	cutoff := time.Now().UTC().AddDate(0, 0, -envInt("IMPORT_JOB_RETENTION_DAYS", 7))
+	result = db.Where("status IN ? AND finished_at <= ?", []string{ImportCompleted, ImportFailed}, cutoff).Delete(&ImportJob{})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	var queued []uint
+	if result = db.Model(&ImportJob{}).Where("status = ?", ImportQueued).Order("id").Pluck("id", &queued); result.Error != nil {
+		return result.Error
+	}
+	for _, id := range queued {
+		if err := runImport(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importUpload reads the sheet and the form fields sent with it.
+func importUpload(w http.ResponseWriter, r *http.Request) ([]byte, string, map[string]string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes())
+	fields := map[string]string{}
+	for _, name := range []string{"mapping", "mode", "dry_run"} {
+		fields[name] = r.URL.Query().Get(name)
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, "", nil, readError(err)
+		}
+		return data, r.URL.Query().Get("filename"), fields, nil
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", nil, readError(err)
+	}
+	var data []byte
+	var name string
+	found := false
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", nil, readError(err)
+		}
+		if part.FormName() == "file" {
+			if data, err = io.ReadAll(part); err != nil {
+				return nil, "", nil, readError(err)
+			}
+			name, found = part.FileName(), true
+			continue
+		}
+		value, _ := io.ReadAll(io.LimitReader(part, 64<<10))
+		fields[part.FormName()] = string(value)
+	}
+	if !found {
+		return nil, "", nil, withStatus(http.StatusBadRequest, errors.New("multipart field file is required"))
+	}
+	return data, name, fields, nil
+}
+
+func importCreateHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := tableNamed(chi.URLParam(r, "resource"))
+	if _, importable := importKeys[t]; !ok || !importable {
+		responseWithMsg(w, http.StatusNotFound, "only equipment, inventory, suppliers and service-providers can be imported")
+		return
+	}
+	actorID, err := requestActor(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	data, fileName, options, err := importUpload(w, r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	mode := options["mode"]
+	if mode == "" {
+		mode = bulkAtomic
+	}
+	if mode != bulkAtomic && mode != bulkBestEffort {
+		responseWithMsg(w, http.StatusBadRequest, fmt.Sprintf("mode must be %s or %s", bulkAtomic, bulkBestEffort))
+		return
+	}
+	dryRun := false
+	if options["dry_run"] != "" {
+		if dryRun, err = strconv.ParseBool(options["dry_run"]); err != nil {
+			responseWithMsg(w, http.StatusBadRequest, "dry_run must be true or false")
+			return
+		}
+	}
+	mapping := map[string]string{}
+	if options["mapping"] != "" {
+		if err = json.Unmarshal([]byte(options["mapping"]), &mapping); err != nil {
+			responseWithError(w, r, &HTTPError{Status: http.StatusBadRequest, Field: "mapping",
+				Err: errors.New("mapping must be a JSON object from column headers to field names")})
+			return
+		}
+	}
+
+	sheet, err := readSpreadsheet(data)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if len(sheet) == 0 {
+		responseWithMsg(w, http.StatusBadRequest, "the file has no header row")
+		return
+	}
+	fields, err := importFields(t)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	columns, described, err := mapColumns(sheet[0], mapping, fields, importKeys[t])
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	rows := sheetRows(sheet, columns)
+	if len(rows) == 0 {
+		responseWithMsg(w, http.StatusBadRequest, "the file has no rows to import")
+		return
+	}
+	if limit := envInt("IMPORT_MAX_ROWS", 10000); len(rows) > limit {
+		responseWithMsg(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("an import takes at most %d rows", limit))
+		return
+	}
+
+	source, err := json.Marshal(rows)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	encodedMapping, err := json.Marshal(described)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	job := ImportJob{
+		Resource:  t.String(),
+		ActorID:   actorID,
+		RequestID: middleware.GetReqID(r.Context()),
+		FileName:  fileName,
+		Mode:      mode,
+		DryRun:    dryRun,
+		Status:    ImportQueued,
+		Total:     len(rows),
+		Mapping:   string(encodedMapping),
+		Source:    string(source),
+	}
+	if result := db.Create(&job); result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	go func() {
+		if err := runImport(job.ID); err != nil {
+			log.Printf("[%s] import %d: %v", job.RequestID, job.ID, err)
+		}
+	}()
+
+	job.Columns, job.IgnoredColumns = described.Columns, described.Ignored
+	w.Header().Set("Location", fmt.Sprintf("/imports/%d", job.ID))
+	responseWithJSON(w, http.StatusAccepted, job, fmt.Sprintf("import of %d %s rows queued", len(rows), t))
+	return
+}
+
+func importJobReadHandler(w http.ResponseWriter, r *http.Request) {
+	query := db.Omit("source", "results").Order("id DESC")
+	if v := r.URL.Query().Get("resource"); v != "" {
+		t, ok := tableNamed(v)
+		if !ok {
+			responseWithError(w, r, &HTTPError{Status: http.StatusBadRequest, Field: "resource", Err: fmt.Errorf("unknown resource %s", v)})
+			return
+		}
+		query = query.Where("resource = ?", t.String())
+	}
+	if v := r.URL.Query().Get("status"); v != "" {
+		query = query.Where("status = ?", v)
+	}
+
+	var data []ImportJob
+	result := query.Limit(envInt("IMPORT_JOB_LIST_LIMIT", 100)).Find(&data)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	for i := range data {
+		if err := data[i].decode(false); err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+	}
+	responseWithJSON(w, http.StatusOK, data, "import jobs read")
+	return
+}
+
+func importJobReadOneHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var data ImportJob
+	result := db.Omit("source").First(&data, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	if err = data.decode(true); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	responseWithJSON(w, http.StatusOK, data, "import job read")
+	return
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withoutDatabase gives the schema parser the naming the real connection
+// uses, for tests of code that reads models but never queries.
+func withoutDatabase(t *testing.T) {
+	if db == nil {
+		db = &gorm.DB{Config: &gorm.Config{NamingStrategy: schema.NamingStrategy{}}}
+		t.Cleanup(func() { db = nil })
+	}
+	validate = newValidator()
+}
+
+const equipmentSheet = "Name;Company ID;Equipment Category ID;Purchase Date;Warranty Expiry;Last Maintenance Date;Status;Comment\n" +
+	"Compressor;12;3;2024-05-31;2027-05-31T08:00:00Z;45200;in_service;spare\n" +
+	";;;;;;;\n" +
+	"Lathe;12;three;2024-05-31;2027-05-31;2024-01-01;;\n" +
+	"Press;12;3;2024-05-31;2027-05-31;2024-01-01;broken;\n"
+
+func TestImportEquipmentSheet(t *testing.T) {
+	withoutDatabase(t)
+	sheet, err := readSpreadsheet([]byte(equipmentSheet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := importFields(EquipmentTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns, described, err := mapColumns(sheet[0], nil, fields, importKeys[EquipmentTable])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(described.Ignored, []string{"Comment"}) {
+		t.Errorf("ignored columns %v, want [Comment]", described.Ignored)
+	}
+	if described.Columns["Last Maintenance Date"] != "last_maintenance_date" {
+		t.Errorf("Last Maintenance Date fills %q, want last_maintenance_date", described.Columns["Last Maintenance Date"])
+	}
+
+	rows := sheetRows(sheet, columns)
+	var numbers []int
+	for _, row := range rows {
+		numbers = append(numbers, row.Row)
+	}
+	if !reflect.DeepEqual(numbers, []int{2, 4, 5}) {
+		t.Fatalf("rows %v, want 2, 4 and 5 with the blank row left out", numbers)
+	}
+
+	// the first row goes through the validation of a single write
+	body, _, err := rowItem(rows[0], fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var equipment Equipment
+	if err = decodeItem(body, &equipment); err != nil {
+		t.Fatalf("row 2 failed: %v", err)
+	}
+	want := Equipment{
+		Name:                "Compressor",
+		CompanyID:           12,
+		EquipmentCategoryID: 3,
+		PurchaseDate:        time.Date(2024, time.May, 31, 0, 0, 0, 0, time.UTC),
+		WarrantyExpiry:      time.Date(2027, time.May, 31, 8, 0, 0, 0, time.UTC),
+		LastMaintenanceDate: time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
+		Status:              "in_service",
+	}
+	if equipment.Name != want.Name || equipment.CompanyID != want.CompanyID || equipment.EquipmentCategoryID != want.EquipmentCategoryID || equipment.Status != want.Status {
+		t.Errorf("row 2 read as %+v", equipment)
+	}
+	for name, pair := range map[string][2]time.Time{
+		"purchase_date":         {equipment.PurchaseDate, want.PurchaseDate},
+		"warranty_expiry":       {equipment.WarrantyExpiry, want.WarrantyExpiry},
+		"last_maintenance_date": {equipment.LastMaintenanceDate, want.LastMaintenanceDate},
+	} {
+		if !pair[0].Equal(pair[1]) {
+			t.Errorf("%s = %s, want %s", name, pair[0], pair[1])
+		}
+	}
+
+	// a cell of the wrong type is refused before the row is decoded
+	_, _, err = rowItem(rows[1], fields)
+	var invalid ValidationErrors
+	if !errors.As(err, &invalid) || len(invalid) != 1 || invalid[0].Field != "equipment_category_id" {
+		t.Errorf("row 4 gave %v, want equipment_category_id refused", err)
+	}
+
+	// a value the model refuses fails validation like a single write would
+	body, _, err = rowItem(rows[2], fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = decodeItem(body, &Equipment{})
+	if !errors.As(err, &invalid) || len(invalid) != 1 || invalid[0].Field != "status" {
+		t.Errorf("row 5 gave %v, want status refused", err)
+	}
+}
+
+func TestMapColumns(t *testing.T) {
+	withoutDatabase(t)
+	fields, err := importFields(EquipmentTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []string{"Asset", "Site", "Name", "Purchase-Date"}
+	tests := []struct {
+		name    string
+		mapping map[string]string
+		want    map[int]string
+		fails   bool
+	}{
+		{
+			name:    "a mapping renames columns and leaves others out",
+			mapping: map[string]string{"Asset": "name", "Site": "company_id", "Name": ""},
+			want:    map[int]string{0: "name", 1: "company_id", 3: "purchase_date"},
+		},
+		{
+			name:    "without the key columns the sheet is refused",
+			mapping: map[string]string{"Name": ""},
+			fails:   true,
+		},
+		{
+			name:    "two columns filling one field are refused",
+			mapping: map[string]string{"Asset": "name", "Site": "company_id"},
+			fails:   true,
+		},
+		{
+			name:    "a mapping to an unknown field is refused",
+			mapping: map[string]string{"Asset": "nickname"},
+			fails:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := mapColumns(header, tt.mapping, fields, importKeys[EquipmentTable])
+			if tt.fails {
+				var httpError *HTTPError
+				if !errors.As(err, &httpError) || httpError.Status != http.StatusBadRequest || httpError.Field != "mapping" {
+					t.Errorf("mapColumns = %v, %v, want a 400 on mapping", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mapColumns = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSheetTime(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want time.Time
+		bad  bool
+	}{
+		{raw: "2024-05-31", want: time.Date(2024, time.May, 31, 0, 0, 0, 0, time.UTC)},
+		{raw: "2024-05-31 08:30:00", want: time.Date(2024, time.May, 31, 8, 30, 0, 0, time.UTC)},
+		{raw: "2024-05-31T08:30:00+02:00", want: time.Date(2024, time.May, 31, 6, 30, 0, 0, time.UTC)},
+		{raw: "45292", want: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{raw: "45292.5", want: time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)},
+		{raw: "soon", bad: true},
+		{raw: "-3", bad: true},
+	}
+	for _, tt := range tests {
+		got, err := sheetTime(tt.raw)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("sheetTime(%q) = %s, want an error", tt.raw, got)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("sheetTime(%q) = %s, %v, want %s", tt.raw, got, err, tt.want)
+		}
+	}
+}
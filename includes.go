@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Associations are left out of responses unless asked for with ?include=,
+// a comma separated list of association names in snake_case. Nested ones are
+// reached with dots, e.g. include=equipment.equipment_category,user.
+
+const maxIncludeDepth = 3
+
+var schemaCache = &sync.Map{}
+
+func modelSchema(model interface{}) (*schema.Schema, error) {
+	return schema.Parse(model, schemaCache, db.NamingStrategy)
+}
+
+// includePaths resolves the requested includes against the model's
+// associations and returns them as preload paths like Equipment.Company.
+func includePaths(r *http.Request, model interface{}) ([]string, error) {
+	raw := r.URL.Query().Get("include")
+	if raw == "" {
+		raw = r.URL.Query().Get("expand")
+	}
+	if raw == "" {
+		return nil, nil
+	}
+
+	root, err := modelSchema(model)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, include := range strings.Split(raw, ",") {
+		include = strings.TrimSpace(include)
+		if include == "" {
+			continue
+		}
+		segments := strings.Split(include, ".")
+		if len(segments) > maxIncludeDepth {
+			return nil, withStatus(http.StatusBadRequest, fmt.Errorf("include %s nests deeper than %d levels", include, maxIncludeDepth))
+		}
+
+		current := root
+		var fields []string
+		for _, segment := range segments {
+			relation := findRelation(current, segment)
+			if relation == nil {
+				return nil, &HTTPError{Status: http.StatusBadRequest, Field: "include",
+					Err: fmt.Errorf("%s has no association %s, it has %s", current.Name, segment, strings.Join(relationNames(current), ", "))}
+			}
+			fields = append(fields, relation.Name)
+			current = relation.FieldSchema
+		}
+		paths = append(paths, strings.Join(fields, "."))
+	}
+	return paths, nil
+}
+
+func findRelation(s *schema.Schema, name string) *schema.Relationship {
+	for fieldName, relation := range s.Relationships.Relations {
+		if db.NamingStrategy.ColumnName("", fieldName) == name || strings.EqualFold(fieldName, name) {
+			return relation
+		}
+	}
+	return nil
+}
+
+func relationNames(s *schema.Schema) []string {
+	var names []string
+	for fieldName := range s.Relationships.Relations {
+		names = append(names, db.NamingStrategy.ColumnName("", fieldName))
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return []string{"none"}
+	}
+	return names
+}
+
+// includeQuery starts a query preloading the associations the request asks
+// for.
+func includeQuery(r *http.Request, model interface{}) (*gorm.DB, error) {
+	paths, err := includePaths(r, model)
+	if err != nil {
+		return nil, err
+	}
+	query := db
+	for _, path := range paths {
+		query = query.Preload(path)
+	}
+	return query, nil
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 	"net/http"
 	"time"
@@ -9,18 +8,20 @@ import (
 
 type Inventory struct {
 	gorm.Model
-	CompanyID           uint      `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	Company             Company   `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	CompanyID           uint      `gorm:"type:int(10);index;not null" validate:"required"`
+	Company             *Company  `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
 	Name                string    `gorm:"type:varchar(255);not null" validate:"required,max=255"`
-	CurrentStock        uint      `gorm:"type:int(10);default:0" validate:"alphanum,len=10"`
-	MinRequiredQuantity uint      `gorm:"type:int(10);default:0" validate:"alphanum,len=10"`
-	LastOrderDate       time.Time `gorm:"not null" validate:"required,datetime"`
+	CurrentStock        uint      `gorm:"type:int(10);default:0"`
+	MinRequiredQuantity uint      `gorm:"type:int(10);default:0"`
+	LastOrderDate       time.Time `gorm:"not null" validate:"required"`
 	Tags                string    `gorm:"type:varchar(500)" validate:"max=500"`
 	Location            string    `gorm:"type:varchar(255)" validate:"max=255"`
+	UnitCost            float64   `gorm:"type:decimal(12,2);not null;default:0" validate:"gte=0"`
+	AssetTag            *string   `gorm:"type:varchar(64);uniqueIndex;default:NULL" validate:"omitempty,max=64"`
 }
 
 func (c *Inventory) Decode(data []byte) (Inventory, error) {
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return Inventory{}, err
 	}
@@ -31,29 +32,50 @@ func (c *Inventory) Encode() ([]byte, error) {
 	return json.Marshal(c)
 }
 
+// createInventory stores a new inventory item and gives it an asset tag.
+func createInventory(tx *gorm.DB, data *Inventory) error {
+	if result := tx.Create(data); result.Error != nil {
+		return result.Error
+	}
+	tag, err := assignAssetTag(tx, InventoryTable, data.ID, data.AssetTag)
+	data.AssetTag = &tag
+	return err
+}
+
+// saveInventory stores a changed item, keeping its asset tag when none is
+// given.
+func saveInventory(tx *gorm.DB, data *Inventory, previousTag *string) error {
+	if data.AssetTag == nil || *data.AssetTag == "" {
+		data.AssetTag = previousTag
+	}
+	return tx.Save(data).Error
+}
+
 func inventoryCreateHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	var c Inventory
 	data, err := c.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
-	result := db.Create(&data)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return createInventory(tx, &data)
+	})
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
@@ -63,9 +85,14 @@ func inventoryCreateHandler(w http.ResponseWriter, r *http.Request) {
 
 func inventoryReadHandler(w http.ResponseWriter, r *http.Request) {
 	var data []Inventory
-	result := db.Find(&data)
+	query, err := includeQuery(r, &Inventory{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.Find(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -74,11 +101,20 @@ func inventoryReadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func inventoryReadOneHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data Inventory
-	result := db.First(&data, id)
+	query, err := includeQuery(r, &Inventory{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 	responseWithJSON(w, http.StatusOK, data, "inventory read")
@@ -86,35 +122,40 @@ func inventoryReadOneHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func inventoryUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data Inventory
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
+	previousTag := data.AssetTag
+
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	data, err = data.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
-	result = db.Save(&data)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	if err = saveInventory(db, &data, previousTag); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
@@ -123,11 +164,13 @@ func inventoryUpdateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func inventoryDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	var data Inventory
-	result := db.Delete(&data, id)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if err = trashRecord(db, InventoryTable, id); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 	responseWithMsg(w, http.StatusOK, "inventory deleted")
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// runEvery starts a background job that runs once immediately and then on
+// every tick. Failures are logged and the job keeps its schedule.
+func runEvery(name string, interval time.Duration, job func() error) {
+	go func() {
+		for {
+			if err := job(); err != nil {
+				log.Printf("job %s failed: %v", name, err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func envInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func startJobs() {
+	runEvery("warranty expiry", envDuration("WARRANTY_CHECK_INTERVAL", time.Hour), notifyExpiringWarranties)
+	runEvery("compliance monitor", envDuration("COMPLIANCE_CHECK_INTERVAL", time.Hour), monitorComplianceDocuments)
+	runEvery("trash retention", envDuration("TRASH_PURGE_INTERVAL", 24*time.Hour), purgeExpiredTrash)
+	runEvery("idempotency keys", envDuration("IDEMPOTENCY_PURGE_INTERVAL", time.Hour), purgeExpiredIdempotencyKeys)
+	runEvery("imports", envDuration("IMPORT_POLL_INTERVAL", time.Minute), runQueuedImports)
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	equipmentTagPrefix = "EQ"
+	inventoryTagPrefix = "INV"
+	qrQuietZone        = 4
+	code128QuietZone   = 10
+)
+
+type AssetLabel struct {
+	Tag   string
+	Title string
+}
+
+type ScanResult struct {
+	Type          string                `json:"type"`
+	Tag           string                `json:"tag"`
+	Record        interface{}           `json:"record"`
+	OpenSchedules []MaintenanceSchedule `json:"open_schedules"`
+}
+
+// assignAssetTag gives a record its default tag, made of a prefix and the
+// zero padded ID, unless it already carries one.
+func assignAssetTag(tx *gorm.DB, t Tables, id uint, current *string) (string, error) {
+	if current != nil && *current != "" {
+		return *current, nil
+	}
+	prefix := equipmentTagPrefix
+	if t == InventoryTable {
+		prefix = inventoryTagPrefix
+	}
+	tag := fmt.Sprintf("%s-%06d", prefix, id)
+	result := tx.Table(t.String()).Where("id = ?", id).UpdateColumn("asset_tag", tag)
+	return tag, result.Error
+}
+
+// loadLabel reads the tag and title printed on a record's label. Tags are
+// given on create and update, so a record without one predates labels and
+// needs POST /{id}/asset-tag first.
+func loadLabel(t Tables, id string) (AssetLabel, error) {
+	if n, err := strconv.ParseUint(id, 10, 64); err != nil || n == 0 {
+		return AssetLabel{}, withStatus(http.StatusBadRequest, fmt.Errorf("%s is not a valid id", id))
+	}
+	var label AssetLabel
+	var tag *string
+	switch t {
+	case EquipmentTable:
+		var e Equipment
+		if result := db.First(&e, id); result.Error != nil {
+			return AssetLabel{}, result.Error
+		}
+		label.Title, tag = e.Name, e.AssetTag
+	case InventoryTable:
+		var i Inventory
+		if result := db.First(&i, id); result.Error != nil {
+			return AssetLabel{}, result.Error
+		}
+		label.Title, tag = i.Name, i.AssetTag
+	default:
+		return AssetLabel{}, fmt.Errorf("%s records have no labels", t.String())
+	}
+	if tag == nil || *tag == "" {
+		return AssetLabel{}, withStatus(http.StatusConflict,
+			fmt.Errorf("%s %s has no asset tag yet, assign one with POST /%s/%s/asset-tag", t.String(), id, t.String(), id))
+	}
+	label.Tag = *tag
+	return label, nil
+}
+
+// assetTagHandler gives a record created before labels existed its default
+// asset tag. Records that already carry a tag keep it.
+func assetTagHandler(t Tables) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+
+		var data interface{}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			switch t {
+			case EquipmentTable:
+				var e Equipment
+				if result := tx.First(&e, id); result.Error != nil {
+					return result.Error
+				}
+				tag, err := assignAssetTag(tx, t, e.ID, e.AssetTag)
+				e.AssetTag = &tag
+				data = e
+				return err
+			case InventoryTable:
+				var i Inventory
+				if result := tx.First(&i, id); result.Error != nil {
+					return result.Error
+				}
+				tag, err := assignAssetTag(tx, t, i.ID, i.AssetTag)
+				i.AssetTag = &tag
+				data = i
+				return err
+			}
+			return fmt.Errorf("%s records have no labels", t.String())
+		})
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+
+		responseWithJSON(w, http.StatusOK, data, fmt.Sprintf("asset tag of %s %s assigned", t.String(), id))
+		return
+	}
+}
+
+func qrPNG(q *QRCode, scale int) ([]byte, error) {
+	side := (q.Size + 2*qrQuietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if !q.Dark(x, y) {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetGray((x+qrQuietZone)*scale+dx, (y+qrQuietZone)*scale+dy, color.Gray{})
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+func qrSVG(q *QRCode, label AssetLabel) []byte {
+	side := q.Size + 2*qrQuietZone
+	var path strings.Builder
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.Dark(x, y) {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<title>%s</title><rect width="100%%" height="100%%" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		side, side, xmlEscape(label.Tag), path.String()))
+}
+
+func code128PNG(widths []int, scale, height int) ([]byte, error) {
+	modules := 2 * code128QuietZone
+	for _, w := range widths {
+		modules += w
+	}
+	img := image.NewGray(image.Rect(0, 0, modules*scale, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	x := code128QuietZone * scale
+	for i, w := range widths {
+		if i%2 == 0 {
+			for dx := 0; dx < w*scale; dx++ {
+				for y := 0; y < height; y++ {
+					img.SetGray(x+dx, y, color.Gray{})
+				}
+			}
+		}
+		x += w * scale
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+func code128SVG(widths []int, label AssetLabel) []byte {
+	modules := 2 * code128QuietZone
+	for _, w := range widths {
+		modules += w
+	}
+	var bars strings.Builder
+	x := code128QuietZone
+	for i, w := range widths {
+		if i%2 == 0 {
+			fmt.Fprintf(&bars, `<rect x="%d" y="0" width="%d" height="50"/>`, x, w)
+		}
+		x += w
+	}
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d 64" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><g fill="#000">%s</g>`+
+		`<text x="%d" y="62" font-family="monospace" font-size="10" text-anchor="middle">%s</text></svg>`,
+		modules, bars.String(), modules/2, xmlEscape(label.Tag)))
+}
+
+func xmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace(s)
+}
+
+// renderLabel draws one label as PNG or SVG in the requested symbology.
+func renderLabel(label AssetLabel, symbology, format string) ([]byte, string, error) {
+	switch symbology {
+	case "", "qr":
+		q, err := EncodeQR([]byte(label.Tag))
+		if err != nil {
+			return nil, "", withStatus(http.StatusUnprocessableEntity, err)
+		}
+		if format == "svg" {
+			return qrSVG(q, label), "image/svg+xml", nil
+		}
+		data, err := qrPNG(q, 8)
+		return data, "image/png", err
+	case "code128":
+		widths, err := EncodeCode128(label.Tag)
+		if err != nil {
+			return nil, "", withStatus(http.StatusUnprocessableEntity, err)
+		}
+		if format == "svg" {
+			return code128SVG(widths, label), "image/svg+xml", nil
+		}
+		data, err := code128PNG(widths, 2, 80)
+		return data, "image/png", err
+	}
+	return nil, "", &HTTPError{Status: http.StatusBadRequest, Field: "symbology", Err: fmt.Errorf("unknown symbology %s", symbology)}
+}
+
+func labelHandler(t Tables) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+		label, err := loadLabel(t, id)
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "png" && format != "svg" {
+			responseWithMsg(w, http.StatusBadRequest, "format must be png or svg")
+			return
+		}
+		data, contentType, err := renderLabel(label, r.URL.Query().Get("symbology"), format)
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Asset-Tag", label.Tag)
+		_, _ = w.Write(data)
+	}
+}
+
+func idList(raw string) []string {
+	var ids []string
+	for _, id := range strings.Split(raw, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// labelSheetHandler renders a printable A4 PDF of labels for the equipment
+// and inventory IDs passed as comma separated lists.
+func labelSheetHandler(w http.ResponseWriter, r *http.Request) {
+	var labels []AssetLabel
+	sources := []struct {
+		table Tables
+		param string
+	}{{EquipmentTable, "equipment"}, {InventoryTable, "inventory"}}
+	for _, source := range sources {
+		param := source.param
+		for _, id := range idList(r.URL.Query().Get(param)) {
+			label, err := loadLabel(source.table, id)
+			if err != nil {
+				responseWithError(w, r, fmt.Errorf("%s %s: %w", param, id, err))
+				return
+			}
+			labels = append(labels, label)
+		}
+	}
+	if len(labels) == 0 {
+		responseWithMsg(w, http.StatusBadRequest, "equipment or inventory ids are required")
+		return
+	}
+
+	data, err := labelSheetPDF(labels, r.URL.Query().Get("symbology"))
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="labels.pdf"`)
+	_, _ = w.Write(data)
+}
+
+// labelScanHandler maps a scanned code back to its equipment or inventory
+// record. Equipment also lists schedules no maintenance was recorded for.
+func labelScanHandler(w http.ResponseWriter, r *http.Request) {
+	code := strings.TrimSpace(r.URL.Query().Get("code"))
+	if code == "" {
+		responseWithMsg(w, http.StatusBadRequest, "code is required")
+		return
+	}
+
+	var equipment Equipment
+	result := db.Where("asset_tag = ?", code).First(&equipment)
+	if result.Error == nil {
+		var schedules []MaintenanceSchedule
+		result = db.Where("equipment_id = ?", equipment.ID).
+			Where("id NOT IN (?)", db.Table(MaintenanceHistoryTable.String()).
+				Select("maintenance_schedule_id").
+				Where("maintenance_schedule_id IS NOT NULL AND deleted_at IS NULL")).
+			Order("scheduled_at").
+			Find(&schedules)
+		if result.Error != nil {
+			responseWithError(w, r, result.Error)
+			return
+		}
+		zones, err := newZoneResolver(r)
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+		for i := range schedules {
+			schedules[i].localize(zones.forEquipment(equipment.ID))
+		}
+		responseWithJSON(w, http.StatusOK, ScanResult{Type: "equipment", Tag: code, Record: equipment, OpenSchedules: schedules}, "label resolved")
+		return
+	}
+	if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	var item Inventory
+	result = db.Where("asset_tag = ?", code).First(&item)
+	if result.Error == nil {
+		responseWithJSON(w, http.StatusOK, ScanResult{Type: "inventory", Tag: code, Record: item, OpenSchedules: []MaintenanceSchedule{}}, "label resolved")
+		return
+	}
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		responseWithMsg(w, http.StatusNotFound, fmt.Sprintf("no record carries the tag %s", code))
+		return
+	}
+	responseWithError(w, r, result.Error)
+	return
+}
+
+// PDF label sheets: A4 portrait, 3 columns by 8 rows of 70 x 37 mm labels.
+const (
+	pdfPageWidth   = 595.28
+	pdfPageHeight  = 841.89
+	pdfLabelWidth  = 198.43
+	pdfLabelHeight = 104.88
+	pdfColumns     = 3
+	pdfRows        = 8
+)
+
+func pdfText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func labelContent(label AssetLabel, symbology string, x, y float64, out *bytes.Buffer) error {
+	const padding = 8.0
+	switch symbology {
+	case "", "qr":
+		q, err := EncodeQR([]byte(label.Tag))
+		if err != nil {
+			return withStatus(http.StatusUnprocessableEntity, err)
+		}
+		side := pdfLabelHeight - 2*padding
+		module := side / float64(q.Size)
+		for my := 0; my < q.Size; my++ {
+			for mx := 0; mx < q.Size; mx++ {
+				if q.Dark(mx, my) {
+					fmt.Fprintf(out, "%.2f %.2f %.2f %.2f re\n",
+						x+padding+float64(mx)*module, y+pdfLabelHeight-padding-float64(my+1)*module, module, module)
+				}
+			}
+		}
+		out.WriteString("f\n")
+		textX := x + padding*2 + side
+		fmt.Fprintf(out, "BT /F1 10 Tf %.2f %.2f Td (%s) Tj ET\n", textX, y+pdfLabelHeight/2+4, pdfText(label.Tag))
+		fmt.Fprintf(out, "BT /F1 7 Tf %.2f %.2f Td (%s) Tj ET\n", textX, y+pdfLabelHeight/2-8, pdfText(truncate(label.Title, 22)))
+	case "code128":
+		widths, err := EncodeCode128(label.Tag)
+		if err != nil {
+			return withStatus(http.StatusUnprocessableEntity, err)
+		}
+		modules := 0
+		for _, w := range widths {
+			modules += w
+		}
+		module := (pdfLabelWidth - 2*padding) / float64(modules)
+		bx := x + padding
+		for i, w := range widths {
+			if i%2 == 0 {
+				fmt.Fprintf(out, "%.2f %.2f %.2f %.2f re\n", bx, y+40, float64(w)*module, pdfLabelHeight-40-padding)
+			}
+			bx += float64(w) * module
+		}
+		out.WriteString("f\n")
+		fmt.Fprintf(out, "BT /F1 10 Tf %.2f %.2f Td (%s) Tj ET\n", x+padding, y+24, pdfText(label.Tag))
+		fmt.Fprintf(out, "BT /F1 7 Tf %.2f %.2f Td (%s) Tj ET\n", x+padding, y+12, pdfText(truncate(label.Title, 50)))
+	default:
+		return &HTTPError{Status: http.StatusBadRequest, Field: "symbology", Err: fmt.Errorf("unknown symbology %s", symbology)}
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-1] + "~"
+}
+
+func labelSheetPDF(labels []AssetLabel, symbology string) ([]byte, error) {
+	perPage := pdfColumns * pdfRows
+	marginX := (pdfPageWidth - pdfColumns*pdfLabelWidth) / 2
+	marginY := (pdfPageHeight - pdfRows*pdfLabelHeight) / 2
+
+	var pages [][]byte
+	for start := 0; start < len(labels); start += perPage {
+		var content bytes.Buffer
+		content.WriteString("0 g\n")
+		for i := start; i < len(labels) && i < start+perPage; i++ {
+			slot := i - start
+			x := marginX + float64(slot%pdfColumns)*pdfLabelWidth
+			y := pdfPageHeight - marginY - float64(slot/pdfColumns+1)*pdfLabelHeight
+			if err := labelContent(labels[i], symbology, x, y, &content); err != nil {
+				return nil, err
+			}
+		}
+		pages = append(pages, content.Bytes())
+	}
+
+	// Objects: 1 catalog, 2 page tree, 3 font, then a page and its content
+	// stream for every page.
+	var objects []string
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = strconv.Itoa(4+2*i) + " 0 R"
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+	)
+	for i, content := range pages {
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+				pdfPageWidth, pdfPageHeight, 5+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes(), nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
+	"expvar"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -14,6 +16,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"reflect"
+	"strings"
+	"time"
 )
 
 type Tables int // enum
@@ -35,6 +40,28 @@ const (
 	ServiceProvidersTable
 	SuppliersTable
 	UsersTable
+	FailureCodesTable
+	MaintenanceBudgetsTable
+	EquipmentStatusHistoryTable
+	MeterReadingsTable
+	WarrantiesTable
+	ComplianceNoticesTable
+	StoredFilesTable
+	EquipmentDocVersionsTable
+	ImageAttachmentsTable
+	ImageThumbnailsTable
+	CalendarFeedsTable
+	SkillsTable
+	UserSkillsTable
+	MaintenanceTypeSkillsTable
+	WorkShiftsTable
+	LeavesTable
+	ScheduleAssignmentsTable
+	MaintenancePlansTable
+	TimeEntriesTable
+	AuditLogsTable
+	IdempotencyKeysTable
+	ImportJobsTable
 )
 
 func (t Tables) String() string {
@@ -55,6 +82,28 @@ func (t Tables) String() string {
 		"service_providers",
 		"suppliers",
 		"users",
+		"failure_codes",
+		"maintenance_budgets",
+		"equipment_status_histories",
+		"meter_readings",
+		"warranties",
+		"compliance_notices",
+		"stored_files",
+		"equipment_doc_versions",
+		"image_attachments",
+		"image_thumbnails",
+		"calendar_feeds",
+		"skills",
+		"user_skills",
+		"maintenance_type_skills",
+		"work_shifts",
+		"leaves",
+		"schedule_assignments",
+		"maintenance_plans",
+		"time_entries",
+		"audit_logs",
+		"idempotency_keys",
+		"import_jobs",
 	}[t]
 }
 
@@ -92,6 +141,50 @@ func (t Tables) Struct() interface{} {
 		return &Supplier{}
 	case UsersTable:
 		return &User{}
+	case FailureCodesTable:
+		return &FailureCode{}
+	case MaintenanceBudgetsTable:
+		return &MaintenanceBudget{}
+	case EquipmentStatusHistoryTable:
+		return &EquipmentStatusHistory{}
+	case MeterReadingsTable:
+		return &MeterReading{}
+	case WarrantiesTable:
+		return &Warranty{}
+	case ComplianceNoticesTable:
+		return &ComplianceNotice{}
+	case StoredFilesTable:
+		return &StoredFile{}
+	case EquipmentDocVersionsTable:
+		return &EquipmentDocVersion{}
+	case ImageAttachmentsTable:
+		return &ImageAttachment{}
+	case ImageThumbnailsTable:
+		return &ImageThumbnail{}
+	case CalendarFeedsTable:
+		return &CalendarFeed{}
+	case SkillsTable:
+		return &Skill{}
+	case UserSkillsTable:
+		return &UserSkill{}
+	case MaintenanceTypeSkillsTable:
+		return &MaintenanceTypeSkill{}
+	case WorkShiftsTable:
+		return &WorkShift{}
+	case LeavesTable:
+		return &Leave{}
+	case ScheduleAssignmentsTable:
+		return &ScheduleAssignment{}
+	case MaintenancePlansTable:
+		return &MaintenancePlan{}
+	case TimeEntriesTable:
+		return &TimeEntry{}
+	case AuditLogsTable:
+		return &AuditLog{}
+	case IdempotencyKeysTable:
+		return &IdempotencyKey{}
+	case ImportJobsTable:
+		return &ImportJob{}
 	default:
 		return nil
 	}
@@ -131,6 +224,50 @@ func (t Tables) Slice() interface{} {
 		return []Supplier{}
 	case UsersTable:
 		return []User{}
+	case FailureCodesTable:
+		return []FailureCode{}
+	case MaintenanceBudgetsTable:
+		return []MaintenanceBudget{}
+	case EquipmentStatusHistoryTable:
+		return []EquipmentStatusHistory{}
+	case MeterReadingsTable:
+		return []MeterReading{}
+	case WarrantiesTable:
+		return []Warranty{}
+	case ComplianceNoticesTable:
+		return []ComplianceNotice{}
+	case StoredFilesTable:
+		return []StoredFile{}
+	case EquipmentDocVersionsTable:
+		return []EquipmentDocVersion{}
+	case ImageAttachmentsTable:
+		return []ImageAttachment{}
+	case ImageThumbnailsTable:
+		return []ImageThumbnail{}
+	case CalendarFeedsTable:
+		return []CalendarFeed{}
+	case SkillsTable:
+		return []Skill{}
+	case UserSkillsTable:
+		return []UserSkill{}
+	case MaintenanceTypeSkillsTable:
+		return []MaintenanceTypeSkill{}
+	case WorkShiftsTable:
+		return []WorkShift{}
+	case LeavesTable:
+		return []Leave{}
+	case ScheduleAssignmentsTable:
+		return []ScheduleAssignment{}
+	case MaintenancePlansTable:
+		return []MaintenancePlan{}
+	case TimeEntriesTable:
+		return []TimeEntry{}
+	case AuditLogsTable:
+		return []AuditLog{}
+	case IdempotencyKeysTable:
+		return []IdempotencyKey{}
+	case ImportJobsTable:
+		return []ImportJob{}
 	default:
 		return nil
 	}
@@ -139,10 +276,10 @@ func (t Tables) Slice() interface{} {
 type ValidationError struct {
 	Namespace       string `json:"namespace"` // can differ when a custom TagNameFunc is registered or
 	Field           string `json:"field"`     // by passing alt name to ReportError like below
-	StructNamespace string `json:"structNamespace"`
-	StructField     string `json:"structField"`
+	StructNamespace string `json:"struct_namespace"`
+	StructField     string `json:"struct_field"`
 	Tag             string `json:"tag"`
-	ActualTag       string `json:"actualTag"`
+	ActualTag       string `json:"actual_tag"`
 	Kind            string `json:"kind"`
 	Type            string `json:"type"`
 	Value           string `json:"value"`
@@ -156,7 +293,7 @@ func dbDSN() string {
 	dbUser := os.Getenv("DBDEVUSER")
 	dbPass := os.Getenv("DBDEVPASSWORD")
 	dbName := os.Getenv("DBDEVDATABASE")
-	return dbUser + ":" + dbPass + "@tcp(" + dbHost + ":" + dbPort + ")/" + dbName + "?charset=utf8mb4&parseTime=True&loc=Local"
+	return dbUser + ":" + dbPass + "@tcp(" + dbHost + ":" + dbPort + ")/" + dbName + "?charset=utf8mb4&parseTime=True&loc=UTC"
 }
 
 var (
@@ -165,64 +302,144 @@ var (
 	json     = jsoniter.ConfigCompatibleWithStandardLibrary
 )
 
-func Validate(c interface{}) ValidationError {
-	err := validate.Struct(c)
-	if err != nil {
-		var invalidValidationError *validator.InvalidValidationError
-		if errors.As(err, &invalidValidationError) {
-			return ValidationError{}
-		}
+// ValidationErrors lists every field of a request that failed validation.
+type ValidationErrors []ValidationError
 
-		for _, err := range err.(validator.ValidationErrors) {
-			return ValidationError{
-				Namespace:       err.Namespace(),
-				Field:           err.Field(),
-				StructNamespace: err.StructNamespace(),
-				StructField:     err.StructField(),
-				Tag:             err.Tag(),
-				ActualTag:       err.ActualTag(),
-				Kind:            fmt.Sprintf("%v", err.Kind()),
-				Type:            fmt.Sprintf("%v", err.Type()),
-				Value:           fmt.Sprintf("%v", err.Value()),
-				Param:           err.Param(),
-				Message:         fmt.Sprintf("%s to be compatible with rule %s", err.StructField(), err.Tag()),
-			}
-		}
+func (v ValidationErrors) Error() string {
+	messages := make([]string, len(v))
+	for i, e := range v {
+		messages[i] = e.Message
 	}
-	return ValidationError{}
+	return strings.Join(messages, "; ")
 }
 
-func ValidateExcept(c interface{}, exp []string) ValidationError {
-	err := validate.StructExcept(c, exp...)
-	if err != nil {
-		var invalidValidationError *validator.InvalidValidationError
-		if errors.As(err, &invalidValidationError) {
-			return ValidationError{}
-		}
+func Validate(c interface{}) ValidationErrors {
+	return validationErrors(validate.Struct(c))
+}
+
+func ValidateExcept(c interface{}, exp []string) ValidationErrors {
+	return validationErrors(validate.StructExcept(c, exp...))
+}
 
-		for _, err := range err.(validator.ValidationErrors) {
-			return ValidationError{
-				Namespace:       err.Namespace(),
-				Field:           err.Field(),
-				StructNamespace: err.StructNamespace(),
-				StructField:     err.StructField(),
-				Tag:             err.Tag(),
-				ActualTag:       err.ActualTag(),
-				Kind:            fmt.Sprintf("%v", err.Kind()),
-				Type:            fmt.Sprintf("%v", err.Type()),
-				Value:           fmt.Sprintf("%v", err.Value()),
-				Param:           err.Param(),
-				Message:         fmt.Sprintf("%s to be compatible with rule %s", err.StructField(), err.Tag()),
-			}
+func validationErrors(err error) ValidationErrors {
+	var fieldErrors validator.ValidationErrors
+	if !errors.As(err, &fieldErrors) {
+		return nil
+	}
+
+	var found ValidationErrors
+	for _, err := range fieldErrors {
+		found = append(found, ValidationError{
+			Namespace:       err.Namespace(),
+			Field:           err.Field(),
+			StructNamespace: err.StructNamespace(),
+			StructField:     err.StructField(),
+			Tag:             err.Tag(),
+			ActualTag:       err.ActualTag(),
+			Kind:            fmt.Sprintf("%v", err.Kind()),
+			Type:            fmt.Sprintf("%v", err.Type()),
+			Value:           fmt.Sprintf("%v", err.Value()),
+			Param:           err.Param(),
+			Message:         validationMessage(err),
+		})
+	}
+	return found
+}
+
+// validationMessage describes a failed rule in words, naming the field the
+// way it is spelled in JSON.
+func validationMessage(err validator.FieldError) string {
+	field, param := err.Field(), err.Param()
+	switch err.Tag() {
+	case "required":
+		return fmt.Sprintf("%s is required", field)
+	case "max":
+		if err.Kind() == reflect.String {
+			return fmt.Sprintf("%s must be at most %s characters long", field, param)
+		}
+		if err.Kind() == reflect.Slice || err.Kind() == reflect.Map {
+			return fmt.Sprintf("%s must have at most %s items", field, param)
+		}
+		return fmt.Sprintf("%s must be %s or less", field, param)
+	case "min":
+		if err.Kind() == reflect.String {
+			return fmt.Sprintf("%s must be at least %s characters long", field, param)
+		}
+		if err.Kind() == reflect.Slice || err.Kind() == reflect.Map {
+			return fmt.Sprintf("%s must have at least %s items", field, param)
 		}
+		return fmt.Sprintf("%s must be %s or more", field, param)
+	case "len":
+		if err.Kind() == reflect.String {
+			return fmt.Sprintf("%s must be exactly %s characters long", field, param)
+		}
+		return fmt.Sprintf("%s must be %s", field, param)
+	case "gte":
+		return fmt.Sprintf("%s must be greater than or equal to %s", field, param)
+	case "gt":
+		return fmt.Sprintf("%s must be greater than %s", field, param)
+	case "lte":
+		return fmt.Sprintf("%s must be less than or equal to %s", field, param)
+	case "lt":
+		return fmt.Sprintf("%s must be less than %s", field, param)
+	case "gtfield":
+		return fmt.Sprintf("%s must be after %s", field, apiFieldName(param))
+	case "ltfield":
+		return fmt.Sprintf("%s must be before %s", field, apiFieldName(param))
+	case "oneof":
+		return fmt.Sprintf("%s must be one of %s", field, strings.ReplaceAll(param, " ", ", "))
+	case "email":
+		return fmt.Sprintf("%s must be a valid email address", field)
+	case "e164":
+		return fmt.Sprintf("%s must be a phone number in E.164 format like +14155552671", field)
+	case "sha256":
+		return fmt.Sprintf("%s must be a SHA-256 hash in hex", field)
+	case "alphanum":
+		return fmt.Sprintf("%s must contain only letters and digits", field)
+	case "timezone":
+		return fmt.Sprintf("%s must be an IANA time zone like Europe/Berlin", field)
+	case "datetime":
+		return fmt.Sprintf("%s must match the layout %s", field, param)
+	case "url":
+		return fmt.Sprintf("%s must be a valid URL", field)
+	}
+	return fmt.Sprintf("%s does not satisfy the rule %s", field, err.ActualTag())
+}
+
+// jsonFieldName makes validation errors name fields as they appear in request
+// bodies rather than by their Go names.
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
 	}
-	return ValidationError{}
+	if name == "" {
+		return apiFieldName(field.Name)
+	}
+	return name
+}
+
+// newValidator sets up the rules. Nullable strings are checked by their
+// value, a NULL counting as empty.
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.RegisterTagNameFunc(jsonFieldName)
+	v.RegisterCustomTypeFunc(func(field reflect.Value) interface{} {
+		if s, ok := field.Interface().(sql.NullString); ok && s.Valid {
+			return s.String
+		}
+		return ""
+	}, sql.NullString{})
+	return v
 }
 
-func init() {
+// openDatabase connects to MySQL. It runs from main rather than init so the
+// tests of the pure helpers need no database.
+func openDatabase() {
 	var err error
 	db, err = gorm.Open(mysql.Open(dbDSN()), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
+		Logger:  logger.Default.LogMode(logger.Info),
+		NowFunc: func() time.Time { return time.Now().UTC() },
 	})
 	if err != nil {
 		panic(err)
@@ -230,15 +447,36 @@ func init() {
 }
 
 func main() {
-	validate = validator.New(validator.WithRequiredStructEnabled())
+	openDatabase()
+	validate = newValidator()
+	var err error
+	if err = runMigrations(); err != nil {
+		log.Fatal("migrations: ", err)
+	}
+	store, err = newStorage()
+	if err != nil {
+		log.Fatal("storage: ", err)
+	}
+	startJobs()
 	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
 	r.Use(middleware.Logger)
+	r.Use(spreadsheetExports)
+	r.Use(sparseFields)
+	r.Use(idempotentPosts)
+	r.Use(conditionalRequests)
+	r.Use(auditTrail)
 	r.Route("/companies", func(r chi.Router) {
 		r.Post("/", companyCreateHandler)
 		r.Get("/", companyReadHandler)
 		r.Get("/{id}", companyReadOneHandler)
 		r.Put("/{id}", companyUpdateHandler)
 		r.Delete("/{id}", companyDeleteHandler)
+		r.Post("/bulk", bulkHandler(CompaniesTable))
+		r.Put("/bulk", bulkHandler(CompaniesTable))
+		r.Delete("/bulk", bulkHandler(CompaniesTable))
+		r.Get("/{id}/fixed-assets", companyFixedAssetReportHandler)
+		r.Get("/{id}/compliance", companyComplianceHandler)
 	})
 
 	r.Route("/compliance-documents", func(r chi.Router) {
@@ -247,6 +485,12 @@ func main() {
 		r.Get("/{id}", complianceDocumentReadOneHandler)
 		r.Put("/{id}", complianceDocumentUpdateHandler)
 		r.Delete("/{id}", complianceDocumentDeleteHandler)
+		r.Post("/bulk", bulkHandler(ComplianceDocumentsTable))
+		r.Put("/bulk", bulkHandler(ComplianceDocumentsTable))
+		r.Delete("/bulk", bulkHandler(ComplianceDocumentsTable))
+		r.Post("/{id}/renew", complianceDocumentRenewHandler)
+		r.Post("/{id}/file", uploadHandler(ComplianceDocumentsTable))
+		r.Get("/{id}/history", complianceDocumentHistoryHandler)
 	})
 
 	r.Route("/equipment-categories", func(r chi.Router) {
@@ -255,6 +499,9 @@ func main() {
 		r.Get("/{id}", equipmentCategoryReadOneHandler)
 		r.Put("/{id}", equipmentCategoryUpdateHandler)
 		r.Delete("/{id}", equipmentCategoryDeleteHandler)
+		r.Post("/bulk", bulkHandler(EquipmentCategoriesTable))
+		r.Put("/bulk", bulkHandler(EquipmentCategoriesTable))
+		r.Delete("/bulk", bulkHandler(EquipmentCategoriesTable))
 	})
 
 	r.Route("/equipment-docs", func(r chi.Router) {
@@ -263,6 +510,13 @@ func main() {
 		r.Get("/{id}", equipmentDocReadOneHandler)
 		r.Put("/{id}", equipmentDocUpdateHandler)
 		r.Delete("/{id}", equipmentDocDeleteHandler)
+		r.Post("/bulk", bulkHandler(EquipmentDocsTable))
+		r.Put("/bulk", bulkHandler(EquipmentDocsTable))
+		r.Delete("/bulk", bulkHandler(EquipmentDocsTable))
+		r.Post("/{id}/file", equipmentDocUploadHandler)
+		r.Get("/{id}/versions", equipmentDocVersionsHandler)
+		r.Get("/{id}/versions/{version}/download", equipmentDocVersionDownloadHandler)
+		r.Post("/{id}/versions/{version}/restore", equipmentDocVersionRestoreHandler)
 	})
 
 	r.Route("/equipment", func(r chi.Router) {
@@ -271,6 +525,20 @@ func main() {
 		r.Get("/{id}", equipmentReadOneHandler)
 		r.Put("/{id}", equipmentUpdateHandler)
 		r.Delete("/{id}", equipmentDeleteHandler)
+		r.Post("/bulk", bulkHandler(EquipmentTable))
+		r.Put("/bulk", bulkHandler(EquipmentTable))
+		r.Delete("/bulk", bulkHandler(EquipmentTable))
+		r.Post("/{id}/status", equipmentStatusChangeHandler)
+		r.Post("/{id}/image", uploadHandler(EquipmentTable))
+		r.Post("/{id}/images", imageUploadHandler(EquipmentTable))
+		r.Get("/{id}/images", galleryHandler(EquipmentTable))
+		r.Get("/{id}/status-history", equipmentStatusHistoryHandler)
+		r.Get("/{id}/depreciation", equipmentDepreciationHandler)
+		r.Get("/{id}/warranties", equipmentWarrantiesHandler)
+		r.Get("/{id}/compliance", equipmentComplianceHandler)
+		r.Get("/{id}/label", labelHandler(EquipmentTable))
+		r.Post("/{id}/asset-tag", assetTagHandler(EquipmentTable))
+		r.Post("/{id}/calendar-feeds", calendarFeedCreateHandler(EquipmentTable))
 	})
 
 	r.Route("/inventory", func(r chi.Router) {
@@ -279,6 +547,11 @@ func main() {
 		r.Get("/{id}", inventoryReadOneHandler)
 		r.Put("/{id}", inventoryUpdateHandler)
 		r.Delete("/{id}", inventoryDeleteHandler)
+		r.Post("/bulk", bulkHandler(InventoryTable))
+		r.Put("/bulk", bulkHandler(InventoryTable))
+		r.Delete("/bulk", bulkHandler(InventoryTable))
+		r.Get("/{id}/label", labelHandler(InventoryTable))
+		r.Post("/{id}/asset-tag", assetTagHandler(InventoryTable))
 	})
 
 	r.Route("/maintenance-history", func(r chi.Router) {
@@ -287,6 +560,27 @@ func main() {
 		r.Get("/{id}", maintenanceHistoryReadOneHandler)
 		r.Put("/{id}", maintenanceHistoryUpdateHandler)
 		r.Delete("/{id}", maintenanceHistoryDeleteHandler)
+		r.Post("/bulk", bulkHandler(MaintenanceHistoryTable))
+		r.Put("/bulk", bulkHandler(MaintenanceHistoryTable))
+		r.Delete("/bulk", bulkHandler(MaintenanceHistoryTable))
+		r.Post("/{id}/images", imageUploadHandler(MaintenanceHistoryTable))
+		r.Get("/{id}/images", galleryHandler(MaintenanceHistoryTable))
+		r.Post("/{id}/time-entries/start", timeEntryStartHandler)
+		r.Get("/{id}/labour", maintenanceLabourHandler)
+	})
+
+	r.Route("/time-entries", func(r chi.Router) {
+		r.Post("/", timeEntryCreateHandler)
+		r.Get("/", timeEntryReadHandler)
+		r.Get("/{id}", timeEntryReadOneHandler)
+		r.Put("/{id}", timeEntryUpdateHandler)
+		r.Delete("/{id}", timeEntryDeleteHandler)
+		r.Post("/bulk", bulkHandler(TimeEntriesTable))
+		r.Put("/bulk", bulkHandler(TimeEntriesTable))
+		r.Delete("/bulk", bulkHandler(TimeEntriesTable))
+		r.Post("/{id}/pause", timeEntryTransition("pause"))
+		r.Post("/{id}/resume", timeEntryTransition("resume"))
+		r.Post("/{id}/stop", timeEntryTransition("stop"))
 	})
 
 	r.Route("/maintenance-parts-usage", func(r chi.Router) {
@@ -295,14 +589,25 @@ func main() {
 		r.Get("/{id}", maintenancePartsUsageReadOneHandler)
 		r.Put("/{id}", maintenancePartsUsageUpdateHandler)
 		r.Delete("/{id}", maintenancePartsUsageDeleteHandler)
+		r.Post("/bulk", bulkHandler(MaintenancePartsUsageTable))
+		r.Put("/bulk", bulkHandler(MaintenancePartsUsageTable))
+		r.Delete("/bulk", bulkHandler(MaintenancePartsUsageTable))
 	})
 
 	r.Route("/maintenance-schedule", func(r chi.Router) {
 		r.Post("/", maintenanceScheduleCreateHandler)
 		r.Get("/", maintenanceScheduleReadHandler)
+		r.Post("/import", calendarImportHandler)
 		r.Get("/{id}", maintenanceScheduleReadOneHandler)
 		r.Put("/{id}", maintenanceScheduleUpdateHandler)
 		r.Delete("/{id}", maintenanceScheduleDeleteHandler)
+		r.Post("/bulk", bulkHandler(MaintenanceScheduleTable))
+		r.Put("/bulk", bulkHandler(MaintenanceScheduleTable))
+		r.Delete("/bulk", bulkHandler(MaintenanceScheduleTable))
+		r.Post("/{id}/assignees", scheduleAssignHandler)
+		r.Get("/{id}/assignees", scheduleAssigneesHandler)
+		r.Delete("/{id}/assignees/{userId}", scheduleUnassignHandler)
+		r.Get("/{id}/conflicts", scheduleConflictsHandler)
 	})
 
 	r.Route("/maintenance-types", func(r chi.Router) {
@@ -311,6 +616,9 @@ func main() {
 		r.Get("/{id}", maintenanceTypeReadOneHandler)
 		r.Put("/{id}", maintenanceTypeUpdateHandler)
 		r.Delete("/{id}", maintenanceTypeDeleteHandler)
+		r.Post("/bulk", bulkHandler(MaintenanceTypesTable))
+		r.Put("/bulk", bulkHandler(MaintenanceTypesTable))
+		r.Delete("/bulk", bulkHandler(MaintenanceTypesTable))
 	})
 
 	r.Route("/notifications", func(r chi.Router) {
@@ -319,6 +627,9 @@ func main() {
 		r.Get("/{id}", notificationReadOneHandler)
 		r.Put("/{id}", notificationUpdateHandler)
 		r.Delete("/{id}", notificationDeleteHandler)
+		r.Post("/bulk", bulkHandler(NotificationsTable))
+		r.Put("/bulk", bulkHandler(NotificationsTable))
+		r.Delete("/bulk", bulkHandler(NotificationsTable))
 	})
 
 	r.Route("/purchase-orders", func(r chi.Router) {
@@ -327,6 +638,9 @@ func main() {
 		r.Get("/{id}", purchaseOrderReadOneHandler)
 		r.Put("/{id}", purchaseOrderUpdateHandler)
 		r.Delete("/{id}", purchaseOrderDeleteHandler)
+		r.Post("/bulk", bulkHandler(PurchaseOrdersTable))
+		r.Put("/bulk", bulkHandler(PurchaseOrdersTable))
+		r.Delete("/bulk", bulkHandler(PurchaseOrdersTable))
 	})
 
 	r.Route("/roles", func(r chi.Router) {
@@ -335,6 +649,9 @@ func main() {
 		r.Get("/{id}", roleReadOneHandler)
 		r.Put("/{id}", roleUpdateHandler)
 		r.Delete("/{id}", roleDeleteHandler)
+		r.Post("/bulk", bulkHandler(RolesTable))
+		r.Put("/bulk", bulkHandler(RolesTable))
+		r.Delete("/bulk", bulkHandler(RolesTable))
 	})
 
 	r.Route("/service-providers", func(r chi.Router) {
@@ -343,6 +660,9 @@ func main() {
 		r.Get("/{id}", serviceProviderReadOneHandler)
 		r.Put("/{id}", serviceProviderUpdateHandler)
 		r.Delete("/{id}", serviceProviderDeleteHandler)
+		r.Post("/bulk", bulkHandler(ServiceProvidersTable))
+		r.Put("/bulk", bulkHandler(ServiceProvidersTable))
+		r.Delete("/bulk", bulkHandler(ServiceProvidersTable))
 	})
 
 	r.Route("/suppliers", func(r chi.Router) {
@@ -351,6 +671,9 @@ func main() {
 		r.Get("/{id}", supplierReadOneHandler)
 		r.Put("/{id}", supplierUpdateHandler)
 		r.Delete("/{id}", supplierDeleteHandler)
+		r.Post("/bulk", bulkHandler(SuppliersTable))
+		r.Put("/bulk", bulkHandler(SuppliersTable))
+		r.Delete("/bulk", bulkHandler(SuppliersTable))
 	})
 
 	r.Route("/users", func(r chi.Router) {
@@ -359,9 +682,169 @@ func main() {
 		r.Get("/{id}", userReadOneHandler)
 		r.Put("/{id}", userUpdateHandler)
 		r.Delete("/{id}", userDeleteHandler)
+		r.Post("/bulk", bulkHandler(UsersTable))
+		r.Put("/bulk", bulkHandler(UsersTable))
+		r.Delete("/bulk", bulkHandler(UsersTable))
+		r.Post("/{id}/calendar-feeds", calendarFeedCreateHandler(UsersTable))
+		r.Get("/{id}/availability", userAvailabilityHandler)
+		r.Get("/{id}/timesheet", userTimesheetHandler)
+	})
+
+	r.Route("/failure-codes", func(r chi.Router) {
+		r.Post("/", failureCodeCreateHandler)
+		r.Get("/", failureCodeReadHandler)
+		r.Get("/pareto", failureCodeParetoHandler)
+		r.Get("/{id}", failureCodeReadOneHandler)
+		r.Put("/{id}", failureCodeUpdateHandler)
+		r.Delete("/{id}", failureCodeDeleteHandler)
+		r.Post("/bulk", bulkHandler(FailureCodesTable))
+		r.Put("/bulk", bulkHandler(FailureCodesTable))
+		r.Delete("/bulk", bulkHandler(FailureCodesTable))
 	})
 
-	err := http.ListenAndServe(":8181", r)
+	r.Route("/maintenance-budgets", func(r chi.Router) {
+		r.Post("/", maintenanceBudgetCreateHandler)
+		r.Get("/", maintenanceBudgetReadHandler)
+		r.Get("/comparison", maintenanceBudgetComparisonHandler)
+		r.Get("/{id}", maintenanceBudgetReadOneHandler)
+		r.Put("/{id}", maintenanceBudgetUpdateHandler)
+		r.Delete("/{id}", maintenanceBudgetDeleteHandler)
+		r.Post("/bulk", bulkHandler(MaintenanceBudgetsTable))
+		r.Put("/bulk", bulkHandler(MaintenanceBudgetsTable))
+		r.Delete("/bulk", bulkHandler(MaintenanceBudgetsTable))
+	})
+
+	r.Get("/maintenance-costs", maintenanceCostHandler)
+
+	r.Route("/meter-readings", func(r chi.Router) {
+		r.Post("/", meterReadingCreateHandler)
+		r.Get("/", meterReadingReadHandler)
+		r.Get("/{id}", meterReadingReadOneHandler)
+		r.Put("/{id}", meterReadingUpdateHandler)
+		r.Delete("/{id}", meterReadingDeleteHandler)
+		r.Post("/bulk", bulkHandler(MeterReadingsTable))
+		r.Put("/bulk", bulkHandler(MeterReadingsTable))
+		r.Delete("/bulk", bulkHandler(MeterReadingsTable))
+	})
+
+	r.Route("/warranties", func(r chi.Router) {
+		r.Post("/", warrantyCreateHandler)
+		r.Get("/", warrantyReadHandler)
+		r.Get("/{id}", warrantyReadOneHandler)
+		r.Put("/{id}", warrantyUpdateHandler)
+		r.Delete("/{id}", warrantyDeleteHandler)
+		r.Post("/bulk", bulkHandler(WarrantiesTable))
+		r.Put("/bulk", bulkHandler(WarrantiesTable))
+		r.Delete("/bulk", bulkHandler(WarrantiesTable))
+	})
+
+	r.Route("/files", func(r chi.Router) {
+		r.Get("/{id}", fileReadOneHandler)
+		r.Get("/{id}/download", fileDownloadHandler)
+	})
+
+	r.Route("/images", func(r chi.Router) {
+		r.Get("/{id}", imageDownloadHandler)
+		r.Get("/{id}/thumbnails/{size}", imageThumbnailHandler)
+		r.Delete("/{id}", imageDeleteHandler)
+	})
+
+	r.Route("/calendar-feeds", func(r chi.Router) {
+		r.Get("/", calendarFeedReadHandler)
+		r.Delete("/{id}", calendarFeedDeleteHandler)
+	})
+
+	r.Get("/calendar/{token}.ics", calendarFeedHandler)
+
+	r.Route("/skills", func(r chi.Router) {
+		r.Post("/", skillCreateHandler)
+		r.Get("/", skillReadHandler)
+		r.Get("/{id}", skillReadOneHandler)
+		r.Put("/{id}", skillUpdateHandler)
+		r.Delete("/{id}", skillDeleteHandler)
+		r.Post("/bulk", bulkHandler(SkillsTable))
+		r.Put("/bulk", bulkHandler(SkillsTable))
+		r.Delete("/bulk", bulkHandler(SkillsTable))
+	})
+
+	r.Route("/user-skills", func(r chi.Router) {
+		r.Post("/", userSkillCreateHandler)
+		r.Get("/", userSkillReadHandler)
+		r.Get("/{id}", userSkillReadOneHandler)
+		r.Put("/{id}", userSkillUpdateHandler)
+		r.Delete("/{id}", userSkillDeleteHandler)
+		r.Post("/bulk", bulkHandler(UserSkillsTable))
+		r.Put("/bulk", bulkHandler(UserSkillsTable))
+		r.Delete("/bulk", bulkHandler(UserSkillsTable))
+	})
+
+	r.Route("/maintenance-type-skills", func(r chi.Router) {
+		r.Post("/", maintenanceTypeSkillCreateHandler)
+		r.Get("/", maintenanceTypeSkillReadHandler)
+		r.Get("/{id}", maintenanceTypeSkillReadOneHandler)
+		r.Put("/{id}", maintenanceTypeSkillUpdateHandler)
+		r.Delete("/{id}", maintenanceTypeSkillDeleteHandler)
+		r.Post("/bulk", bulkHandler(MaintenanceTypeSkillsTable))
+		r.Put("/bulk", bulkHandler(MaintenanceTypeSkillsTable))
+		r.Delete("/bulk", bulkHandler(MaintenanceTypeSkillsTable))
+	})
+
+	r.Route("/work-shifts", func(r chi.Router) {
+		r.Post("/", workShiftCreateHandler)
+		r.Get("/", workShiftReadHandler)
+		r.Get("/{id}", workShiftReadOneHandler)
+		r.Put("/{id}", workShiftUpdateHandler)
+		r.Delete("/{id}", workShiftDeleteHandler)
+		r.Post("/bulk", bulkHandler(WorkShiftsTable))
+		r.Put("/bulk", bulkHandler(WorkShiftsTable))
+		r.Delete("/bulk", bulkHandler(WorkShiftsTable))
+	})
+
+	r.Route("/leaves", func(r chi.Router) {
+		r.Post("/", leaveCreateHandler)
+		r.Get("/", leaveReadHandler)
+		r.Get("/{id}", leaveReadOneHandler)
+		r.Put("/{id}", leaveUpdateHandler)
+		r.Delete("/{id}", leaveDeleteHandler)
+		r.Post("/bulk", bulkHandler(LeavesTable))
+		r.Put("/bulk", bulkHandler(LeavesTable))
+		r.Delete("/bulk", bulkHandler(LeavesTable))
+	})
+
+	r.Route("/planner", func(r chi.Router) {
+		r.Post("/preview", planPreviewHandler)
+		r.Get("/plans", planReadHandler)
+		r.Get("/plans/{id}", planReadOneHandler)
+		r.Post("/plans/{id}/commit", planCommitHandler)
+		r.Delete("/plans/{id}", planDiscardHandler)
+	})
+
+	r.Route("/trash", func(r chi.Router) {
+		r.Get("/{resource}", trashReadHandler)
+		r.Post("/{resource}/{id}/restore", trashRestoreHandler)
+		r.With(requireAdmin).Delete("/{resource}/{id}", trashPurgeHandler)
+	})
+
+	r.Route("/audit-logs", func(r chi.Router) {
+		r.Get("/", auditLogReadHandler)
+		r.Get("/verify", auditLogVerifyHandler)
+		r.Get("/{id}", auditLogReadOneHandler)
+	})
+
+	r.Route("/imports", func(r chi.Router) {
+		r.Get("/", importJobReadHandler)
+		r.Get("/{id}", importJobReadOneHandler)
+		r.Post("/{resource}", importCreateHandler)
+	})
+
+	r.Route("/labels", func(r chi.Router) {
+		r.Get("/sheet", labelSheetHandler)
+		r.Get("/resolve", labelScanHandler)
+	})
+
+	r.With(requireAdmin).Get("/debug/vars", expvar.Handler().ServeHTTP)
+
+	err = http.ListenAndServe(":8181", r)
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestValidateRecords runs the validation rules of every table over an empty
+// record, so a rule that does not fit the type of its field, such as datetime
+// on a time.Time, shows up here instead of panicking on a request.
+func TestValidateRecords(t *testing.T) {
+	validate = newValidator()
+	for _, table := range allTables() {
+		t.Run(table.String(), func(t *testing.T) {
+			defer func() {
+				if p := recover(); p != nil {
+					t.Fatalf("validating %s panicked: %v", table, p)
+				}
+			}()
+			Validate(table.Struct())
+		})
+	}
+}
+
+// TestValidateReferences checks that ids, quantities and dates of complete
+// records pass, as the rules meant for strings once refused every one of them.
+func TestValidateReferences(t *testing.T) {
+	validate = newValidator()
+	day := time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	records := []interface{}{
+		&Equipment{CompanyID: 12, EquipmentCategoryID: 3, Name: "Compressor", PurchaseDate: day, WarrantyExpiry: day, LastMaintenanceDate: day},
+		&Inventory{CompanyID: 12, Name: "Filter", CurrentStock: 4, MinRequiredQuantity: 2, LastOrderDate: day},
+		&MaintenancePartsUsage{MaintenanceHistoryID: 7, InventoryID: 5, QuantityUsed: 3},
+	}
+	for _, record := range records {
+		if problems := Validate(record); len(problems) > 0 {
+			t.Errorf("%T: %v", record, problems)
+		}
+	}
+}
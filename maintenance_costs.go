@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type MaintenanceBudget struct {
+	gorm.Model
+	CompanyID           uint               `gorm:"type:int(10);index;not null" validate:"required"`
+	Company             *Company           `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	EquipmentCategoryID *uint              `gorm:"type:int(10);index;default:NULL"`
+	EquipmentCategory   *EquipmentCategory `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	EquipmentID         *uint              `gorm:"type:int(10);index;default:NULL"`
+	Equipment           *Equipment         `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	Month               time.Time          `gorm:"type:date;not null" validate:"required"`
+	Amount              float64            `gorm:"type:decimal(12,2);not null;default:0" validate:"gte=0"`
+}
+
+type MaintenanceCostRow struct {
+	GroupID      uint    `json:"group_id"`
+	GroupName    string  `json:"group_name"`
+	Month        string  `json:"month,omitempty"`
+	Events       int64   `json:"events"`
+	LabourHours  float64 `json:"labour_hours"`
+	LabourCost   float64 `json:"labour_cost"`
+	PartsCost    float64 `json:"parts_cost"`
+	ExternalCost float64 `json:"external_cost"`
+	TotalCost    float64 `json:"total_cost"`
+}
+
+type BudgetComparisonRow struct {
+	Month    string  `json:"month"`
+	Planned  float64 `json:"planned"`
+	Actual   float64 `json:"actual"`
+	Variance float64 `json:"variance"`
+}
+
+var costGroups = map[string][2]string{
+	"equipment": {"equipment.id", "equipment.name"},
+	"category":  {"equipment_categories.id", "equipment_categories.category_name"},
+	"company":   {"companies.id", "companies.name"},
+	"month":     {"0", "''"},
+}
+
+// recalculateMaintenanceCost refreshes the labour, parts and total cost of a
+// maintenance history entry from its user's rate, its parts usage and its
+// external invoice amount. Once time entries have been stopped on it, their
+// logged hours and frozen rates replace the hours entered by hand; when all
+// of them are in the trash the hours are what they log, none.
+func recalculateMaintenanceCost(tx *gorm.DB, historyID uint) error {
+	var history MaintenanceHistory
+	if result := tx.First(&history, historyID); result.Error != nil {
+		return result.Error
+	}
+
+	if history.LabourRate == 0 {
+		var user User
+		if result := tx.First(&user, history.UserID); result.Error == nil {
+			history.LabourRate = user.HourlyRate
+		}
+	}
+
+	var partsCost float64
+	result := tx.Model(&MaintenancePartsUsage{}).
+		Where("maintenance_history_id = ?", historyID).
+		Select("COALESCE(SUM(total_cost), 0)").
+		Scan(&partsCost)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	var logged struct {
+		Entries int64
+		Seconds float64
+		Cost    float64
+	}
+	result = tx.Model(&TimeEntry{}).
+		Where("maintenance_history_id = ? AND ended_at IS NOT NULL", historyID).
+		Select("COUNT(*) AS entries, COALESCE(SUM(worked_seconds), 0) AS seconds, "+
+			"COALESCE(SUM(worked_seconds * CASE WHEN hourly_rate > 0 THEN hourly_rate ELSE ? END), 0) / 3600 AS cost", history.LabourRate).
+		Scan(&logged)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if logged.Entries == 0 {
+		// LabourHours still holds what the trashed entries logged, not hours
+		// entered by hand.
+		var trashed int64
+		result = tx.Unscoped().Model(&TimeEntry{}).
+			Where("maintenance_history_id = ? AND ended_at IS NOT NULL AND deleted_at IS NOT NULL", historyID).
+			Count(&trashed)
+		if result.Error != nil {
+			return result.Error
+		}
+		if trashed > 0 {
+			history.LabourHours = 0
+		}
+	}
+
+	labourCost := history.LabourHours * history.LabourRate
+	if logged.Entries > 0 {
+		history.LabourHours = logged.Seconds / 3600
+		labourCost = logged.Cost
+	}
+	return tx.Model(&history).UpdateColumns(map[string]interface{}{
+		"labour_hours": history.LabourHours,
+		"labour_rate":  history.LabourRate,
+		"labour_cost":  labourCost,
+		"parts_cost":   partsCost,
+		"total_cost":   labourCost + partsCost + history.ExternalCost,
+	}).Error
+}
+
+// priceMaintenancePartsUsage freezes the inventory unit cost on a parts usage
+// row so later price changes do not rewrite past maintenance costs.
+func priceMaintenancePartsUsage(tx *gorm.DB, usage *MaintenancePartsUsage) error {
+	if usage.UnitCost == 0 {
+		var item Inventory
+		if result := tx.First(&item, usage.InventoryID); result.Error != nil {
+			return result.Error
+		}
+		usage.UnitCost = item.UnitCost
+	}
+	usage.TotalCost = usage.UnitCost * float64(usage.QuantityUsed)
+	return nil
+}
+
+func maintenanceBudgetCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if Create(w, r, MaintenanceBudgetsTable) {
+		fmt.Println("maintenance budget created")
+		return
+	}
+	fmt.Println("maintenance budget not created")
+	return
+}
+
+func maintenanceBudgetReadHandler(w http.ResponseWriter, r *http.Request) {
+	if Read(w, r, MaintenanceBudgetsTable) {
+		fmt.Println("maintenance budgets read")
+		return
+	}
+	fmt.Println("maintenance budgets not read")
+	return
+}
+
+func maintenanceBudgetReadOneHandler(w http.ResponseWriter, r *http.Request) {
+	if ReadOne(w, r, MaintenanceBudgetsTable) {
+		fmt.Println("maintenance budget read")
+		return
+	}
+	fmt.Println("maintenance budget not read")
+	return
+}
+
+func maintenanceBudgetUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if Update(w, r, MaintenanceBudgetsTable) {
+		fmt.Println("maintenance budget updated")
+		return
+	}
+	fmt.Println("maintenance budget not updated")
+	return
+}
+
+func maintenanceBudgetDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if Delete(w, r, MaintenanceBudgetsTable) {
+		fmt.Println("maintenance budget deleted")
+		return
+	}
+	fmt.Println("maintenance budget not deleted")
+	return
+}
+
+func costQuery(r *http.Request) *gorm.DB {
+	query := db.Table("maintenance_history").
+		Joins("JOIN equipment ON equipment.id = maintenance_history.equipment_id").
+		Joins("JOIN equipment_categories ON equipment_categories.id = equipment.equipment_category_id").
+		Joins("JOIN companies ON companies.id = equipment.company_id").
+		Where("maintenance_history.deleted_at IS NULL")
+
+	params := r.URL.Query()
+	if v := params.Get("company_id"); v != "" {
+		query = query.Where("companies.id = ?", v)
+	}
+	if v := params.Get("equipment_category_id"); v != "" {
+		query = query.Where("equipment_categories.id = ?", v)
+	}
+	if v := params.Get("equipment_id"); v != "" {
+		query = query.Where("equipment.id = ?", v)
+	}
+	if v := params.Get("from"); v != "" {
+		query = query.Where("maintenance_history.performed_at >= ?", v)
+	}
+	if v := params.Get("to"); v != "" {
+		query = query.Where("maintenance_history.performed_at < ?", v)
+	}
+	return query
+}
+
+// maintenanceCostHandler rolls maintenance costs up per equipment, category,
+// company or month. Non-month groupings are additionally split by month when
+// monthly=true is passed.
+func maintenanceCostHandler(w http.ResponseWriter, r *http.Request) {
+	groupBy := r.URL.Query().Get("group_by")
+	if groupBy == "" {
+		groupBy = "equipment"
+	}
+	group, ok := costGroups[groupBy]
+	if !ok {
+		responseWithMsg(w, http.StatusBadRequest, "group_by must be one of equipment, category, company, month")
+		return
+	}
+
+	selects := group[0] + " AS group_id, " + group[1] + " AS group_name, " +
+		"COUNT(*) AS events, " +
+		"COALESCE(SUM(maintenance_history.labour_hours), 0) AS labour_hours, " +
+		"COALESCE(SUM(maintenance_history.labour_cost), 0) AS labour_cost, " +
+		"COALESCE(SUM(maintenance_history.parts_cost), 0) AS parts_cost, " +
+		"COALESCE(SUM(maintenance_history.external_cost), 0) AS external_cost, " +
+		"COALESCE(SUM(maintenance_history.total_cost), 0) AS total_cost"
+	groups := group[0] + ", " + group[1]
+	if groupBy == "month" {
+		groups = "month"
+	} else if r.URL.Query().Get("monthly") == "true" {
+		groups += ", month"
+	}
+	if groupBy == "month" || r.URL.Query().Get("monthly") == "true" {
+		selects += ", DATE_FORMAT(maintenance_history.performed_at, '%Y-%m') AS month"
+	}
+
+	var rows []MaintenanceCostRow
+	result := costQuery(r).Select(selects).Group(groups).Order(groups).Scan(&rows)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, rows, fmt.Sprintf("maintenance costs by %s read", groupBy))
+	return
+}
+
+// maintenanceBudgetComparisonHandler compares the planned budget of a company
+// with its actual maintenance cost month by month. Budgets can be narrowed to
+// a category or a single piece of equipment the same way costs are.
+func maintenanceBudgetComparisonHandler(w http.ResponseWriter, r *http.Request) {
+	companyID := r.URL.Query().Get("company_id")
+	if companyID == "" {
+		responseWithMsg(w, http.StatusBadRequest, "company_id is required")
+		return
+	}
+
+	var actual []BudgetComparisonRow
+	result := costQuery(r).
+		Select("DATE_FORMAT(maintenance_history.performed_at, '%Y-%m') AS month, " +
+			"COALESCE(SUM(maintenance_history.total_cost), 0) AS actual").
+		Group("month").
+		Scan(&actual)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	budgets := db.Table("maintenance_budgets").
+		Select("DATE_FORMAT(month, '%Y-%m') AS month, COALESCE(SUM(amount), 0) AS planned").
+		Where("company_id = ? AND deleted_at IS NULL", companyID)
+	if v := r.URL.Query().Get("equipment_category_id"); v != "" {
+		budgets = budgets.Where("equipment_category_id = ?", v)
+	} else {
+		budgets = budgets.Where("equipment_category_id IS NULL")
+	}
+	if v := r.URL.Query().Get("equipment_id"); v != "" {
+		budgets = budgets.Where("equipment_id = ?", v)
+	} else {
+		budgets = budgets.Where("equipment_id IS NULL")
+	}
+	if v := r.URL.Query().Get("from"); v != "" {
+		budgets = budgets.Where("month >= ?", v)
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		budgets = budgets.Where("month < ?", v)
+	}
+
+	var planned []BudgetComparisonRow
+	result = budgets.Group("DATE_FORMAT(month, '%Y-%m')").Scan(&planned)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, mergeBudgetRows(planned, actual), "maintenance budget comparison read")
+	return
+}
+
+func mergeBudgetRows(planned, actual []BudgetComparisonRow) []BudgetComparisonRow {
+	months := map[string]*BudgetComparisonRow{}
+	var order []string
+	for _, rows := range [][]BudgetComparisonRow{planned, actual} {
+		for _, row := range rows {
+			m, ok := months[row.Month]
+			if !ok {
+				m = &BudgetComparisonRow{Month: row.Month}
+				months[row.Month] = m
+				order = append(order, row.Month)
+			}
+			m.Planned += row.Planned
+			m.Actual += row.Actual
+		}
+	}
+
+	sort.Strings(order)
+	merged := make([]BudgetComparisonRow, 0, len(order))
+	for _, month := range order {
+		m := months[month]
+		m.Variance = m.Planned - m.Actual
+		merged = append(merged, *m)
+	}
+	return merged
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 	"net/http"
 	"time"
@@ -9,21 +8,39 @@ import (
 
 type MaintenanceHistory struct {
 	gorm.Model
-	EquipmentID           uint                `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	Equipment             Equipment           `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	ServiceProviderID     uint                `gorm:"type:int(10);index;" validate:"alphanum,len=10"`
-	ServiceProvider       ServiceProvider     `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
-	UserID                uint                `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	User                  User                `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	MaintenanceScheduleID uint                `gorm:"type:int(10);index;" validate:"alphanum,len=10"`
-	MaintenanceSchedule   MaintenanceSchedule `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
-	MaintenanceDate       time.Time           `gorm:"not null" validate:"required,datetime"`
-	MaintenanceTime       time.Time           `gorm:"not null" validate:"required,datetime"`
-	AdditionalNotes       string              `gorm:"type:varchar(500)" validate:"max=500"`
+	EquipmentID           uint                 `gorm:"type:int(10);index;not null" validate:"required"`
+	Equipment             *Equipment           `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	ServiceProviderID     uint                 `gorm:"type:int(10);index;"`
+	ServiceProvider       *ServiceProvider     `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:",omitempty"`
+	UserID                uint                 `gorm:"type:int(10);index;not null" validate:"required"`
+	User                  *User                `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	MaintenanceScheduleID uint                 `gorm:"type:int(10);index;"`
+	MaintenanceSchedule   *MaintenanceSchedule `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:",omitempty"`
+	PerformedAt           time.Time            `gorm:"not null;index" validate:"required"`
+	DurationMinutes       int                  `gorm:"type:int(10);not null;default:60" validate:"gte=0"`
+	AdditionalNotes       string               `gorm:"type:varchar(500)" validate:"max=500"`
+	ProblemCodeID         *uint                `gorm:"type:int(10);index;default:NULL"`
+	ProblemCode           *FailureCode         `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:",omitempty"`
+	CauseCodeID           *uint                `gorm:"type:int(10);index;default:NULL"`
+	CauseCode             *FailureCode         `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:",omitempty"`
+	RemedyCodeID          *uint                `gorm:"type:int(10);index;default:NULL"`
+	RemedyCode            *FailureCode         `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:",omitempty"`
+	LabourHours           float64              `gorm:"type:decimal(8,2);not null;default:0" validate:"gte=0"`
+	LabourRate            float64              `gorm:"type:decimal(10,2);not null;default:0" validate:"gte=0"`
+	LabourCost            float64              `gorm:"type:decimal(12,2);not null;default:0"`
+	PartsCost             float64              `gorm:"type:decimal(12,2);not null;default:0"`
+	ExternalCost          float64              `gorm:"type:decimal(12,2);not null;default:0" validate:"gte=0"`
+	ExternalInvoiceNumber string               `gorm:"type:varchar(100)" validate:"max=100"`
+	TotalCost             float64              `gorm:"type:decimal(12,2);not null;default:0"`
+	WarrantyID            *uint                `gorm:"type:int(10);index;default:NULL"`
+	Warranty              *Warranty            `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:",omitempty"`
+	PossiblyUnderWarranty bool                 `gorm:"type:tinyint(1);not null;default:0"`
+	SuggestedProviderID   *uint                `gorm:"-"`
+	Timezone              string               `gorm:"-"`
 }
 
 func (c *MaintenanceHistory) Decode(data []byte) (MaintenanceHistory, error) {
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return MaintenanceHistory{}, err
 	}
@@ -34,105 +51,215 @@ func (c *MaintenanceHistory) Encode() ([]byte, error) {
 	return json.Marshal(c)
 }
 
+func (c *MaintenanceHistory) localize(loc *time.Location) {
+	c.PerformedAt = c.PerformedAt.In(loc)
+	c.Timezone = loc.String()
+}
+
+// createMaintenanceHistory checks the failure codes, flags work that may be
+// covered by a warranty, stores the record and prices it.
+func createMaintenanceHistory(tx *gorm.DB, data *MaintenanceHistory) error {
+	if err := checkFailureCodes(*data); err != nil {
+		return err
+	}
+
+	var err error
+	data.WarrantyID, data.SuggestedProviderID, err = flagWarrantyCoverage(data.EquipmentID, data.PerformedAt)
+	if err != nil {
+		return err
+	}
+	data.PossiblyUnderWarranty = data.WarrantyID != nil
+
+	if result := tx.Create(data); result.Error != nil {
+		return result.Error
+	}
+	if err = recalculateMaintenanceCost(tx, data.ID); err != nil {
+		return err
+	}
+	return tx.First(data, data.ID).Error
+}
+
+// saveMaintenanceHistory stores a changed record and prices it again.
+func saveMaintenanceHistory(tx *gorm.DB, data *MaintenanceHistory) error {
+	if err := checkFailureCodes(*data); err != nil {
+		return err
+	}
+	if result := tx.Save(data); result.Error != nil {
+		return result.Error
+	}
+	if err := recalculateMaintenanceCost(tx, data.ID); err != nil {
+		return err
+	}
+	return tx.First(data, data.ID).Error
+}
+
 func maintenanceHistoryCreateHandler(w http.ResponseWriter, r *http.Request) {
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
+		return
+	}
+
+	body, err = localizeBody(body, zones.ownerOf(equipmentIDInBody(body, 0)), "performed_at")
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
 	var c MaintenanceHistory
 	data, err := c.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
-	result := db.Create(&data)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return createMaintenanceHistory(tx, &data)
+	})
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
+	data.localize(zones.forEquipment(data.EquipmentID))
 	responseWithJSON(w, http.StatusOK, data, "maintenance history created")
 	return
 }
 
 func maintenanceHistoryReadHandler(w http.ResponseWriter, r *http.Request) {
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
 	var data []MaintenanceHistory
-	result := db.Find(&data)
+	query, err := includeQuery(r, &MaintenanceHistory{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.Find(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
+	for i := range data {
+		data[i].localize(zones.forEquipment(data[i].EquipmentID))
+	}
+
 	responseWithJSON(w, http.StatusOK, data, "maintenance history read")
 	return
 }
 
 func maintenanceHistoryReadOneHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data MaintenanceHistory
-	result := db.First(&data, id)
+	query, err := includeQuery(r, &MaintenanceHistory{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
+
+	data.localize(zones.forEquipment(data.EquipmentID))
 	responseWithJSON(w, http.StatusOK, data, "maintenance history read")
 	return
 }
 
 func maintenanceHistoryUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data MaintenanceHistory
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
+		return
+	}
+
+	body, err = localizeBody(body, zones.ownerOf(equipmentIDInBody(body, data.EquipmentID)), "performed_at")
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
 	data, err = data.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
-	result = db.Save(&data)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return saveMaintenanceHistory(tx, &data)
+	})
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
+	data.localize(zones.forEquipment(data.EquipmentID))
 	responseWithJSON(w, http.StatusOK, data, "maintenance history updated")
 	return
 }
 
 func maintenanceHistoryDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	var data MaintenanceHistory
-	result := db.Delete(&data, id)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if err = trashRecord(db, MaintenanceHistoryTable, id); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
-	responseWithJSON(w, http.StatusOK, data, "maintenance history deleted")
+	responseWithJSON(w, http.StatusOK, nil, "maintenance history deleted")
 	return
 }
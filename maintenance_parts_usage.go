@@ -1,22 +1,23 @@
 package main
 
 import (
-	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 	"net/http"
 )
 
 type MaintenancePartsUsage struct {
 	gorm.Model
-	MaintenanceHistoryID uint               `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	MaintenanceHistory   MaintenanceHistory `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	InventoryID          uint               `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	Inventory            Inventory          `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	QuantityUsed         uint               `gorm:"type:int(10);not null;default:0" validate:"required,alphanum,len=10"`
+	MaintenanceHistoryID uint                `gorm:"type:int(10);index;not null" validate:"required"`
+	MaintenanceHistory   *MaintenanceHistory `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	InventoryID          uint                `gorm:"type:int(10);index;not null" validate:"required"`
+	Inventory            *Inventory          `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	QuantityUsed         uint                `gorm:"type:int(10);not null;default:0" validate:"required"`
+	UnitCost             float64             `gorm:"type:decimal(12,2);not null;default:0" validate:"gte=0"`
+	TotalCost            float64             `gorm:"type:decimal(12,2);not null;default:0" validate:"gte=0"`
 }
 
 func (c *MaintenancePartsUsage) Decode(data []byte) (MaintenancePartsUsage, error) {
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return MaintenancePartsUsage{}, err
 	}
@@ -27,29 +28,69 @@ func (c *MaintenancePartsUsage) Encode() ([]byte, error) {
 	return json.Marshal(c)
 }
 
+// createMaintenancePartsUsage prices the parts at the current stock cost,
+// stores the usage and updates the cost of the maintenance it belongs to.
+func createMaintenancePartsUsage(tx *gorm.DB, data *MaintenancePartsUsage) error {
+	if err := maintenanceHistoryAcceptsWork(tx, data.MaintenanceHistoryID); err != nil {
+		return err
+	}
+	if err := priceMaintenancePartsUsage(tx, data); err != nil {
+		return err
+	}
+	if result := tx.Create(data); result.Error != nil {
+		return result.Error
+	}
+	return recalculateMaintenanceCost(tx, data.MaintenanceHistoryID)
+}
+
+// saveMaintenancePartsUsage stores a changed usage, pricing it again when the
+// part changed, and updates the cost of the maintenance it left and joined.
+func saveMaintenancePartsUsage(tx *gorm.DB, data *MaintenancePartsUsage, previousHistoryID, previousInventoryID uint) error {
+	if err := maintenanceHistoryAcceptsWork(tx, data.MaintenanceHistoryID); err != nil {
+		return err
+	}
+	if data.InventoryID != previousInventoryID {
+		data.UnitCost = 0
+	}
+	if err := priceMaintenancePartsUsage(tx, data); err != nil {
+		return err
+	}
+	if result := tx.Save(data); result.Error != nil {
+		return result.Error
+	}
+	for _, historyID := range []uint{previousHistoryID, data.MaintenanceHistoryID} {
+		if err := recalculateMaintenanceCost(tx, historyID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func maintenancePartsUsageCreateHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	var c MaintenancePartsUsage
 	data, err := c.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
-	result := db.Create(&data)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return createMaintenancePartsUsage(tx, &data)
+	})
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
@@ -59,9 +100,14 @@ func maintenancePartsUsageCreateHandler(w http.ResponseWriter, r *http.Request)
 
 func maintenancePartsUsageReadHandler(w http.ResponseWriter, r *http.Request) {
 	var data []MaintenancePartsUsage
-	result := db.Find(&data)
+	query, err := includeQuery(r, &MaintenancePartsUsage{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.Find(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -70,11 +116,20 @@ func maintenancePartsUsageReadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func maintenancePartsUsageReadOneHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data MaintenancePartsUsage
-	result := db.First(&data, id)
+	query, err := includeQuery(r, &MaintenancePartsUsage{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 	responseWithJSON(w, http.StatusOK, data, "maintenance parts usage read")
@@ -82,35 +137,44 @@ func maintenancePartsUsageReadOneHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func maintenancePartsUsageUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data MaintenancePartsUsage
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
+	previousHistoryID := data.MaintenanceHistoryID
+	previousInventoryID := data.InventoryID
+
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	data, err = data.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
-	result = db.Save(&data)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return saveMaintenancePartsUsage(tx, &data, previousHistoryID, previousInventoryID)
+	})
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
@@ -119,11 +183,20 @@ func maintenancePartsUsageUpdateHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func maintenancePartsUsageDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data MaintenancePartsUsage
-	result := db.Delete(&data, id)
+	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	if err = trashRecord(db, MaintenancePartsUsageTable, id); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 	responseWithJSON(w, http.StatusOK, data, "maintenance parts usage deleted")
@@ -2,7 +2,6 @@ package main
 
 import (
 	"database/sql"
-	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 	"net/http"
 	"time"
@@ -10,18 +9,24 @@ import (
 
 type MaintenanceSchedule struct {
 	gorm.Model
-	EquipmentID       uint            `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	Equipment         Equipment       `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	MaintenanceTypeID uint            `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	MaintenanceType   MaintenanceType `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	ReminderSent      bool            `gorm:"type:tinyint(1);default:0;not null" validate:"required,boolean"`
-	ScheduledDate     time.Time       `gorm:"not null" validate:"required,datetime"`
-	ScheduledTime     time.Time       `gorm:"not null" validate:"required,datetime"`
-	Notes             sql.NullString  `gorm:"type:varchar(500)" validate:"max=500"`
+	EquipmentID           uint                `gorm:"type:int(10);index;not null" validate:"required"`
+	Equipment             *Equipment          `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	MaintenanceTypeID     uint                `gorm:"type:int(10);index;not null" validate:"required"`
+	MaintenanceType       *MaintenanceType    `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	ReminderSent          bool                `gorm:"type:tinyint(1);default:0;not null" validate:"required,boolean"`
+	ScheduledAt           time.Time           `gorm:"not null;index" validate:"required"`
+	DurationMinutes       int                 `gorm:"type:int(10);not null;default:60" validate:"gte=0"`
+	Notes                 sql.NullString      `gorm:"type:varchar(500)" validate:"max=500"`
+	WarrantyID            *uint               `gorm:"type:int(10);index;default:NULL"`
+	Warranty              *Warranty           `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:",omitempty"`
+	PossiblyUnderWarranty bool                `gorm:"type:tinyint(1);not null;default:0"`
+	SuggestedProviderID   *uint               `gorm:"-"`
+	Timezone              string              `gorm:"-"`
+	Warnings              []AssignmentWarning `gorm:"-" json:",omitempty"`
 }
 
 func (c *MaintenanceSchedule) Decode(data []byte) (MaintenanceSchedule, error) {
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return MaintenanceSchedule{}, err
 	}
@@ -32,107 +37,203 @@ func (c *MaintenanceSchedule) Encode() ([]byte, error) {
 	return json.Marshal(c)
 }
 
+func (c *MaintenanceSchedule) localize(loc *time.Location) {
+	c.ScheduledAt = c.ScheduledAt.In(loc)
+	c.Timezone = loc.String()
+}
+
+// createMaintenanceSchedule flags visits that may be covered by a warranty and
+// stores the schedule.
+func createMaintenanceSchedule(tx *gorm.DB, data *MaintenanceSchedule) error {
+	if err := equipmentAcceptsWork(tx, data.EquipmentID); err != nil {
+		return err
+	}
+
+	var err error
+	data.WarrantyID, data.SuggestedProviderID, err = flagWarrantyCoverage(data.EquipmentID, data.ScheduledAt)
+	if err != nil {
+		return err
+	}
+	data.PossiblyUnderWarranty = data.WarrantyID != nil
+
+	return tx.Create(data).Error
+}
+
+func saveMaintenanceSchedule(tx *gorm.DB, data *MaintenanceSchedule) error {
+	if err := equipmentAcceptsWork(tx, data.EquipmentID); err != nil {
+		return err
+	}
+	return tx.Save(data).Error
+}
+
 func maintenanceScheduleCreateHandler(w http.ResponseWriter, r *http.Request) {
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
+		return
+	}
+
+	body, err = localizeBody(body, zones.ownerOf(equipmentIDInBody(body, 0)), "scheduled_at")
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
 	var c MaintenanceSchedule
 	data, err := c.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
-	result := db.Create(&data)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	if err = createMaintenanceSchedule(db, &data); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
+	data.localize(zones.forEquipment(data.EquipmentID))
 	responseWithJSON(w, http.StatusOK, data, "maintenance schedule created")
 	return
 }
 
 func maintenanceScheduleReadHandler(w http.ResponseWriter, r *http.Request) {
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
 	var data []MaintenanceSchedule
-	result := db.Find(&data)
+	query, err := includeQuery(r, &MaintenanceSchedule{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.Find(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
+	for i := range data {
+		data[i].localize(zones.forEquipment(data[i].EquipmentID))
+	}
+
 	responseWithJSON(w, http.StatusOK, data, "maintenance schedule read")
 	return
 }
 
 func maintenanceScheduleReadOneHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data MaintenanceSchedule
-	result := db.First(&data, id)
+	query, err := includeQuery(r, &MaintenanceSchedule{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
+	data.localize(zones.forEquipment(data.EquipmentID))
+
 	responseWithJSON(w, http.StatusOK, data, "maintenance schedule read")
 	return
 }
 
 func maintenanceScheduleUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data MaintenanceSchedule
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
+		return
+	}
+
+	body, err = localizeBody(body, zones.ownerOf(equipmentIDInBody(body, data.EquipmentID)), "scheduled_at")
+	if err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
 	data, err = data.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
-	result = db.Save(&data)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	if err = saveMaintenanceSchedule(db, &data); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
+	if data.Warnings, err = scheduleConflicts(data); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	data.localize(zones.forEquipment(data.EquipmentID))
 	responseWithJSON(w, http.StatusOK, data, "maintenance schedule updated")
 	return
 }
 
 func maintenanceScheduleDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	var data MaintenanceSchedule
-	result := db.Delete(&data, id)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if err = trashRecord(db, MaintenanceScheduleTable, id); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
-	responseWithJSON(w, http.StatusOK, data, "maintenance schedule deleted")
+	responseWithJSON(w, http.StatusOK, nil, "maintenance schedule deleted")
 	return
 }
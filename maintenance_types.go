@@ -2,7 +2,6 @@ package main
 
 import (
 	"database/sql"
-	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 	"net/http"
 )
@@ -14,7 +13,7 @@ type MaintenanceType struct {
 }
 
 func (c *MaintenanceType) Decode(data []byte) (MaintenanceType, error) {
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return MaintenanceType{}, err
 	}
@@ -28,26 +27,26 @@ func (c *MaintenanceType) Encode() ([]byte, error) {
 func maintenanceTypeCreateHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	var c MaintenanceType
 	data, err := c.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result := db.Create(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -57,9 +56,14 @@ func maintenanceTypeCreateHandler(w http.ResponseWriter, r *http.Request) {
 
 func maintenanceTypeReadHandler(w http.ResponseWriter, r *http.Request) {
 	var data []MaintenanceType
-	result := db.Find(&data)
+	query, err := includeQuery(r, &MaintenanceType{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.Find(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -68,11 +72,20 @@ func maintenanceTypeReadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func maintenanceTypeReadOneHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data MaintenanceType
-	result := db.First(&data, id)
+	query, err := includeQuery(r, &MaintenanceType{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -81,35 +94,39 @@ func maintenanceTypeReadOneHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func maintenanceTypeUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data MaintenanceType
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	data, err = data.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result = db.Save(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -118,14 +135,16 @@ func maintenanceTypeUpdateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func maintenanceTypeDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	var data MaintenanceType
-	result := db.Delete(&data, id)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if err = trashRecord(db, MaintenanceTypesTable, id); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
-	responseWithJSON(w, http.StatusOK, data, "maintenance type deleted")
+	responseWithJSON(w, http.StatusOK, nil, "maintenance type deleted")
 	return
 }
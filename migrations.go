@@ -0,0 +1,336 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"gorm.io/gorm"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// SchemaMigration records the one-off data migrations that already ran, so
+// each of them is applied exactly once.
+type SchemaMigration struct {
+	ID        string `gorm:"type:varchar(100);primaryKey"`
+	AppliedAt time.Time
+}
+
+// migrations run in order, each in its own transaction together with the row
+// recording it. MySQL commits around schema changes, so steps that alter
+// tables must be safe to run again after a partial failure; steps that only
+// rewrite data are applied exactly once.
+//
+// Only the UTC migration has steps here, as it rewrites data the running code
+// no longer reads. The app creates no other tables or columns: those added
+// since, such as calendar feeds, time entries or the audit log, come with
+// the schema that is set up outside it, like the original tables.
+var migrations = []struct {
+	id  string
+	run func(tx *gorm.DB) error
+}{
+	{"2026-10-utc-instants/columns", addInstantColumns},
+	{"2026-10-utc-instants/shift", shiftLegacyDatetimes},
+	{"2026-10-utc-instants/merge", mergeInstantColumns},
+	{"2026-10-utc-instants/index", indexInstants},
+}
+
+// migrationApplied tells whether a step ran. Steps of a migration that was
+// recorded as a whole before it was split count as applied.
+func migrationApplied(id string) (bool, error) {
+	ids := []string{id}
+	if whole, _, split := strings.Cut(id, "/"); split {
+		ids = append(ids, whole)
+	}
+	var count int64
+	result := db.Model(&SchemaMigration{}).Where("id IN ?", ids).Count(&count)
+	return count > 0, result.Error
+}
+
+func runMigrations() error {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		applied, err := migrationApplied(m.id)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		log.Printf("running migration %s", m.id)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := m.run(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{ID: m.id, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", m.id, err)
+		}
+	}
+	return nil
+}
+
+// legacyLocation is the zone the server wrote wall times in while the DSN
+// still used loc=Local. DB_LEGACY_TIMEZONE overrides it when the migration
+// runs on a different host.
+func legacyLocation() (*time.Location, error) {
+	if name := os.Getenv("DB_LEGACY_TIMEZONE"); name != "" {
+		return time.LoadLocation(name)
+	}
+	return time.Local, nil
+}
+
+type instantMerge struct {
+	table   Tables
+	date    string
+	clock   string
+	instant string
+}
+
+var instantMerges = []instantMerge{
+	{MaintenanceScheduleTable, "scheduled_date", "scheduled_time", "scheduled_at"},
+	{MaintenanceHistoryTable, "maintenance_date", "maintenance_time", "performed_at"},
+}
+
+// The UTC migration moves the database from server local wall times to UTC:
+// schedules and history get instant columns, existing datetime columns are
+// shifted out of the legacy zone, the split date and time columns are merged
+// into the instants, and companies and users get a timezone setting.
+
+// addInstantColumns adds the columns of the UTC migration that are missing.
+func addInstantColumns(tx *gorm.DB) error {
+	m := tx.Migrator()
+	columns := []struct {
+		table Tables
+		name  string
+		ddl   string
+	}{
+		{MaintenanceScheduleTable, "scheduled_at", "DATETIME(3) NULL"},
+		{MaintenanceScheduleTable, "duration_minutes", "INT(10) NOT NULL DEFAULT 60"},
+		{MaintenanceHistoryTable, "performed_at", "DATETIME(3) NULL"},
+		{MaintenanceHistoryTable, "duration_minutes", "INT(10) NOT NULL DEFAULT 60"},
+		{CompaniesTable, "timezone", "VARCHAR(64) NOT NULL DEFAULT 'UTC'"},
+		{UsersTable, "timezone", "VARCHAR(64) NULL"},
+	}
+	for _, c := range columns {
+		if !m.HasTable(c.table.String()) || m.HasColumn(c.table.String(), c.name) {
+			continue
+		}
+		if err := tx.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` %s", c.table.String(), c.name, c.ddl)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeInstantColumns fills the instants from the split date and time
+// columns, then drops those. The instants are computed from the split columns
+// alone, so a merge interrupted before the drop can simply run again.
+func mergeInstantColumns(tx *gorm.DB) error {
+	legacy, err := legacyLocation()
+	if err != nil {
+		return err
+	}
+	m := tx.Migrator()
+	for _, merge := range instantMerges {
+		table := merge.table.String()
+		if !m.HasTable(table) || !m.HasColumn(table, merge.date) {
+			continue
+		}
+		if err := mergeInstants(tx, merge, legacy); err != nil {
+			return err
+		}
+		for _, old := range []string{merge.date, merge.clock} {
+			if !m.HasColumn(table, old) {
+				continue
+			}
+			if err := tx.Exec(fmt.Sprintf("ALTER TABLE `%s` DROP COLUMN `%s`", table, old)).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexInstants makes the instants mandatory, falling back to the creation
+// time of rows that had none, and indexes them.
+func indexInstants(tx *gorm.DB) error {
+	m := tx.Migrator()
+	for _, merge := range instantMerges {
+		table := merge.table.String()
+		if !m.HasTable(table) {
+			continue
+		}
+		statements := []string{
+			fmt.Sprintf("UPDATE `%s` SET `%s` = created_at WHERE `%s` IS NULL", table, merge.instant, merge.instant),
+			fmt.Sprintf("ALTER TABLE `%s` MODIFY `%s` DATETIME(3) NOT NULL", table, merge.instant),
+		}
+		index := fmt.Sprintf("idx_%s_%s", table, merge.instant)
+		if !m.HasIndex(table, index) {
+			statements = append(statements, fmt.Sprintf("CREATE INDEX `%s` ON `%s` (`%s`)", index, table, merge.instant))
+		}
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fromLegacy reinterprets a wall time read back as UTC in the legacy zone.
+func fromLegacy(t time.Time, legacy *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), legacy).UTC()
+}
+
+func mergeInstants(tx *gorm.DB, merge instantMerge, legacy *time.Location) error {
+	table := merge.table.String()
+	rows, err := tx.Table(table).Select("id", merge.date, merge.clock).Rows()
+	if err != nil {
+		return err
+	}
+	type row struct {
+		id          uint
+		date, clock time.Time
+	}
+	var pending []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.date, &r.clock); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, r)
+	}
+	rows.Close()
+
+	for _, r := range pending {
+		wall := time.Date(r.date.Year(), r.date.Month(), r.date.Day(), r.clock.Hour(), r.clock.Minute(), r.clock.Second(), 0, time.UTC)
+		result := tx.Table(table).Where("id = ?", r.id).UpdateColumn(merge.instant, fromLegacy(wall, legacy))
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+// legacyTables are the tables that held wall times when the UTC migration
+// was written. Tables added later only ever stored UTC, so they stay out of
+// the shift however the enum grows.
+var legacyTables = []Tables{
+	CompaniesTable,
+	ComplianceDocumentsTable,
+	EquipmentCategoriesTable,
+	EquipmentDocsTable,
+	EquipmentTable,
+	InventoryTable,
+	MaintenanceHistoryTable,
+	MaintenancePartsUsageTable,
+	MaintenanceScheduleTable,
+	MaintenanceTypesTable,
+	NotificationsTable,
+	PurchaseOrdersTable,
+	RolesTable,
+	ServiceProvidersTable,
+	SuppliersTable,
+	UsersTable,
+	FailureCodesTable,
+	MaintenanceBudgetsTable,
+	EquipmentStatusHistoryTable,
+	MeterReadingsTable,
+	WarrantiesTable,
+	ComplianceNoticesTable,
+	StoredFilesTable,
+	EquipmentDocVersionsTable,
+	ImageAttachmentsTable,
+	ImageThumbnailsTable,
+	CalendarFeedsTable,
+}
+
+// shiftLegacyDatetimes converts every other DATETIME column of the legacy
+// tables from legacy wall time to UTC. It only updates rows, so it commits
+// together with its migration record and never shifts a value twice.
+func shiftLegacyDatetimes(tx *gorm.DB) error {
+	legacy, err := legacyLocation()
+	if err != nil {
+		return err
+	}
+	if legacy.String() == "UTC" {
+		return nil
+	}
+
+	skip := map[string]bool{}
+	for _, merge := range instantMerges {
+		skip[merge.table.String()+"."+merge.date] = true
+		skip[merge.table.String()+"."+merge.clock] = true
+		skip[merge.table.String()+"."+merge.instant] = true
+	}
+
+	for _, t := range legacyTables {
+		table := t.String()
+		var columns []string
+		result := tx.Raw("SELECT column_name FROM information_schema.columns "+
+			"WHERE table_schema = DATABASE() AND table_name = ? AND data_type = 'datetime'", table).Scan(&columns)
+		if result.Error != nil {
+			return result.Error
+		}
+		var shifted []string
+		for _, column := range columns {
+			if !skip[table+"."+column] {
+				shifted = append(shifted, column)
+			}
+		}
+		if len(shifted) > 0 {
+			if err := shiftTable(tx, table, shifted, legacy); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func shiftTable(tx *gorm.DB, table string, columns []string, legacy *time.Location) error {
+	rows, err := tx.Table(table).Select(append([]string{"id"}, columns...)).Rows()
+	if err != nil {
+		return err
+	}
+	type row struct {
+		id     uint
+		values []sql.NullTime
+	}
+	var pending []row
+	for rows.Next() {
+		r := row{values: make([]sql.NullTime, len(columns))}
+		dest := []interface{}{&r.id}
+		for i := range r.values {
+			dest = append(dest, &r.values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, r)
+	}
+	rows.Close()
+
+	for _, r := range pending {
+		updates := map[string]interface{}{}
+		for i, value := range r.values {
+			if value.Valid && !value.Time.IsZero() {
+				updates[columns[i]] = fromLegacy(value.Time, legacy)
+			}
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		if result := tx.Table(table).Where("id = ?", r.id).UpdateColumns(updates); result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
@@ -1,24 +1,23 @@
 package main
 
 import (
-	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 	"net/http"
 )
 
 type Notification struct {
 	gorm.Model
-	UserID           uint    `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	User             User    `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	RelatedID        uint    `gorm:"type:int(10)" validate:"alphanum,len=10"`
-	RelatedType      string  `gorm:"type:ENUM('inventory','equipments','schedule','role','providers','parts_usage','documents');not null;default:'inventory';column:related_type" validate:"required,oneof=inventory equipments schedule role providers parts_usage documents"`
+	UserID           uint    `gorm:"type:int(10);index;not null" validate:"required"`
+	User             *User   `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	RelatedID        uint    `gorm:"type:int(10)"`
+	RelatedType      string  `gorm:"type:ENUM('inventory','equipments','schedule','role','providers','parts_usage','documents','warranties');not null;default:'inventory';column:related_type" validate:"required,oneof=inventory equipments schedule role providers parts_usage documents warranties"`
 	NotificationType string  `gorm:"type:varchar(255);not null" validate:"required,max=255"`
 	Message          *string `gorm:"type:text;not null" validate:"required,max=65535"`
 	Status           string  `gorm:"type:ENUM('Unread','Read','Dismissed');default:'Unread';column:status" validate:"oneof=Unread Read Dismissed"`
 }
 
 func (c *Notification) Decode(data []byte) (Notification, error) {
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return Notification{}, err
 	}
@@ -32,26 +31,26 @@ func (c *Notification) Encode() ([]byte, error) {
 func notificationCreateHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	var c Notification
 	data, err := c.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result := db.Create(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -61,9 +60,14 @@ func notificationCreateHandler(w http.ResponseWriter, r *http.Request) {
 
 func notificationReadHandler(w http.ResponseWriter, r *http.Request) {
 	var data []Notification
-	result := db.Find(&data)
+	query, err := includeQuery(r, &Notification{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.Find(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -72,11 +76,20 @@ func notificationReadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func notificationReadOneHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data Notification
-	result := db.First(&data, id)
+	query, err := includeQuery(r, &Notification{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -85,35 +98,39 @@ func notificationReadOneHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func notificationUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data Notification
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	data, err = data.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result = db.Save(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -122,11 +139,13 @@ func notificationUpdateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func notificationDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	var data Notification
-	result := db.Delete(&data, id)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if err = trashRecord(db, NotificationsTable, id); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaintenancePlan is a proposal of the automatic planner. It is created as a
+// preview and only turns into schedules and assignments once committed.
+type MaintenancePlan struct {
+	gorm.Model
+	CompanyID   uint        `gorm:"type:int(10);index;not null"`
+	Company     *Company    `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	Status      string      `gorm:"type:ENUM('preview','committed','discarded');not null;default:'preview';column:status"`
+	Request     string      `gorm:"type:longtext;not null" json:"-"`
+	Result      string      `gorm:"type:longtext;not null" json:"-"`
+	CommittedAt *time.Time  `gorm:"default:NULL"`
+	Proposal    *PlanResult `gorm:"-"`
+}
+
+type PlanDemand struct {
+	Key               string     `json:"key" validate:"max=100"`
+	EquipmentID       uint       `json:"equipment_id" validate:"required"`
+	MaintenanceTypeID uint       `json:"maintenance_type_id" validate:"required"`
+	DueAt             time.Time  `json:"due_at" validate:"required"`
+	EarliestAt        *time.Time `json:"earliest_at"`
+	DurationMinutes   int        `json:"duration_minutes" validate:"gte=0"`
+	Technicians       int        `json:"technicians" validate:"gte=0"`
+	SkillIDs          []uint     `json:"skill_ids"`
+	Notes             string     `json:"notes" validate:"max=500"`
+}
+
+type PlanRequest struct {
+	CompanyID            uint         `json:"company_id" validate:"required"`
+	From                 time.Time    `json:"from" validate:"required"`
+	To                   time.Time    `json:"to" validate:"required,gtfield=From"`
+	DailyCapacityMinutes int          `json:"daily_capacity_minutes" validate:"gte=0"`
+	UserIDs              []uint       `json:"user_ids"`
+	Demands              []PlanDemand `json:"demands" validate:"required,min=1,dive"`
+}
+
+type PlannedSchedule struct {
+	DemandKey         string    `json:"demand_key"`
+	EquipmentID       uint      `json:"equipment_id"`
+	MaintenanceTypeID uint      `json:"maintenance_type_id"`
+	ScheduledAt       time.Time `json:"scheduled_at"`
+	DurationMinutes   int       `json:"duration_minutes"`
+	UserIDs           []uint    `json:"user_ids"`
+	Notes             string    `json:"notes,omitempty"`
+	ScheduleID        uint      `json:"schedule_id,omitempty"`
+}
+
+type UnplacedDemand struct {
+	DemandKey string `json:"demand_key"`
+	Reason    string `json:"reason"`
+}
+
+type TechnicianLoad struct {
+	UserID           uint `json:"user_id"`
+	PlannedMinutes   int  `json:"planned_minutes"`
+	AvailableMinutes int  `json:"available_minutes"`
+}
+
+type PlanResult struct {
+	Timezone string            `json:"timezone"`
+	Placed   []PlannedSchedule `json:"placed"`
+	Unplaced []UnplacedDemand  `json:"unplaced"`
+	Workload []TechnicianLoad  `json:"workload"`
+}
+
+type planTechnician struct {
+	user      User
+	free      []Interval
+	daily     map[string]int
+	planned   int
+	available int
+	qualified map[qualification]bool
+}
+
+// qualification is what a technician's skills are checked for: certificates
+// are valid for some due dates of a maintenance type and not for later ones.
+type qualification struct {
+	maintenanceTypeID uint
+	dueAt             int64
+}
+
+// defaultShifts are the working hours assumed for technicians without a
+// working calendar, PLANNER_DEFAULT_SHIFT on Monday to Friday.
+func defaultShifts() []WorkShift {
+	start, end := "08:00", "16:00"
+	if v := os.Getenv("PLANNER_DEFAULT_SHIFT"); v != "" {
+		if a, b, ok := strings.Cut(v, "-"); ok {
+			start, end = strings.TrimSpace(a), strings.TrimSpace(b)
+		}
+	}
+	var shifts []WorkShift
+	for day := time.Monday; day <= time.Friday; day++ {
+		shifts = append(shifts, WorkShift{Weekday: int(day), StartTime: start, EndTime: end})
+	}
+	return shifts
+}
+
+func minutesIn(intervals []Interval) int {
+	total := 0
+	for _, in := range intervals {
+		total += int(in.End.Sub(in.Start) / time.Minute)
+	}
+	return total
+}
+
+func loadPlanTechnicians(req PlanRequest, zones *zoneResolver) ([]*planTechnician, error) {
+	var users []User
+	query := db.Where("company_id = ?", req.CompanyID)
+	if len(req.UserIDs) > 0 {
+		query = query.Where("id IN ?", req.UserIDs)
+	}
+	if result := query.Order("id").Find(&users); result.Error != nil {
+		return nil, result.Error
+	}
+
+	var technicians []*planTechnician
+	for _, user := range users {
+		working, _, err := userWorkingTime(user, req.From, req.To, zones.forUser(user), defaultShifts())
+		if err != nil {
+			return nil, err
+		}
+		bookings, err := userBookings(db, user.ID, req.From, req.To, 0)
+		if err != nil {
+			return nil, err
+		}
+		var booked []Interval
+		for _, b := range bookings {
+			booked = append(booked, Interval{Start: b.ScheduledAt, End: b.ScheduledAt.Add(time.Duration(b.DurationMinutes) * time.Minute)})
+		}
+		free := subtractIntervals(working, booked)
+		technicians = append(technicians, &planTechnician{
+			user:      user,
+			free:      free,
+			daily:     map[string]int{},
+			available: minutesIn(free),
+			qualified: map[qualification]bool{},
+		})
+	}
+	return technicians, nil
+}
+
+// qualifiedFor tells whether a technician meets the skills of a maintenance
+// type plus the extra skills a demand asks for.
+func (t *planTechnician) qualifiedFor(d PlanDemand) (bool, error) {
+	key := qualification{maintenanceTypeID: d.MaintenanceTypeID, dueAt: d.DueAt.Unix()}
+	ok, checked := t.qualified[key]
+	if !checked {
+		gaps, err := missingSkills(t.user.ID, d.MaintenanceTypeID, d.DueAt)
+		if err != nil {
+			return false, err
+		}
+		ok = len(gaps) == 0
+		t.qualified[key] = ok
+	}
+	if !ok || len(d.SkillIDs) == 0 {
+		return ok, nil
+	}
+
+	var count int64
+	result := db.Model(&UserSkill{}).
+		Where("user_id = ? AND skill_id IN ?", t.user.ID, d.SkillIDs).
+		Where("expires_at IS NULL OR expires_at >= ?", d.DueAt).
+		Distinct("skill_id").
+		Count(&count)
+	return count == int64(len(uniqueIDs(d.SkillIDs))), result.Error
+}
+
+func uniqueIDs(ids []uint) []uint {
+	seen := map[uint]bool{}
+	var unique []uint
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+func (t *planTechnician) freeAt(start, end time.Time, day string, duration, capacity int) bool {
+	if t.daily[day]+duration > capacity {
+		return false
+	}
+	for _, in := range t.free {
+		if !in.Start.After(start) && !in.End.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *planTechnician) book(start, end time.Time, day string, duration int) {
+	t.free = subtractIntervals(t.free, []Interval{{Start: start, End: end}})
+	t.daily[day] += duration
+	t.planned += duration
+}
+
+// placeDemand looks for the earliest day in the demand's window on which
+// enough qualified technicians are free at the same time, and on that day
+// picks the start and crew with the lowest planned workload so far.
+func placeDemand(d PlanDemand, crew []*planTechnician, from, to time.Time, capacity int, loc *time.Location) (PlannedSchedule, bool) {
+	duration := time.Duration(d.DurationMinutes) * time.Minute
+	windowStart, windowEnd := from, to
+	if d.EarliestAt != nil && d.EarliestAt.After(windowStart) {
+		windowStart = *d.EarliestAt
+	}
+	if d.DueAt.Before(windowEnd) {
+		windowEnd = d.DueAt
+	}
+
+	var starts []time.Time
+	for _, t := range crew {
+		for _, in := range t.free {
+			start := in.Start
+			if start.Before(windowStart) {
+				start = windowStart
+			}
+			if !start.Add(duration).After(windowEnd) && !start.Add(duration).After(in.End) {
+				starts = append(starts, start)
+			}
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	var best []*planTechnician
+	var bestStart time.Time
+	bestLoad, bestDay := -1, ""
+	for _, start := range starts {
+		day := start.In(loc).Format("2006-01-02")
+		if bestDay != "" && day != bestDay {
+			break
+		}
+		end := start.Add(duration)
+		var available []*planTechnician
+		for _, t := range crew {
+			if t.freeAt(start, end, day, d.DurationMinutes, capacity) {
+				available = append(available, t)
+			}
+		}
+		if len(available) < d.Technicians {
+			continue
+		}
+		sort.SliceStable(available, func(i, j int) bool { return available[i].planned < available[j].planned })
+		chosen := available[:d.Technicians]
+		load := 0
+		for _, t := range chosen {
+			load += t.planned
+		}
+		if bestLoad < 0 || load < bestLoad {
+			best, bestStart, bestLoad, bestDay = chosen, start, load, day
+		}
+	}
+	if best == nil {
+		return PlannedSchedule{}, false
+	}
+
+	placed := PlannedSchedule{
+		DemandKey:         d.Key,
+		EquipmentID:       d.EquipmentID,
+		MaintenanceTypeID: d.MaintenanceTypeID,
+		ScheduledAt:       bestStart,
+		DurationMinutes:   d.DurationMinutes,
+		Notes:             d.Notes,
+	}
+	for _, t := range best {
+		t.book(bestStart, bestStart.Add(duration), bestDay, d.DurationMinutes)
+		placed.UserIDs = append(placed.UserIDs, t.user.ID)
+	}
+	return placed, true
+}
+
+// orderDemands fills in the defaults of the demands and sorts them into the
+// order they are placed in.
+func orderDemands(requested []PlanDemand) []PlanDemand {
+	demands := make([]PlanDemand, len(requested))
+	copy(demands, requested)
+	for i := range demands {
+		if demands[i].Key == "" {
+			demands[i].Key = fmt.Sprintf("demand %d", i+1)
+		}
+		if demands[i].DurationMinutes == 0 {
+			demands[i].DurationMinutes = 60
+		}
+		if demands[i].Technicians == 0 {
+			demands[i].Technicians = 1
+		}
+	}
+	sort.SliceStable(demands, func(i, j int) bool {
+		if !demands[i].DueAt.Equal(demands[j].DueAt) {
+			return demands[i].DueAt.Before(demands[j].DueAt)
+		}
+		return demands[i].DurationMinutes > demands[j].DurationMinutes
+	})
+	return demands
+}
+
+// planMaintenance places demands earliest due date first, longer jobs first
+// among equal due dates, and reports those it could not place.
+func planMaintenance(req PlanRequest, zones *zoneResolver) (PlanResult, error) {
+	loc := zones.company(req.CompanyID)
+	capacity := req.DailyCapacityMinutes
+	if capacity == 0 {
+		capacity = envInt("PLANNER_DAILY_CAPACITY_MINUTES", 480)
+	}
+
+	technicians, err := loadPlanTechnicians(req, zones)
+	if err != nil {
+		return PlanResult{}, err
+	}
+
+	demands := orderDemands(req.Demands)
+	plan := PlanResult{Timezone: loc.String(), Placed: []PlannedSchedule{}, Unplaced: []UnplacedDemand{}, Workload: []TechnicianLoad{}}
+	unplaced := func(d PlanDemand, reason string) {
+		plan.Unplaced = append(plan.Unplaced, UnplacedDemand{DemandKey: d.Key, Reason: reason})
+	}
+	for _, d := range demands {
+		var equipment Equipment
+		if result := db.Select("id", "company_id").First(&equipment, d.EquipmentID); result.Error != nil {
+			unplaced(d, fmt.Sprintf("equipment %d not found", d.EquipmentID))
+			continue
+		}
+		if equipment.CompanyID != req.CompanyID {
+			unplaced(d, fmt.Sprintf("equipment %d belongs to another company", d.EquipmentID))
+			continue
+		}
+		if err := equipmentAcceptsWork(db, d.EquipmentID); err != nil {
+			unplaced(d, err.Error())
+			continue
+		}
+		if !d.DueAt.After(req.From) {
+			unplaced(d, "due before the planning horizon starts")
+			continue
+		}
+
+		var crew []*planTechnician
+		for _, t := range technicians {
+			ok, err := t.qualifiedFor(d)
+			if err != nil {
+				return PlanResult{}, err
+			}
+			if ok {
+				crew = append(crew, t)
+			}
+		}
+		if len(crew) < d.Technicians {
+			unplaced(d, fmt.Sprintf("%d qualified technicians, %d needed", len(crew), d.Technicians))
+			continue
+		}
+
+		placed, ok := placeDemand(d, crew, req.From, req.To, capacity, loc)
+		if !ok {
+			unplaced(d, "no free slot with enough technicians before the due date")
+			continue
+		}
+		placed.ScheduledAt = placed.ScheduledAt.In(loc)
+		plan.Placed = append(plan.Placed, placed)
+	}
+
+	for _, t := range technicians {
+		plan.Workload = append(plan.Workload, TechnicianLoad{UserID: t.user.ID, PlannedMinutes: t.planned, AvailableMinutes: t.available})
+	}
+	return plan, nil
+}
+
+func (p *MaintenancePlan) decodeResult() error {
+	var result PlanResult
+	if err := json.Unmarshal([]byte(p.Result), &result); err != nil {
+		return err
+	}
+	p.Proposal = &result
+	return nil
+}
+
+// commitPlan turns a previewed plan into schedules with their assignments.
+// Bookings made since the preview are checked again, holding the locks of
+// the plan's technicians so that two plans committed at once cannot both
+// book them, and equipment taken out of service since is refused. The plan
+// is claimed first, so of two concurrent commits the second finds it no
+// longer in preview.
+func commitPlan(plan *MaintenancePlan) error {
+	if plan.Status != "preview" {
+		return withStatus(http.StatusConflict, fmt.Errorf("plan %d is already %s", plan.ID, plan.Status))
+	}
+	if err := plan.decodeResult(); err != nil {
+		return err
+	}
+
+	var users []string
+	for _, placed := range plan.Proposal.Placed {
+		for _, userID := range placed.UserIDs {
+			users = append(users, strconv.FormatUint(uint64(userID), 10))
+		}
+	}
+	return withRecordLocks(UsersTable, users, func() error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			return commitPlanIn(tx, plan)
+		})
+	})
+}
+
+func commitPlanIn(tx *gorm.DB, plan *MaintenancePlan) error {
+	result := tx.Model(&MaintenancePlan{}).Where("id = ? AND status = ?", plan.ID, "preview").Update("status", "committed")
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return withStatus(http.StatusConflict, fmt.Errorf("plan %d was committed or discarded meanwhile", plan.ID))
+	}
+
+	var conflicts []string
+	for i, placed := range plan.Proposal.Placed {
+		end := placed.ScheduledAt.Add(time.Duration(placed.DurationMinutes) * time.Minute)
+		for _, userID := range placed.UserIDs {
+			bookings, err := userBookings(tx, userID, placed.ScheduledAt, end, 0)
+			if err != nil {
+				return err
+			}
+			if len(bookings) > 0 {
+				conflicts = append(conflicts, fmt.Sprintf("%s: user %d was booked on schedule %d since the preview", placed.DemandKey, userID, bookings[0].ID))
+			}
+		}
+
+		schedule := MaintenanceSchedule{
+			EquipmentID:       placed.EquipmentID,
+			MaintenanceTypeID: placed.MaintenanceTypeID,
+			ScheduledAt:       placed.ScheduledAt,
+			DurationMinutes:   placed.DurationMinutes,
+		}
+		schedule.Notes.String, schedule.Notes.Valid = placed.Notes, placed.Notes != ""
+		if err := createMaintenanceSchedule(tx, &schedule); err != nil {
+			return fmt.Errorf("%s: %w", placed.DemandKey, err)
+		}
+		for j, userID := range placed.UserIDs {
+			role := "assistant"
+			if j == 0 {
+				role = "lead"
+			}
+			assignment := ScheduleAssignment{MaintenanceScheduleID: schedule.ID, UserID: userID, Role: role}
+			if result := tx.Create(&assignment); result.Error != nil {
+				return result.Error
+			}
+		}
+		plan.Proposal.Placed[i].ScheduleID = schedule.ID
+	}
+	if len(conflicts) > 0 {
+		return withStatus(http.StatusConflict, errors.New("plan conflicts with newer bookings: "+strings.Join(conflicts, "; ")))
+	}
+
+	encoded, err := json.Marshal(plan.Proposal)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	plan.Status, plan.Result, plan.CommittedAt = "committed", string(encoded), &now
+	return tx.Save(plan).Error
+}
+
+func planPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := Reader(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var peek struct {
+		CompanyID uint `json:"company_id"`
+	}
+	_ = json.Unmarshal(body, &peek)
+	body, err = localizePlanRequest(body, zones.company(peek.CompanyID))
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	var req PlanRequest
+	if err = decodeJSON(body, &req); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	validationErrors := Validate(req)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
+		return
+	}
+
+	proposal, err := planMaintenance(req, zones)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	encoded, err := json.Marshal(proposal)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	data := MaintenancePlan{CompanyID: req.CompanyID, Status: "preview", Request: string(body), Result: string(encoded), Proposal: &proposal}
+	result := db.Create(&data)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, data, fmt.Sprintf("%d demands placed, %d not placed", len(proposal.Placed), len(proposal.Unplaced)))
+	return
+}
+
+// localizePlanRequest resolves local wall times in the request and in each
+// of its demands in the company's zone.
+func localizePlanRequest(body []byte, loc *time.Location) ([]byte, error) {
+	var object map[string]interface{}
+	if err := decodeJSON(body, &object); err != nil {
+		return nil, err
+	}
+	if _, err := localizeObject(object, loc, "from", "to"); err != nil {
+		return nil, err
+	}
+	demands, _ := object["demands"].([]interface{})
+	for i, d := range demands {
+		demand, ok := d.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, err := localizeObject(demand, loc, "due_at", "earliest_at"); err != nil {
+			return nil, withStatus(http.StatusBadRequest, fmt.Errorf("demand %d: %s", i+1, err.Error()))
+		}
+	}
+	return json.Marshal(object)
+}
+
+func planReadHandler(w http.ResponseWriter, r *http.Request) {
+	var data []MaintenancePlan
+	query, err := includeQuery(r, &MaintenancePlan{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	query = query.Order("id DESC")
+	if companyID := r.URL.Query().Get("company_id"); companyID != "" {
+		query = query.Where("company_id = ?", companyID)
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	result := query.Find(&data)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	for i := range data {
+		if err := data[i].decodeResult(); err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+	}
+	responseWithJSON(w, http.StatusOK, data, "maintenance plans read")
+	return
+}
+
+func planReadOneHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var data MaintenancePlan
+	query, err := includeQuery(r, &MaintenancePlan{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	if err := data.decodeResult(); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	responseWithJSON(w, http.StatusOK, data, "maintenance plan read")
+	return
+}
+
+func planCommitHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var data MaintenancePlan
+	result := db.First(&data, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	if err := commitPlan(&data); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	var scheduleIDs []uint
+	for _, placed := range data.Proposal.Placed {
+		scheduleID := strconv.FormatUint(uint64(placed.ScheduleID), 10)
+		recordRelatedAudit(r, MaintenanceScheduleTable, scheduleID, "create", nil, auditSnapshot(db, MaintenanceScheduleTable, scheduleID))
+		scheduleIDs = append(scheduleIDs, placed.ScheduleID)
+	}
+	var assignments []ScheduleAssignment
+	if len(scheduleIDs) > 0 {
+		result = db.Select("id").Where("maintenance_schedule_id IN ?", scheduleIDs).Order("id").Find(&assignments)
+		if result.Error != nil {
+			auditFailures.Add(1)
+			log.Printf("audit of the assignments of plan %s failed: %v", id, result.Error)
+		}
+	}
+	for _, assignment := range assignments {
+		assignmentID := strconv.FormatUint(uint64(assignment.ID), 10)
+		recordRelatedAudit(r, ScheduleAssignmentsTable, assignmentID, "create", nil, auditSnapshot(db, ScheduleAssignmentsTable, assignmentID))
+	}
+
+	responseWithJSON(w, http.StatusOK, data, fmt.Sprintf("maintenance plan %s committed with %d schedules", id, len(data.Proposal.Placed)))
+	return
+}
+
+func planDiscardHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := db.Model(&MaintenancePlan{}).Where("id = ? AND status = ?", id, "preview").Update("status", "discarded")
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		responseWithMsg(w, http.StatusNotFound, fmt.Sprintf("no plan in preview with id %s", id))
+		return
+	}
+
+	responseWithMsg(w, http.StatusOK, fmt.Sprintf("maintenance plan %s discarded", id))
+	return
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Monday 19 October 2026, in UTC like the company of every case.
+func plannerTime(day, hour, minute int) time.Time {
+	return time.Date(2026, time.October, 19+day, hour, minute, 0, 0, time.UTC)
+}
+
+func plannerTechnician(id uint, planned int, free ...Interval) *planTechnician {
+	t := &planTechnician{user: User{}, free: free, daily: map[string]int{}, planned: planned, available: minutesIn(free)}
+	t.user.ID = id
+	return t
+}
+
+func workday(day int) Interval {
+	return Interval{Start: plannerTime(day, 8, 0), End: plannerTime(day, 16, 0)}
+}
+
+func TestPlaceDemand(t *testing.T) {
+	type placement struct {
+		at    time.Time
+		users []uint
+	}
+	unplaced := placement{}
+	tests := []struct {
+		name     string
+		crew     func() []*planTechnician
+		capacity int
+		demands  []PlanDemand
+		want     []placement
+	}{
+		{
+			name:     "daily capacity moves the second job to the next day",
+			crew:     func() []*planTechnician { return []*planTechnician{plannerTechnician(1, 0, workday(0), workday(1))} },
+			capacity: 240,
+			demands: []PlanDemand{
+				{Key: "a", DueAt: plannerTime(4, 0, 0), DurationMinutes: 180, Technicians: 1},
+				{Key: "b", DueAt: plannerTime(4, 0, 0), DurationMinutes: 180, Technicians: 1},
+			},
+			want: []placement{{plannerTime(0, 8, 0), []uint{1}}, {plannerTime(1, 8, 0), []uint{1}}},
+		},
+		{
+			name:     "a job due before the technician has capacity again stays unplaced",
+			crew:     func() []*planTechnician { return []*planTechnician{plannerTechnician(1, 0, workday(0), workday(1))} },
+			capacity: 240,
+			demands: []PlanDemand{
+				{Key: "a", DueAt: plannerTime(4, 0, 0), DurationMinutes: 180, Technicians: 1},
+				{Key: "b", DueAt: plannerTime(1, 0, 0), DurationMinutes: 120, Technicians: 1},
+			},
+			want: []placement{{plannerTime(0, 8, 0), []uint{1}}, unplaced},
+		},
+		{
+			name:     "jobs of one day follow each other within the capacity",
+			crew:     func() []*planTechnician { return []*planTechnician{plannerTechnician(1, 0, workday(0))} },
+			capacity: 480,
+			demands: []PlanDemand{
+				{Key: "a", DueAt: plannerTime(1, 0, 0), DurationMinutes: 90, Technicians: 1},
+				{Key: "b", DueAt: plannerTime(1, 0, 0), DurationMinutes: 60, Technicians: 1},
+			},
+			want: []placement{{plannerTime(0, 8, 0), []uint{1}}, {plannerTime(0, 9, 30), []uint{1}}},
+		},
+		{
+			name:     "the earliest start of a demand is respected",
+			crew:     func() []*planTechnician { return []*planTechnician{plannerTechnician(1, 0, workday(0), workday(1))} },
+			capacity: 480,
+			demands: []PlanDemand{
+				{Key: "a", DueAt: plannerTime(4, 0, 0), EarliestAt: timePointer(plannerTime(1, 10, 0)), DurationMinutes: 60, Technicians: 1},
+			},
+			want: []placement{{plannerTime(1, 10, 0), []uint{1}}},
+		},
+		{
+			name: "the technician with the lower workload gets the job",
+			crew: func() []*planTechnician {
+				return []*planTechnician{plannerTechnician(1, 120, workday(0)), plannerTechnician(2, 0, workday(0))}
+			},
+			capacity: 480,
+			demands:  []PlanDemand{{Key: "a", DueAt: plannerTime(1, 0, 0), DurationMinutes: 60, Technicians: 1}},
+			want:     []placement{{plannerTime(0, 8, 0), []uint{2}}},
+		},
+		{
+			name: "a crew starts once all of its members are free",
+			crew: func() []*planTechnician {
+				return []*planTechnician{
+					plannerTechnician(1, 0, Interval{Start: plannerTime(0, 8, 0), End: plannerTime(0, 12, 0)}),
+					plannerTechnician(2, 0, Interval{Start: plannerTime(0, 10, 0), End: plannerTime(0, 16, 0)}),
+				}
+			},
+			capacity: 480,
+			demands:  []PlanDemand{{Key: "a", DueAt: plannerTime(1, 0, 0), DurationMinutes: 120, Technicians: 2}},
+			want:     []placement{{plannerTime(0, 10, 0), []uint{1, 2}}},
+		},
+		{
+			name:     "a job longer than the daily capacity cannot be placed",
+			crew:     func() []*planTechnician { return []*planTechnician{plannerTechnician(1, 0, workday(0), workday(1))} },
+			capacity: 240,
+			demands:  []PlanDemand{{Key: "a", DueAt: plannerTime(4, 0, 0), DurationMinutes: 300, Technicians: 1}},
+			want:     []placement{unplaced},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crew := tt.crew()
+			for i, d := range tt.demands {
+				placed, ok := placeDemand(d, crew, plannerTime(0, 0, 0), plannerTime(7, 0, 0), tt.capacity, time.UTC)
+				want := tt.want[i]
+				if want.at.IsZero() {
+					if ok {
+						t.Errorf("%s: placed at %s, want unplaced", d.Key, placed.ScheduledAt)
+					}
+					continue
+				}
+				if !ok {
+					t.Errorf("%s: unplaced, want %s", d.Key, want.at)
+					continue
+				}
+				if !placed.ScheduledAt.Equal(want.at) || fmt.Sprint(placed.UserIDs) != fmt.Sprint(want.users) {
+					t.Errorf("%s: placed at %s with %v, want %s with %v", d.Key, placed.ScheduledAt, placed.UserIDs, want.at, want.users)
+				}
+			}
+		})
+	}
+}
+
+func TestOrderDemands(t *testing.T) {
+	tests := []struct {
+		name    string
+		demands []PlanDemand
+		want    []string
+	}{
+		{
+			name: "earliest due date first",
+			demands: []PlanDemand{
+				{Key: "late", DueAt: plannerTime(3, 0, 0)},
+				{Key: "soon", DueAt: plannerTime(1, 0, 0)},
+			},
+			want: []string{"soon", "late"},
+		},
+		{
+			name: "longer jobs first among equal due dates",
+			demands: []PlanDemand{
+				{Key: "short", DueAt: plannerTime(1, 0, 0), DurationMinutes: 30},
+				{Key: "long", DueAt: plannerTime(1, 0, 0), DurationMinutes: 240},
+				{Key: "default", DueAt: plannerTime(1, 0, 0)},
+			},
+			want: []string{"long", "default", "short"},
+		},
+		{
+			name:    "demands without a key are numbered in request order",
+			demands: []PlanDemand{{DueAt: plannerTime(2, 0, 0)}, {DueAt: plannerTime(1, 0, 0)}},
+			want:    []string{"demand 2", "demand 1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, d := range orderDemands(tt.demands) {
+				if d.DurationMinutes == 0 || d.Technicians == 0 {
+					t.Errorf("%s: duration %d and technicians %d were not defaulted", d.Key, d.DurationMinutes, d.Technicians)
+				}
+				got = append(got, d.Key)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("order %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func timePointer(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-sql-driver/mysql"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Errors are answered with RFC 7807 problem details. Handlers pass whatever
+// error they got to responseWithError, which works out the status: missing
+// records are 404, unique and foreign key violations 409, failed validation
+// 422 and anything the database or storage layer could not do 500, with the
+// cause logged under the request's correlation ID instead of being sent to
+// the client. Only errors known to be the client's fault are 400: malformed
+// bodies and parameters, which handlers give a status with HTTPError, and
+// values MySQL refuses to store. Anything else is taken to be a server error.
+
+const problemContentType = "application/problem+json"
+
+type Problem struct {
+	Type          string           `json:"type"`
+	Title         string           `json:"title"`
+	Status        int              `json:"status"`
+	Detail        string           `json:"detail,omitempty"`
+	Instance      string           `json:"instance,omitempty"`
+	Field         string           `json:"field,omitempty"`
+	CorrelationID string           `json:"correlation_id,omitempty"`
+	Errors        ValidationErrors `json:"errors,omitempty"`
+}
+
+// HTTPError gives an error the status it should be answered with.
+type HTTPError struct {
+	Status int
+	Field  string
+	Err    error
+}
+
+func (e *HTTPError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+func withStatus(status int, err error) error {
+	return &HTTPError{Status: status, Err: err}
+}
+
+var problemTypes = map[int]string{
+	http.StatusBadRequest:            "/problems/bad-request",
+	http.StatusUnauthorized:          "/problems/unauthorized",
+	http.StatusForbidden:             "/problems/forbidden",
+	http.StatusNotFound:              "/problems/not-found",
+	http.StatusNotAcceptable:         "/problems/not-acceptable",
+	http.StatusConflict:              "/problems/conflict",
+	http.StatusPreconditionFailed:    "/problems/precondition-failed",
+	http.StatusRequestEntityTooLarge: "/problems/too-large",
+	http.StatusUnsupportedMediaType:  "/problems/unsupported-media-type",
+	http.StatusUnprocessableEntity:   "/problems/validation",
+	http.StatusFailedDependency:      "/problems/failed-dependency",
+	http.StatusPreconditionRequired:  "/problems/precondition-required",
+	http.StatusInternalServerError:   "/problems/internal",
+}
+
+func newProblem(status int, detail string) Problem {
+	problemType, ok := problemTypes[status]
+	if !ok {
+		problemType = "about:blank"
+	}
+	return Problem{Type: problemType, Title: http.StatusText(status), Status: status, Detail: detail}
+}
+
+func writeProblem(w http.ResponseWriter, problem Problem) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(problem.Status)
+	_ = json.NewEncoder(w).Encode(problem)
+}
+
+var (
+	duplicateKey = regexp.MustCompile(`for key '(?:[^.']+\.)?([^']+)'`)
+	foreignKey   = regexp.MustCompile("FOREIGN KEY \\(`([^`]+)`\\)")
+	childTable   = regexp.MustCompile("fails \\(`[^`]+`\\.`([^`]+)`")
+)
+
+// uniqueField turns the name of a violated unique index back into the field
+// it covers, undoing the uni_<table>_ and idx_<table>_ prefixes gorm adds.
+// The longest table name wins, so idx_equipment_categories_category_name is
+// read as equipment_categories rather than equipment.
+func uniqueField(key string) string {
+	for _, prefix := range []string{"uni_", "idx_"} {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		field, table := key, ""
+		for _, t := range tableNames() {
+			if f, ok := strings.CutPrefix(rest, t+"_"); ok && len(t) > len(table) {
+				field, table = f, t
+			}
+		}
+		return field
+	}
+	return key
+}
+
+func tableNames() []string {
+	var names []string
+	for t := CompaniesTable; t.Struct() != nil; t++ {
+		names = append(names, t.String())
+	}
+	return names
+}
+
+// problemFor classifies an error. Client errors keep their message as the
+// detail, server errors are not described.
+func problemFor(err error) Problem {
+	var validation ValidationErrors
+	if errors.As(err, &validation) {
+		problem := newProblem(http.StatusUnprocessableEntity, "validation failed: "+validation.Error())
+		problem.Errors = validation
+		return problem
+	}
+
+	var httpError *HTTPError
+	if errors.As(err, &httpError) {
+		if httpError.Status >= http.StatusInternalServerError {
+			return newProblem(httpError.Status, "")
+		}
+		problem := newProblem(httpError.Status, err.Error())
+		problem.Field = httpError.Field
+		return problem
+	}
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return newProblem(http.StatusNotFound, err.Error())
+	}
+
+	var mysqlError *mysql.MySQLError
+	if errors.As(err, &mysqlError) {
+		switch mysqlError.Number {
+		case 1062:
+			problem := newProblem(http.StatusConflict, "")
+			if m := duplicateKey.FindStringSubmatch(mysqlError.Message); m != nil {
+				problem.Field = uniqueField(m[1])
+			}
+			problem.Detail = fmt.Sprintf("a record with this %s already exists", problem.Field)
+			return problem
+		case 1452:
+			problem := newProblem(http.StatusConflict, "")
+			if m := foreignKey.FindStringSubmatch(mysqlError.Message); m != nil {
+				problem.Field = m[1]
+			}
+			problem.Detail = fmt.Sprintf("%s refers to a record that does not exist", problem.Field)
+			return problem
+		case 1451:
+			problem := newProblem(http.StatusConflict, "the record is still referenced by other records")
+			if m := childTable.FindStringSubmatch(mysqlError.Message); m != nil {
+				problem.Detail = fmt.Sprintf("the record is still referenced by %s", m[1])
+			}
+			if m := foreignKey.FindStringSubmatch(mysqlError.Message); m != nil {
+				problem.Field = m[1]
+			}
+			return problem
+		case 1264, 1265, 1292, 1366, 1406:
+			return newProblem(http.StatusBadRequest, mysqlError.Message)
+		}
+		return newProblem(http.StatusInternalServerError, "")
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newProblem(http.StatusRequestEntityTooLarge, err.Error())
+	}
+	return newProblem(http.StatusInternalServerError, "")
+}
+
+// responseWithError answers a failed request. Server errors get a
+// correlation ID that is logged together with the real cause.
+func responseWithError(w http.ResponseWriter, r *http.Request, err error) {
+	problem := problemFor(err)
+	problem.Instance = r.URL.Path
+	if problem.Status >= http.StatusInternalServerError {
+		problem.CorrelationID = middleware.GetReqID(r.Context())
+		problem.Detail = "an internal error occurred, quote the correlation ID when reporting it"
+		log.Printf("[%s] %s %s: %v", problem.CorrelationID, r.Method, r.URL.Path, err)
+	}
+	writeProblem(w, problem)
+}
+
+// pathID reads a numeric ID from the URL, so that malformed IDs are refused
+// before they reach a query.
+func pathID(r *http.Request, name string) (string, error) {
+	id := chi.URLParam(r, name)
+	if n, err := strconv.ParseUint(id, 10, 64); err != nil || n == 0 {
+		return id, &HTTPError{Status: http.StatusBadRequest, Field: name, Err: fmt.Errorf("%s must be a positive integer", name)}
+	}
+	return id, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestUniqueField(t *testing.T) {
+	tests := map[string]string{
+		"uni_equipment_asset_tag":                     "asset_tag",
+		"idx_equipment_categories_category_name":      "category_name",
+		"idx_equipment_doc_versions_equipment_doc_id": "equipment_doc_id",
+		"uni_maintenance_type_skills_skill_id":        "skill_id",
+		"uni_users_email":                             "email",
+		"idx_attachment_size":                         "idx_attachment_size",
+		"email":                                       "email",
+	}
+	for key, want := range tests {
+		if got := uniqueField(key); got != want {
+			t.Errorf("uniqueField(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 	"net/http"
 	"time"
@@ -9,21 +8,21 @@ import (
 
 type PurchaseOrder struct {
 	gorm.Model
-	InventoryID     uint      `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	Inventory       Inventory `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	SupplierID      uint      `gorm:"type:int(10);index;" validate:"alphanum,len=10"`
-	Supplier        Supplier  `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
-	CompanyID       uint      `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	Company         Company   `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	UserID          uint      `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	User            User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	QuantityOrdered uint      `gorm:"type:int(10);not null;default:0" validate:"required,alphanum,len=10"`
-	OrderDate       time.Time `gorm:"not null" validate:"required,datetime"`
-	ReceivedDate    time.Time `gorm:"not null" validate:"required,datetime"`
+	InventoryID     uint       `gorm:"type:int(10);index;not null" validate:"required"`
+	Inventory       *Inventory `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	SupplierID      uint       `gorm:"type:int(10);index;"`
+	Supplier        *Supplier  `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:",omitempty"`
+	CompanyID       uint       `gorm:"type:int(10);index;not null" validate:"required"`
+	Company         *Company   `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	UserID          uint       `gorm:"type:int(10);index;not null" validate:"required"`
+	User            *User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	QuantityOrdered uint       `gorm:"type:int(10);not null;default:0" validate:"required"`
+	OrderDate       time.Time  `gorm:"not null" validate:"required"`
+	ReceivedDate    time.Time  `gorm:"not null" validate:"required"`
 }
 
 func (c *PurchaseOrder) Decode(data []byte) (PurchaseOrder, error) {
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return PurchaseOrder{}, err
 	}
@@ -37,26 +36,26 @@ func (c *PurchaseOrder) Encode() ([]byte, error) {
 func purchaseOrderCreateHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	var c PurchaseOrder
 	data, err := c.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result := db.Create(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -66,9 +65,14 @@ func purchaseOrderCreateHandler(w http.ResponseWriter, r *http.Request) {
 
 func purchaseOrderReadHandler(w http.ResponseWriter, r *http.Request) {
 	var data []PurchaseOrder
-	result := db.Find(&data)
+	query, err := includeQuery(r, &PurchaseOrder{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.Find(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -77,11 +81,20 @@ func purchaseOrderReadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func purchaseOrderReadOneHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data PurchaseOrder
-	result := db.First(&data, id)
+	query, err := includeQuery(r, &PurchaseOrder{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -90,35 +103,39 @@ func purchaseOrderReadOneHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func purchaseOrderUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data PurchaseOrder
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	data, err = data.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result = db.Save(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -127,11 +144,13 @@ func purchaseOrderUpdateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func purchaseOrderDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	var data PurchaseOrder
-	result := db.Delete(&data, id)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if err = trashRecord(db, PurchaseOrdersTable, id); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
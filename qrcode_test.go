@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// qrFormatM lists the 15 format bits of level M for masks 0 to 7, as printed
+// in ISO/IEC 18004 table C.1, most significant bit first.
+var qrFormatM = [8]string{
+	"101010000010010", "101000100100101", "101111001111100", "101101101001011",
+	"100010111111001", "100000011001110", "100111110010111", "100101010100000",
+}
+
+func TestEncodeQRVersion(t *testing.T) {
+	tests := []struct {
+		length int
+		size   int
+	}{
+		{1, 21},
+		{14, 21},
+		{15, 25},
+		{26, 25},
+		{27, 29},
+		{180, 53},
+		{181, 57},
+		{213, 57},
+		{214, 0},
+	}
+	for _, tt := range tests {
+		q, err := EncodeQR(bytes.Repeat([]byte("a"), tt.length))
+		if tt.size == 0 {
+			if err == nil {
+				t.Errorf("%d bytes: got a %d module symbol, want an error", tt.length, q.Size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d bytes: %v", tt.length, err)
+			continue
+		}
+		if q.Size != tt.size {
+			t.Errorf("%d bytes: size %d, want %d", tt.length, q.Size, tt.size)
+		}
+	}
+}
+
+// The codewords of "HELLO WORLD" at 1-M are the worked example of the
+// standard; their ten error correction codewords are known.
+func TestRSRemainder(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(len(want))); !bytes.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// qrFormat reads both copies of the format bits of a symbol.
+func qrFormat(q *QRCode) (string, string) {
+	bit := func(x, y int) byte {
+		if q.Dark(x, y) {
+			return '1'
+		}
+		return '0'
+	}
+	first := make([]byte, 15)
+	second := make([]byte, 15)
+	for i := 0; i <= 5; i++ {
+		first[14-i] = bit(8, i)
+	}
+	first[14-6], first[14-7], first[14-8] = bit(8, 7), bit(8, 8), bit(7, 8)
+	for i := 9; i < 15; i++ {
+		first[14-i] = bit(14-i, 8)
+	}
+	for i := 0; i < 8; i++ {
+		second[14-i] = bit(q.Size-1-i, 8)
+	}
+	for i := 8; i < 15; i++ {
+		second[14-i] = bit(8, q.Size-15+i)
+	}
+	return string(first), string(second)
+}
+
+// qrPayload unmasks a symbol, reads its codewords back in placement order,
+// checks the error correction of every block and returns the byte mode data.
+func qrPayload(t *testing.T, q *QRCode, mask int) []byte {
+	t.Helper()
+	clone := &QRCode{Size: q.Size, function: q.function, modules: make([][]bool, q.Size)}
+	for y := range q.modules {
+		clone.modules[y] = append([]bool(nil), q.modules[y]...)
+	}
+	clone.applyMask(mask)
+
+	var bits []bool
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.Size; vert++ {
+			y := vert
+			if (right+1)&2 == 0 {
+				y = q.Size - 1 - vert
+			}
+			for x := right; x >= right-1; x-- {
+				if !clone.function[y][x] {
+					bits = append(bits, clone.modules[y][x])
+				}
+			}
+		}
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i := range codewords {
+		for j := 0; j < 8; j++ {
+			if bits[i*8+j] {
+				codewords[i] |= 1 << (7 - j)
+			}
+		}
+	}
+
+	version := (q.Size - 17) / 4
+	blocks := qrLevelM[version]
+	var lengths []int
+	for _, g := range blocks.groups {
+		for i := 0; i < g[0]; i++ {
+			lengths = append(lengths, g[1])
+		}
+	}
+	data := make([][]byte, len(lengths))
+	next := 0
+	for i := 0; i < lengths[len(lengths)-1]; i++ {
+		for b, n := range lengths {
+			if i < n {
+				data[b] = append(data[b], codewords[next])
+				next++
+			}
+		}
+	}
+	divisor := rsDivisor(blocks.ecPerBlock)
+	var stream []byte
+	for b := range data {
+		ec := make([]byte, blocks.ecPerBlock)
+		for i := range ec {
+			ec[i] = codewords[next+i*len(data)+b]
+		}
+		if got := rsRemainder(data[b], divisor); !bytes.Equal(got, ec) {
+			t.Fatalf("block %d: error correction %v, want %v", b, ec, got)
+		}
+		stream = append(stream, data[b]...)
+	}
+
+	if stream[0]>>4 != 0x4 {
+		t.Fatalf("mode %x, want byte mode", stream[0]>>4)
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	read := func(offset, n int) int {
+		v := 0
+		for i := offset; i < offset+n; i++ {
+			v = v<<1 | int(stream[i/8]>>(7-i%8)&1)
+		}
+		return v
+	}
+	length := read(4, countBits)
+	payload := make([]byte, length)
+	for i := range payload {
+		payload[i] = byte(read(4+countBits+8*i, 8))
+	}
+	return payload
+}
+
+// TestEncodeQR pins the mask the penalty rules pick for a few tags and reads
+// every symbol back, so placement, interleaving and masking are all checked.
+func TestEncodeQR(t *testing.T) {
+	tests := []struct {
+		data    string
+		version int
+		mask    int
+	}{
+		{"EQ-000001", 1, 3},
+		{"INV-004217", 1, 7},
+		{"https://example.com/labels/resolve?code=EQ-000042", 4, 6},
+		{strings.Repeat("0123456789", 20), 10, 2},
+	}
+	for _, tt := range tests {
+		q, err := EncodeQR([]byte(tt.data))
+		if err != nil {
+			t.Errorf("%q: %v", tt.data, err)
+			continue
+		}
+		if version := (q.Size - 17) / 4; version != tt.version {
+			t.Errorf("%q: version %d, want %d", tt.data, version, tt.version)
+			continue
+		}
+		first, second := qrFormat(q)
+		if first != second {
+			t.Errorf("%q: format copies differ, %s and %s", tt.data, first, second)
+		}
+		if first != qrFormatM[tt.mask] {
+			t.Errorf("%q: format bits %s, want %s for mask %d", tt.data, first, qrFormatM[tt.mask], tt.mask)
+			continue
+		}
+		if payload := qrPayload(t, q, tt.mask); string(payload) != tt.data {
+			t.Errorf("%q: decoded %q", tt.data, payload)
+		}
+	}
+}
+
+func TestEncodeQRFinderPatterns(t *testing.T) {
+	q, err := EncodeQR([]byte("EQ-000001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, corner := range [][2]int{{0, 0}, {q.Size - 7, 0}, {0, q.Size - 7}} {
+		for dy := 0; dy < 7; dy++ {
+			for dx := 0; dx < 7; dx++ {
+				ring := max(abs(dx-3), abs(dy-3))
+				if want := ring != 2; q.Dark(corner[0]+dx, corner[1]+dy) != want {
+					t.Fatalf("finder at %v: module %d,%d dark is %v", corner, dx, dy, !want)
+				}
+			}
+		}
+	}
+}
@@ -1,23 +1,22 @@
 package main
 
 import (
-	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 	"net/http"
 )
 
 type Role struct {
 	gorm.Model
-	CompanyID            uint    `gorm:"type:int(10) unsigned;not null;default:0;index:idx_company_id;column:company_id" validate:"required,alphanum,len=10"`
-	Company              Company `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	ParentRoleID         *uint   `gorm:"type:int(10) unsigned;default:NULL;column:parent_role_id" validate:"alphanum,len=10"`
-	ParentRole           *Role   `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	RoleOrDepartmentName string  `gorm:"type:varchar(255);not null" validate:"required,max=255"`
-	IsDepartment         bool    `gorm:"type:tinyint(1);not null;default:0" validate:"required,boolean"`
+	CompanyID            uint     `gorm:"type:int(10) unsigned;not null;default:0;index:idx_company_id;column:company_id" validate:"required"`
+	Company              *Company `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	ParentRoleID         *uint    `gorm:"type:int(10) unsigned;default:NULL;column:parent_role_id"`
+	ParentRole           *Role    `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	RoleOrDepartmentName string   `gorm:"type:varchar(255);not null" validate:"required,max=255"`
+	IsDepartment         bool     `gorm:"type:tinyint(1);not null;default:0" validate:"required,boolean"`
 }
 
 func (c *Role) Decode(data []byte) (Role, error) {
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return Role{}, err
 	}
@@ -31,26 +30,26 @@ func (c *Role) Encode() ([]byte, error) {
 func roleCreateHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	var c Role
 	data, err := c.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result := db.Create(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -59,9 +58,14 @@ func roleCreateHandler(w http.ResponseWriter, r *http.Request) {
 
 func roleReadHandler(w http.ResponseWriter, r *http.Request) {
 	var data []Role
-	result := db.Find(&data)
+	query, err := includeQuery(r, &Role{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.Find(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -69,11 +73,20 @@ func roleReadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func roleReadOneHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data Role
-	result := db.First(&data, id)
+	query, err := includeQuery(r, &Role{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -81,35 +94,39 @@ func roleReadOneHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func roleUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data Role
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	data, err = data.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result = db.Save(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -117,13 +134,15 @@ func roleUpdateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func roleDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	var data Role
-	result := db.Delete(&data, id)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if err = trashRecord(db, RolesTable, id); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
-	responseWithJSON(w, http.StatusOK, data, "role deleted")
+	responseWithJSON(w, http.StatusOK, nil, "role deleted")
 }
@@ -2,7 +2,6 @@ package main
 
 import (
 	"database/sql"
-	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 	"net/http"
 )
@@ -12,7 +11,7 @@ type ServiceProvider struct {
 	Name           string         `gorm:"type:varchar(255);not null" validate:"required,max=255"`
 	Contact        string         `gorm:"type:varchar(255)" validate:"max=255"`
 	Rating         float32        `gorm:"type:decimal(2,1);default:0" validate:"max=5"`
-	ReviewsCount   uint           `gorm:"int(10);default:0" validate:"alphanum,len=10"`
+	ReviewsCount   uint           `gorm:"int(10);default:0"`
 	Specialization sql.NullString `gorm:"type:varchar(500)" validate:"max=500"`
 	Tags           string         `gorm:"type:json" validate:"json"`
 	Address        string         `gorm:"type:varchar(500)" validate:"max=500"`
@@ -20,7 +19,7 @@ type ServiceProvider struct {
 }
 
 func (c *ServiceProvider) Decode(data []byte) (ServiceProvider, error) {
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return ServiceProvider{}, err
 	}
@@ -34,26 +33,26 @@ func (c *ServiceProvider) Encode() ([]byte, error) {
 func serviceProviderCreateHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	var c ServiceProvider
 	data, err := c.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result := db.Create(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -63,9 +62,14 @@ func serviceProviderCreateHandler(w http.ResponseWriter, r *http.Request) {
 
 func serviceProviderReadHandler(w http.ResponseWriter, r *http.Request) {
 	var data []ServiceProvider
-	result := db.Find(&data)
+	query, err := includeQuery(r, &ServiceProvider{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.Find(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -74,11 +78,20 @@ func serviceProviderReadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func serviceProviderReadOneHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data ServiceProvider
-	result := db.First(&data, id)
+	query, err := includeQuery(r, &ServiceProvider{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -87,35 +100,39 @@ func serviceProviderReadOneHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func serviceProviderUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data ServiceProvider
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	data, err = data.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result = db.Save(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -124,14 +141,16 @@ func serviceProviderUpdateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func serviceProviderDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	var data ServiceProvider
-	result := db.Delete(&data, id)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if err = trashRecord(db, ServiceProvidersTable, id); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
-	responseWithJSON(w, http.StatusOK, data, "service provider deleted")
+	responseWithJSON(w, http.StatusOK, nil, "service provider deleted")
 	return
 }
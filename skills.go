@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+type Skill struct {
+	gorm.Model
+	CompanyID   uint     `gorm:"type:int(10);index;not null" validate:"required"`
+	Company     *Company `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	Name        string   `gorm:"type:varchar(100);not null" validate:"required,max=100"`
+	Description string   `gorm:"type:varchar(500)" validate:"max=500"`
+}
+
+// UserSkill is a skill a technician holds. A skill with an ExpiresAt is a
+// certification and stops counting once it has expired.
+type UserSkill struct {
+	gorm.Model
+	UserID            uint       `gorm:"type:int(10);not null;uniqueIndex:idx_user_skill" validate:"required"`
+	User              *User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	SkillID           uint       `gorm:"type:int(10);not null;uniqueIndex:idx_user_skill" validate:"required"`
+	Skill             *Skill     `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	Level             int        `gorm:"type:int(10);not null;default:1" validate:"omitempty,gte=1,lte=5"`
+	CertificateNumber string     `gorm:"type:varchar(100)" validate:"max=100"`
+	CertifiedAt       *time.Time `gorm:"default:NULL"`
+	ExpiresAt         *time.Time `gorm:"default:NULL"`
+}
+
+// MaintenanceTypeSkill is a skill required to perform a maintenance type.
+type MaintenanceTypeSkill struct {
+	gorm.Model
+	MaintenanceTypeID     uint             `gorm:"type:int(10);not null;uniqueIndex:idx_type_skill" validate:"required"`
+	MaintenanceType       *MaintenanceType `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	SkillID               uint             `gorm:"type:int(10);not null;uniqueIndex:idx_type_skill" validate:"required"`
+	Skill                 *Skill           `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	MinLevel              int              `gorm:"type:int(10);not null;default:1" validate:"omitempty,gte=1,lte=5"`
+	RequiresCertification bool             `gorm:"type:tinyint(1);not null;default:0"`
+}
+
+// missingSkills compares what a maintenance type requires with what the user
+// holds at the given time and describes every gap.
+func missingSkills(userID, maintenanceTypeID uint, at time.Time) ([]AssignmentWarning, error) {
+	var required []MaintenanceTypeSkill
+	result := db.Preload("Skill").Where("maintenance_type_id = ?", maintenanceTypeID).Find(&required)
+	if result.Error != nil || len(required) == 0 {
+		return nil, result.Error
+	}
+
+	var held []UserSkill
+	if result = db.Where("user_id = ?", userID).Find(&held); result.Error != nil {
+		return nil, result.Error
+	}
+	bySkill := map[uint]UserSkill{}
+	for _, s := range held {
+		bySkill[s.SkillID] = s
+	}
+
+	var warnings []AssignmentWarning
+	for _, req := range required {
+		name := fmt.Sprintf("skill %d", req.SkillID)
+		if req.Skill != nil {
+			name = req.Skill.Name
+		}
+		s, ok := bySkill[req.SkillID]
+		switch {
+		case !ok:
+			warnings = append(warnings, AssignmentWarning{UserID: userID, Kind: "missing_skill",
+				Message: fmt.Sprintf("user %d lacks the skill %s", userID, name)})
+		case s.Level < req.MinLevel:
+			warnings = append(warnings, AssignmentWarning{UserID: userID, Kind: "insufficient_level",
+				Message: fmt.Sprintf("user %d has %s at level %d, %d is required", userID, name, s.Level, req.MinLevel)})
+		case req.RequiresCertification && s.CertifiedAt == nil:
+			warnings = append(warnings, AssignmentWarning{UserID: userID, Kind: "missing_certification",
+				Message: fmt.Sprintf("user %d is not certified for %s", userID, name)})
+		case s.ExpiresAt != nil && s.ExpiresAt.Before(at):
+			message := fmt.Sprintf("the %s certification of user %d expired on %s", name, userID, s.ExpiresAt.Format("2006-01-02"))
+			if s.ExpiresAt.After(time.Now()) {
+				message = fmt.Sprintf("the %s certification of user %d expires on %s, before the work is due", name, userID, s.ExpiresAt.Format("2006-01-02"))
+			}
+			warnings = append(warnings, AssignmentWarning{UserID: userID, Kind: "certification_expired", Message: message})
+		}
+	}
+	return warnings, nil
+}
+
+func skillCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if Create(w, r, SkillsTable) {
+		fmt.Println("skill created")
+		return
+	}
+	fmt.Println("skill not created")
+	return
+}
+
+func skillReadHandler(w http.ResponseWriter, r *http.Request) {
+	if Read(w, r, SkillsTable) {
+		fmt.Println("skills read")
+		return
+	}
+	fmt.Println("skills not read")
+	return
+}
+
+func skillReadOneHandler(w http.ResponseWriter, r *http.Request) {
+	if ReadOne(w, r, SkillsTable) {
+		fmt.Println("skill read")
+		return
+	}
+	fmt.Println("skill not read")
+	return
+}
+
+func skillUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if Update(w, r, SkillsTable) {
+		fmt.Println("skill updated")
+		return
+	}
+	fmt.Println("skill not updated")
+	return
+}
+
+func skillDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if Delete(w, r, SkillsTable) {
+		fmt.Println("skill deleted")
+		return
+	}
+	fmt.Println("skill not deleted")
+	return
+}
+
+func userSkillCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if Create(w, r, UserSkillsTable) {
+		fmt.Println("user skill created")
+		return
+	}
+	fmt.Println("user skill not created")
+	return
+}
+
+func userSkillReadHandler(w http.ResponseWriter, r *http.Request) {
+	if Read(w, r, UserSkillsTable) {
+		fmt.Println("user skills read")
+		return
+	}
+	fmt.Println("user skills not read")
+	return
+}
+
+func userSkillReadOneHandler(w http.ResponseWriter, r *http.Request) {
+	if ReadOne(w, r, UserSkillsTable) {
+		fmt.Println("user skill read")
+		return
+	}
+	fmt.Println("user skill not read")
+	return
+}
+
+func userSkillUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if Update(w, r, UserSkillsTable) {
+		fmt.Println("user skill updated")
+		return
+	}
+	fmt.Println("user skill not updated")
+	return
+}
+
+func userSkillDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if Delete(w, r, UserSkillsTable) {
+		fmt.Println("user skill deleted")
+		return
+	}
+	fmt.Println("user skill not deleted")
+	return
+}
+
+func maintenanceTypeSkillCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if Create(w, r, MaintenanceTypeSkillsTable) {
+		fmt.Println("maintenance type skill created")
+		return
+	}
+	fmt.Println("maintenance type skill not created")
+	return
+}
+
+func maintenanceTypeSkillReadHandler(w http.ResponseWriter, r *http.Request) {
+	if Read(w, r, MaintenanceTypeSkillsTable) {
+		fmt.Println("maintenance type skills read")
+		return
+	}
+	fmt.Println("maintenance type skills not read")
+	return
+}
+
+func maintenanceTypeSkillReadOneHandler(w http.ResponseWriter, r *http.Request) {
+	if ReadOne(w, r, MaintenanceTypeSkillsTable) {
+		fmt.Println("maintenance type skill read")
+		return
+	}
+	fmt.Println("maintenance type skill not read")
+	return
+}
+
+func maintenanceTypeSkillUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if Update(w, r, MaintenanceTypeSkillsTable) {
+		fmt.Println("maintenance type skill updated")
+		return
+	}
+	fmt.Println("maintenance type skill not updated")
+	return
+}
+
+func maintenanceTypeSkillDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if Delete(w, r, MaintenanceTypeSkillsTable) {
+		fmt.Println("maintenance type skill deleted")
+		return
+	}
+	fmt.Println("maintenance type skill not deleted")
+	return
+}
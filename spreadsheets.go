@@ -0,0 +1,521 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Lists can be downloaded as spreadsheets: GET any list with ?format=csv or
+// ?format=xlsx, or with an Accept header naming either type, and the rows of
+// the JSON answer are sent as a sheet instead. Filters, includes and ?fields=
+// apply as usual; fields of included records become dotted columns such as
+// company.name. Uploaded sheets are read back by the imports.
+
+const (
+	csvContentType  = "text/csv"
+	xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+)
+
+// maxSheetXMLBytes bounds how far a part of an uploaded workbook may inflate.
+const maxSheetXMLBytes = 256 << 20
+
+// exportFormat picks the spreadsheet format a request asks for, if any.
+func exportFormat(r *http.Request) string {
+	switch r.URL.Query().Get("format") {
+	case "csv":
+		return "csv"
+	case "xlsx":
+		return "xlsx"
+	case "":
+		accept := r.Header.Get("Accept")
+		if strings.Contains(accept, xlsxContentType) {
+			return "xlsx"
+		}
+		if strings.Contains(accept, csvContentType) {
+			return "csv"
+		}
+	}
+	return ""
+}
+
+// tabulate lays out the data of a JSON answer as rows, one per object, with
+// nested objects flattened into dotted columns. Columns keep the order in
+// which they first appear.
+func tabulate(body []byte) ([]string, []map[string]interface{}, error) {
+	iter := jsoniter.ParseBytes(json, body)
+	var data []byte
+	for field := iter.ReadObject(); field != ""; field = iter.ReadObject() {
+		if field == "data" {
+			data = iter.SkipAndReturnBytes()
+			continue
+		}
+		iter.Skip()
+	}
+	if iter.Error != nil && iter.Error != io.EOF {
+		return nil, nil, iter.Error
+	}
+
+	var columns []string
+	seen := map[string]bool{}
+	var rows []map[string]interface{}
+	iter = jsoniter.ParseBytes(json, data)
+	switch iter.WhatIsNext() {
+	case jsoniter.ArrayValue:
+		for iter.ReadArray() {
+			if iter.WhatIsNext() != jsoniter.ObjectValue {
+				return nil, nil, errors.New("only lists of records can be exported")
+			}
+			row := map[string]interface{}{}
+			flattenRow(iter, "", row, &columns, seen)
+			rows = append(rows, row)
+		}
+	case jsoniter.ObjectValue:
+		row := map[string]interface{}{}
+		flattenRow(iter, "", row, &columns, seen)
+		rows = append(rows, row)
+	default:
+		return nil, nil, errors.New("only lists of records can be exported")
+	}
+	if iter.Error != nil && iter.Error != io.EOF {
+		return nil, nil, iter.Error
+	}
+	return columns, rows, nil
+}
+
+func flattenRow(iter *jsoniter.Iterator, prefix string, row map[string]interface{}, columns *[]string, seen map[string]bool) {
+	for field := iter.ReadObject(); field != ""; field = iter.ReadObject() {
+		column := prefix + field
+		switch iter.WhatIsNext() {
+		case jsoniter.ObjectValue:
+			flattenRow(iter, column+".", row, columns, seen)
+			continue
+		case jsoniter.ArrayValue:
+			row[column] = string(iter.SkipAndReturnBytes())
+		case jsoniter.StringValue:
+			row[column] = iter.ReadString()
+		case jsoniter.NumberValue:
+			row[column] = iter.ReadNumber()
+		case jsoniter.BoolValue:
+			row[column] = iter.ReadBool()
+		default:
+			iter.Skip()
+			row[column] = nil
+		}
+		if !seen[column] {
+			seen[column] = true
+			*columns = append(*columns, column)
+		}
+	}
+}
+
+// csvFormulaPrefixes start cells that spreadsheet programs would run as
+// formulas. Such text is written behind a quote and read back without it.
+const csvFormulaPrefixes = "=+-@\t\r"
+
+func csvCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		if v != "" && strings.ContainsRune(csvFormulaPrefixes, rune(v[0])) {
+			return "'" + v
+		}
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func writeCSV(w io.Writer, columns []string, rows []map[string]interface{}) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(columns); err != nil {
+		return err
+	}
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, column := range columns {
+			record[i] = csvCell(row[column])
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// columnLetters names a zero-based column the way spreadsheets do: A to Z,
+// then AA and on.
+func columnLetters(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// columnIndex reads the column of a cell reference like AB12.
+func columnIndex(ref string) int {
+	index := 0
+	for _, c := range ref {
+		if c < 'A' || c > 'Z' {
+			break
+		}
+		index = index*26 + int(c-'A') + 1
+	}
+	return index - 1
+}
+
+const (
+	xlsxMainNS = "http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+	xlsxRelsNS = "http://schemas.openxmlformats.org/package/2006/relationships"
+	xlsxDocNS  = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+)
+
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="` + xlsxRelsNS + `"><Relationship Id="rId1" Type="` + xlsxDocNS + `/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="` + xlsxRelsNS + `"><Relationship Id="rId1" Type="` + xlsxDocNS + `/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+// writeXLSX writes a workbook with one sheet. Text is stored inline, so the
+// workbook needs no shared string table, and numbers and booleans keep their
+// type.
+func writeXLSX(w io.Writer, sheet string, columns []string, rows []map[string]interface{}) error {
+	archive := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		file, err := archive.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(file, part.content); err != nil {
+			return err
+		}
+	}
+
+	if len(sheet) > 31 {
+		sheet = sheet[:31]
+	}
+	file, err := archive.Create("xl/workbook.xml")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(file, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="%s" xmlns:r="%s"><sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+		xlsxMainNS, xlsxDocNS, cellText(sheet))
+
+	file, err = archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	buffer.WriteString(`<worksheet xmlns="` + xlsxMainNS + `"><sheetData>`)
+	writeRow := func(number int, values []interface{}) error {
+		fmt.Fprintf(&buffer, `<row r="%d">`, number)
+		for i, value := range values {
+			ref := columnLetters(i) + strconv.Itoa(number)
+			switch v := value.(type) {
+			case nil:
+				continue
+			case jsoniter.Number:
+				fmt.Fprintf(&buffer, `<c r="%s"><v>%s</v></c>`, ref, v)
+			case bool:
+				flag := 0
+				if v {
+					flag = 1
+				}
+				fmt.Fprintf(&buffer, `<c r="%s" t="b"><v>%d</v></c>`, ref, flag)
+			default:
+				fmt.Fprintf(&buffer, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, cellText(fmt.Sprint(v)))
+			}
+		}
+		buffer.WriteString(`</row>`)
+		if buffer.Len() < 1<<16 {
+			return nil
+		}
+		_, err := buffer.WriteTo(file)
+		return err
+	}
+
+	header := make([]interface{}, len(columns))
+	for i, column := range columns {
+		header[i] = column
+	}
+	if err = writeRow(1, header); err != nil {
+		return err
+	}
+	values := make([]interface{}, len(columns))
+	for i, row := range rows {
+		for j, column := range columns {
+			values[j] = row[column]
+		}
+		if err = writeRow(i+2, values); err != nil {
+			return err
+		}
+	}
+	buffer.WriteString(`</sheetData></worksheet>`)
+	if _, err = buffer.WriteTo(file); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// cellText escapes text for a sheet, replacing characters XML cannot carry.
+func cellText(s string) string {
+	var escaped strings.Builder
+	_ = xml.EscapeText(&escaped, []byte(s))
+	return escaped.String()
+}
+
+// readSpreadsheet reads the rows of an uploaded CSV file or of the first
+// sheet of an XLSX workbook, telling them apart by content.
+func readSpreadsheet(data []byte) ([][]string, error) {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		return readXLSX(data)
+	}
+	return readCSV(data)
+}
+
+// readCSV accepts comma, semicolon and tab separated files, guessing the
+// separator from the header line.
+func readCSV(data []byte) ([][]string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	header, _, _ := bytes.Cut(data, []byte("\n"))
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	for _, separator := range []rune{';', '\t'} {
+		if bytes.Count(header, []byte(string(separator))) > bytes.Count(header, []byte(string(reader.Comma))) {
+			reader.Comma = separator
+		}
+	}
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, withStatus(http.StatusBadRequest, fmt.Errorf("the file is not valid CSV: %w", err))
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if len(cell) > 1 && cell[0] == '\'' && strings.ContainsRune(csvFormulaPrefixes, rune(cell[1])) {
+				row[i] = cell[1:]
+			}
+		}
+	}
+	return rows, nil
+}
+
+type xlsxRels struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		ID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (x xlsxText) String() string {
+	text := x.T
+	for _, run := range x.Runs {
+		text += run.T
+	}
+	return text
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			R  string   `xml:"r,attr"`
+			T  string   `xml:"t,attr"`
+			V  string   `xml:"v"`
+			Is xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// readXLSX reads the first sheet of a workbook. Cells hold what they show
+// as text; dates stay serial numbers, which the imports convert.
+func readXLSX(data []byte) ([][]string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, withStatus(http.StatusBadRequest, fmt.Errorf("the file is not a valid XLSX workbook: %w", err))
+	}
+	parts := map[string]*zip.File{}
+	for _, file := range archive.File {
+		parts[file.Name] = file
+	}
+	readPart := func(name string, into interface{}) (bool, error) {
+		file, ok := parts[name]
+		if !ok {
+			return false, nil
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return true, err
+		}
+		defer reader.Close()
+		content, err := io.ReadAll(io.LimitReader(reader, maxSheetXMLBytes+1))
+		if err != nil {
+			return true, err
+		}
+		if len(content) > maxSheetXMLBytes {
+			return true, withStatus(http.StatusRequestEntityTooLarge, fmt.Errorf("%s of the workbook is too large", name))
+		}
+		if err = xml.Unmarshal(content, into); err != nil {
+			return true, withStatus(http.StatusBadRequest, fmt.Errorf("%s of the workbook is not valid: %w", name, err))
+		}
+		return true, nil
+	}
+
+	sheetPath := "xl/worksheets/sheet1.xml"
+	var workbook xlsxWorkbook
+	var rels xlsxRels
+	if _, err = readPart("xl/workbook.xml", &workbook); err != nil {
+		return nil, err
+	}
+	if _, err = readPart("xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	if len(workbook.Sheets) > 0 {
+		for _, rel := range rels.Relationships {
+			if rel.ID != workbook.Sheets[0].ID {
+				continue
+			}
+			if strings.HasPrefix(rel.Target, "/") {
+				sheetPath = strings.TrimPrefix(rel.Target, "/")
+			} else {
+				sheetPath = path.Join("xl", rel.Target)
+			}
+		}
+	}
+
+	var shared struct {
+		Items []xlsxText `xml:"si"`
+	}
+	if _, err = readPart("xl/sharedStrings.xml", &shared); err != nil {
+		return nil, err
+	}
+	var sheet xlsxSheet
+	found, err := readPart(sheetPath, &sheet)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, withStatus(http.StatusBadRequest, errors.New("the workbook has no sheet"))
+	}
+
+	var rows [][]string
+	for _, row := range sheet.Rows {
+		number := row.R
+		if number <= len(rows) {
+			number = len(rows) + 1
+		}
+		for len(rows) < number-1 {
+			rows = append(rows, nil)
+		}
+		var cells []string
+		for _, cell := range row.Cells {
+			column := len(cells)
+			if cell.R != "" {
+				column = columnIndex(cell.R)
+			}
+			if column < 0 || column >= 16384 {
+				continue
+			}
+			var value string
+			switch cell.T {
+			case "s":
+				index, err := strconv.Atoi(cell.V)
+				if err != nil || index < 0 || index >= len(shared.Items) {
+					return nil, withStatus(http.StatusBadRequest, fmt.Errorf("cell %s refers to a missing shared string", cell.R))
+				}
+				value = shared.Items[index].String()
+			case "inlineStr":
+				value = cell.Is.String()
+			case "b":
+				value = strconv.FormatBool(cell.V == "1")
+			default:
+				value = cell.V
+			}
+			for len(cells) <= column {
+				cells = append(cells, "")
+			}
+			cells[column] = value
+		}
+		rows = append(rows, cells)
+	}
+	return rows, nil
+}
+
+// spreadsheetExports answers GET requests for spreadsheets by converting
+// the JSON answer once the handler is done. Every read is negotiated on
+// Accept, so caches are told to key JSON answers on it as well.
+func spreadsheetExports(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			w.Header().Add("Vary", "Accept")
+		}
+		format := exportFormat(r)
+		if r.Method != http.MethodGet || format == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buffered := &bufferedResponse{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(buffered, r)
+		if buffered.status != http.StatusOK {
+			w.WriteHeader(buffered.status)
+			_, _ = w.Write(buffered.body.Bytes())
+			return
+		}
+
+		columns, rows, err := tabulate(buffered.body.Bytes())
+		if err != nil {
+			responseWithMsg(w, http.StatusNotAcceptable, fmt.Sprintf("%s cannot be exported as %s: %s", r.URL.Path, format, err.Error()))
+			return
+		}
+
+		name := strings.ReplaceAll(strings.Trim(r.URL.Path, "/"), "/", "-")
+		var out bytes.Buffer
+		if format == "xlsx" {
+			err = writeXLSX(&out, name, columns, rows)
+			w.Header().Set("Content-Type", xlsxContentType)
+		} else {
+			err = writeCSV(&out, columns, rows)
+			w.Header().Set("Content-Type", csvContentType+"; charset=utf-8")
+		}
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, format))
+		w.WriteHeader(http.StatusOK)
+		_, _ = out.WriteTo(w)
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const exportBody = `{"message":"equipment read","data":[
+	{"id":1,"name":"=HYPERLINK(\"x\")","company":{"name":"Acme","address":{"city":"Berlin"}},"tags":["a","b"],"active":true,"notes":null},
+	{"id":2,"name":"Lathe","cost":-5,"note":"+49 30 1234","extra":"@home"}
+]}`
+
+func TestTabulate(t *testing.T) {
+	columns, rows, err := tabulate([]byte(exportBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"id", "name", "company.name", "company.address.city", "tags", "active", "notes", "cost", "note", "extra"}
+	if !reflect.DeepEqual(columns, want) {
+		t.Errorf("columns = %v, want %v", columns, want)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("%d rows, want 2", len(rows))
+	}
+	if got := rows[0]["company.address.city"]; got != "Berlin" {
+		t.Errorf("company.address.city = %v, want Berlin", got)
+	}
+	if got := rows[0]["tags"]; got != `["a","b"]` {
+		t.Errorf("tags = %v, want the list as JSON", got)
+	}
+	if _, _, err = tabulate([]byte(`{"data":[1,2]}`)); err == nil {
+		t.Error("a list of numbers was tabulated")
+	}
+}
+
+// spreadsheetRows is what reading back an export should give: the header and
+// each row as the text of its cells.
+var spreadsheetRows = [][]string{
+	{"id", "name", "company.name", "company.address.city", "tags", "active", "notes", "cost", "note", "extra"},
+	{"1", `=HYPERLINK("x")`, "Acme", "Berlin", `["a","b"]`, "true", "", "", "", ""},
+	{"2", "Lathe", "", "", "", "", "", "-5", "+49 30 1234", "@home"},
+}
+
+// padRows fills short rows with empty cells, as readers leave out the empty
+// cells at the end of a row.
+func padRows(rows [][]string, width int) [][]string {
+	for i := range rows {
+		for len(rows[i]) < width {
+			rows[i] = append(rows[i], "")
+		}
+	}
+	return rows
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	columns, rows, err := tabulate([]byte(exportBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = writeCSV(&out, columns, rows); err != nil {
+		t.Fatal(err)
+	}
+
+	written := out.String()
+	for _, quoted := range []string{`"'=HYPERLINK(""x"")"`, "'+49 30 1234", "'@home"} {
+		if !strings.Contains(written, quoted) {
+			t.Errorf("the CSV does not hold %s, formulas must be written behind a quote:\n%s", quoted, written)
+		}
+	}
+	if strings.Contains(written, "'-5") {
+		t.Errorf("a negative number was quoted:\n%s", written)
+	}
+
+	read, err := readSpreadsheet(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := padRows(read, len(columns)); !reflect.DeepEqual(got, spreadsheetRows) {
+		t.Errorf("read back\n%q\nwant\n%q", got, spreadsheetRows)
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want [][]string
+	}{
+		{"commas", "name,company_id\nLathe,3\n", [][]string{{"name", "company_id"}, {"Lathe", "3"}}},
+		{"semicolons behind a byte order mark", "\xef\xbb\xbfname;company_id\nLathe, big;3\n", [][]string{{"name", "company_id"}, {"Lathe, big", "3"}}},
+		{"tabs", "name\tcompany_id\nLathe\t3\n", [][]string{{"name", "company_id"}, {"Lathe", "3"}}},
+		{"a quote that guards no formula stays", "name\n'quoted\n'=1+1\n", [][]string{{"name"}, {"'quoted"}, {"=1+1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readCSV([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readCSV = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestXLSXRoundTrip(t *testing.T) {
+	columns, rows, err := tabulate([]byte(exportBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = writeXLSX(&out, "equipment", columns, rows); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := readSpreadsheet(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := padRows(read, len(columns)); !reflect.DeepEqual(got, spreadsheetRows) {
+		t.Errorf("read back\n%q\nwant\n%q", got, spreadsheetRows)
+	}
+}
+
+func xlsxSheetName(t *testing.T, workbook []byte) string {
+	archive, err := zip.NewReader(bytes.NewReader(workbook), int64(len(workbook)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range archive.File {
+		if file.Name != "xl/workbook.xml" {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parsed struct {
+			Sheets []struct {
+				Name string `xml:"name,attr"`
+			} `xml:"sheets>sheet"`
+		}
+		if err = xml.Unmarshal(content, &parsed); err != nil {
+			t.Fatal(err)
+		}
+		if len(parsed.Sheets) != 1 {
+			t.Fatalf("the workbook has %d sheets, want 1", len(parsed.Sheets))
+		}
+		return parsed.Sheets[0].Name
+	}
+	t.Fatal("the workbook has no xl/workbook.xml")
+	return ""
+}
+
+func TestXLSXSheetName(t *testing.T) {
+	tests := []struct {
+		sheet string
+		want  string
+	}{
+		{"equipment", "equipment"},
+		{"maintenance-history-123-time-entries", "maintenance-history-123-time-en"},
+		{"a<b&c", "a<b&c"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := writeXLSX(&out, tt.sheet, []string{"id"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		got := xlsxSheetName(t, out.Bytes())
+		if got != tt.want {
+			t.Errorf("sheet %q is named %q, want %q", tt.sheet, got, tt.want)
+		}
+		if len(got) > 31 {
+			t.Errorf("sheet name %q is longer than 31 characters", got)
+		}
+	}
+}
+
+func TestColumnLetters(t *testing.T) {
+	for i, want := range map[int]string{0: "A", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA", 16383: "XFD"} {
+		if got := columnLetters(i); got != want {
+			t.Errorf("columnLetters(%d) = %s, want %s", i, got, want)
+		}
+		if got := columnIndex(want + "12"); got != i {
+			t.Errorf("columnIndex(%s12) = %d, want %d", want, got, i)
+		}
+	}
+}
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TimeEntry is a stretch of work a technician spends on a maintenance record.
+// Entries are started and stopped as the work happens, can be paused in
+// between, and can also be recorded afterwards with both ends given. The
+// user's hourly rate is frozen on the entry when it is created.
+type TimeEntry struct {
+	gorm.Model
+	MaintenanceHistoryID uint                `gorm:"type:int(10);index;not null" validate:"required"`
+	MaintenanceHistory   *MaintenanceHistory `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	UserID               uint                `gorm:"type:int(10);index;not null" validate:"required"`
+	User                 *User               `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	StartedAt            time.Time           `gorm:"not null;index" validate:"required"`
+	EndedAt              *time.Time          `gorm:"index;default:NULL"`
+	PausedAt             *time.Time          `gorm:"default:NULL"`
+	PausedSeconds        int                 `gorm:"type:int(10);not null;default:0" validate:"gte=0"`
+	WorkedSeconds        int                 `gorm:"type:int(10);not null;default:0"`
+	HourlyRate           float64             `gorm:"type:decimal(10,2);not null;default:0" validate:"gte=0"`
+	Note                 string              `gorm:"type:varchar(500)" validate:"max=500"`
+	Timezone             string              `gorm:"-"`
+}
+
+type LabourTotal struct {
+	UserID uint    `json:"user_id"`
+	Hours  float64 `json:"hours"`
+	Cost   float64 `json:"cost"`
+}
+
+type LabourSummary struct {
+	MaintenanceHistoryID uint          `json:"maintenance_history_id"`
+	TotalHours           float64       `json:"total_hours"`
+	TotalCost            float64       `json:"total_cost"`
+	Running              int           `json:"running"`
+	Technicians          []LabourTotal `json:"technicians"`
+	Entries              []TimeEntry   `json:"entries"`
+}
+
+type TimesheetDay struct {
+	Date    string      `json:"date"`
+	Hours   float64     `json:"hours"`
+	Entries []TimeEntry `json:"entries"`
+}
+
+type TimesheetRecord struct {
+	MaintenanceHistoryID uint    `json:"maintenance_history_id"`
+	EquipmentID          uint    `json:"equipment_id"`
+	Hours                float64 `json:"hours"`
+}
+
+type Timesheet struct {
+	UserID     uint              `json:"user_id"`
+	Timezone   string            `json:"timezone"`
+	WeekStart  string            `json:"week_start"`
+	TotalHours float64           `json:"total_hours"`
+	Days       []TimesheetDay    `json:"days"`
+	Records    []TimesheetRecord `json:"records"`
+}
+
+func (c *TimeEntry) Decode(data []byte) (TimeEntry, error) {
+	err := decodeJSON(data, &c)
+	if err != nil {
+		return TimeEntry{}, err
+	}
+	return *c, nil
+}
+
+func (c *TimeEntry) Encode() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+func (c *TimeEntry) localize(loc *time.Location) {
+	c.StartedAt = c.StartedAt.In(loc)
+	if c.EndedAt != nil {
+		t := c.EndedAt.In(loc)
+		c.EndedAt = &t
+	}
+	if c.PausedAt != nil {
+		t := c.PausedAt.In(loc)
+		c.PausedAt = &t
+	}
+	c.Timezone = loc.String()
+}
+
+// worked is the time spent on the entry up to now, pauses left out. Entries
+// still running count up to now.
+func (c *TimeEntry) worked(now time.Time) time.Duration {
+	end := now
+	if c.EndedAt != nil {
+		end = *c.EndedAt
+	}
+	paused := time.Duration(c.PausedSeconds) * time.Second
+	if c.PausedAt != nil {
+		paused += end.Sub(*c.PausedAt)
+	}
+	if d := end.Sub(c.StartedAt) - paused; d > 0 {
+		return d
+	}
+	return 0
+}
+
+func hours(d time.Duration) float64 {
+	return math.Round(d.Hours()*100) / 100
+}
+
+// entryOverlaps looks for another entry of the same user overlapping the
+// given span, so no one is booked on two records at once.
+func entryOverlaps(tx *gorm.DB, entry TimeEntry, end time.Time) (*TimeEntry, error) {
+	var other TimeEntry
+	result := tx.Where("user_id = ? AND id <> ? AND started_at < ?", entry.UserID, entry.ID, end).
+		Where("ended_at IS NULL OR ended_at > ?", entry.StartedAt).
+		Limit(1).
+		Find(&other)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+	return &other, nil
+}
+
+// checkTimeEntry validates a recorded entry: both ends given, pauses fitting
+// in between and no overlap with the user's other entries.
+func checkTimeEntry(tx *gorm.DB, entry *TimeEntry) error {
+	if entry.EndedAt == nil || !entry.EndedAt.After(entry.StartedAt) {
+		return withStatus(http.StatusBadRequest, errors.New("ended_at must be after started_at"))
+	}
+	if entry.PausedAt != nil {
+		return withStatus(http.StatusBadRequest, errors.New("recorded entries cannot be paused"))
+	}
+	if time.Duration(entry.PausedSeconds)*time.Second > entry.EndedAt.Sub(entry.StartedAt) {
+		return withStatus(http.StatusBadRequest, errors.New("paused_seconds exceeds the length of the entry"))
+	}
+	other, err := entryOverlaps(tx, *entry, *entry.EndedAt)
+	if err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+	if other != nil {
+		return withStatus(http.StatusConflict, fmt.Errorf("user %d already has time entry %d at %s", entry.UserID, other.ID, other.StartedAt.Format(time.RFC3339)))
+	}
+	entry.WorkedSeconds = int(entry.worked(*entry.EndedAt) / time.Second)
+	return nil
+}
+
+// createTimeEntry stores a recorded entry and adds its labour to the
+// maintenance cost.
+func createTimeEntry(tx *gorm.DB, entry *TimeEntry) error {
+	if err := maintenanceHistoryAcceptsWork(tx, entry.MaintenanceHistoryID); err != nil {
+		return err
+	}
+	if err := checkTimeEntry(tx, entry); err != nil {
+		return err
+	}
+	if err := priceTimeEntry(entry); err != nil {
+		return err
+	}
+	if result := tx.Create(entry); result.Error != nil {
+		return result.Error
+	}
+	return recalculateMaintenanceCost(tx, entry.MaintenanceHistoryID)
+}
+
+// saveTimeEntry stores a corrected entry and updates the cost of the
+// maintenance it left and joined.
+func saveTimeEntry(tx *gorm.DB, entry *TimeEntry, previousHistoryID uint) error {
+	if err := checkTimeEntry(tx, entry); err != nil {
+		return err
+	}
+	if result := tx.Save(entry); result.Error != nil {
+		return result.Error
+	}
+	if previousHistoryID != entry.MaintenanceHistoryID {
+		if err := recalculateMaintenanceCost(tx, previousHistoryID); err != nil {
+			return err
+		}
+	}
+	return recalculateMaintenanceCost(tx, entry.MaintenanceHistoryID)
+}
+
+func priceTimeEntry(entry *TimeEntry) error {
+	if entry.HourlyRate != 0 {
+		return nil
+	}
+	var user User
+	if result := db.Select("id", "hourly_rate").First(&user, entry.UserID); result.Error != nil {
+		return result.Error
+	}
+	entry.HourlyRate = user.HourlyRate
+	return nil
+}
+
+func timeEntryZone(zones *zoneResolver, historyID uint) *time.Location {
+	var history MaintenanceHistory
+	if db.Select("id", "equipment_id").First(&history, historyID).Error != nil {
+		return time.UTC
+	}
+	return zones.forEquipment(history.EquipmentID)
+}
+
+func respondWithTimeEntry(w http.ResponseWriter, r *http.Request, data TimeEntry, msg string) {
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		zones = newZones()
+	}
+	data.localize(timeEntryZone(zones, data.MaintenanceHistoryID))
+	responseWithJSON(w, http.StatusOK, data, msg)
+}
+
+func timeEntryStartHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var history MaintenanceHistory
+	result := db.Select("id", "equipment_id").First(&history, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	body, err := Reader(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	var data TimeEntry
+	if data, err = data.Decode(body); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	data.ID, data.MaintenanceHistoryID = 0, history.ID
+	data.StartedAt = time.Now()
+	data.EndedAt, data.PausedAt, data.PausedSeconds, data.WorkedSeconds = nil, nil, 0, 0
+
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
+		return
+	}
+
+	if err = equipmentAcceptsWork(db, history.EquipmentID); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	// The user's lock keeps two starts on different maintenance from both
+	// finding the user clocked off.
+	err = withRecordLock(UsersTable, strconv.FormatUint(uint64(data.UserID), 10), func() error {
+		var running TimeEntry
+		result := db.Where("user_id = ? AND ended_at IS NULL", data.UserID).Limit(1).Find(&running)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			return withStatus(http.StatusConflict, fmt.Errorf("user %d is still clocked on time entry %d", data.UserID, running.ID))
+		}
+		if err := priceTimeEntry(&data); err != nil {
+			return err
+		}
+		return db.Create(&data).Error
+	})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	entryID := strconv.FormatUint(uint64(data.ID), 10)
+	recordChildAudit(r, TimeEntriesTable, entryID, "start", nil, auditSnapshot(db, TimeEntriesTable, entryID))
+
+	respondWithTimeEntry(w, r, data, fmt.Sprintf("user %d started work on maintenance history %s", data.UserID, id))
+	return
+}
+
+// timeEntryTransition pauses, resumes or stops a running entry.
+func timeEntryTransition(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r, "id")
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+		var data TimeEntry
+		result := db.First(&data, id)
+		if result.Error != nil {
+			responseWithError(w, r, result.Error)
+			return
+		}
+		if data.EndedAt != nil {
+			responseWithMsg(w, http.StatusConflict, fmt.Sprintf("time entry %s is already stopped", id))
+			return
+		}
+
+		now := time.Now()
+		switch action {
+		case "pause":
+			if data.PausedAt != nil {
+				responseWithMsg(w, http.StatusConflict, fmt.Sprintf("time entry %s is already paused", id))
+				return
+			}
+			data.PausedAt = &now
+		case "resume":
+			if data.PausedAt == nil {
+				responseWithMsg(w, http.StatusConflict, fmt.Sprintf("time entry %s is not paused", id))
+				return
+			}
+			data.PausedSeconds += int(now.Sub(*data.PausedAt) / time.Second)
+			data.PausedAt = nil
+		case "stop":
+			if data.PausedAt != nil {
+				data.PausedSeconds += int(now.Sub(*data.PausedAt) / time.Second)
+				data.PausedAt = nil
+			}
+			data.EndedAt = &now
+			data.WorkedSeconds = int(data.worked(now) / time.Second)
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if result := tx.Save(&data); result.Error != nil {
+				return result.Error
+			}
+			if action != "stop" {
+				return nil
+			}
+			return recalculateMaintenanceCost(tx, data.MaintenanceHistoryID)
+		})
+		if err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+
+		respondWithTimeEntry(w, r, data, fmt.Sprintf("time entry %s %s", id, map[string]string{"pause": "paused", "resume": "resumed", "stop": "stopped"}[action]))
+		return
+	}
+}
+
+func timeEntryCreateHandler(w http.ResponseWriter, r *http.Request) {
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	body, err := Reader(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	var peek struct{ MaintenanceHistoryID uint }
+	_ = json.Unmarshal(body, &peek)
+	var history MaintenanceHistory
+	db.Select("id", "equipment_id").First(&history, peek.MaintenanceHistoryID)
+	body, err = localizeBody(body, zones.ownerOf(history.EquipmentID), "started_at", "ended_at")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	var c TimeEntry
+	data, err := c.Decode(body)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	data.ID = 0
+
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return createTimeEntry(tx, &data)
+	})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	data.localize(zones.forEquipment(history.EquipmentID))
+	responseWithJSON(w, http.StatusOK, data, "time entry created")
+	return
+}
+
+func timeEntryReadHandler(w http.ResponseWriter, r *http.Request) {
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	var data []TimeEntry
+	query, err := includeQuery(r, &TimeEntry{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	query = query.Order("started_at")
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		query = query.Where("user_id = ?", v)
+	}
+	if v := r.URL.Query().Get("maintenance_history_id"); v != "" {
+		query = query.Where("maintenance_history_id = ?", v)
+	}
+	if r.URL.Query().Get("running") == "true" {
+		query = query.Where("ended_at IS NULL")
+	}
+	result := query.Find(&data)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	for i := range data {
+		data[i].localize(timeEntryZone(zones, data[i].MaintenanceHistoryID))
+	}
+	responseWithJSON(w, http.StatusOK, data, "time entries read")
+	return
+}
+
+func timeEntryReadOneHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var data TimeEntry
+	query, err := includeQuery(r, &TimeEntry{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	respondWithTimeEntry(w, r, data, "time entry read")
+	return
+}
+
+// timeEntryUpdateHandler corrects a stopped entry. Running entries change
+// only through pause, resume and stop.
+func timeEntryUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var data TimeEntry
+	result := db.First(&data, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	if data.EndedAt == nil {
+		responseWithMsg(w, http.StatusConflict, fmt.Sprintf("time entry %s is still running, stop it first", id))
+		return
+	}
+	entryID, previousHistoryID := data.ID, data.MaintenanceHistoryID
+
+	body, err := Reader(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	body, err = localizeBody(body, timeEntryZone(newZones(), data.MaintenanceHistoryID), "started_at", "ended_at")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	data, err = data.Decode(body)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	// A body id would otherwise save this data over another entry.
+	data.ID = entryID
+
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return saveTimeEntry(tx, &data, previousHistoryID)
+	})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	data.localize(timeEntryZone(zones, data.MaintenanceHistoryID))
+	responseWithJSON(w, http.StatusOK, data, "time entry updated")
+	return
+}
+
+func timeEntryDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if err = trashRecord(db, TimeEntriesTable, id); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	responseWithMsg(w, http.StatusOK, "time entry deleted")
+	return
+}
+
+// maintenanceLabourHandler totals the time logged on a maintenance record,
+// per technician and overall. Running entries are listed and counted up to
+// now but only stopped ones are costed.
+func maintenanceLabourHandler(w http.ResponseWriter, r *http.Request) {
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var history MaintenanceHistory
+	result := db.First(&history, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	data := LabourSummary{MaintenanceHistoryID: history.ID, Technicians: []LabourTotal{}, Entries: []TimeEntry{}}
+	if result = db.Where("maintenance_history_id = ?", history.ID).Order("started_at").Find(&data.Entries); result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	now := time.Now()
+	loc := zones.forEquipment(history.EquipmentID)
+	byUser := map[uint]int{}
+	var total time.Duration
+	for i, e := range data.Entries {
+		worked := e.worked(now)
+		rate := e.HourlyRate
+		if rate == 0 {
+			rate = history.LabourRate
+		}
+		cost := 0.0
+		if e.EndedAt == nil {
+			data.Running++
+		} else {
+			cost = worked.Hours() * rate
+		}
+
+		n, ok := byUser[e.UserID]
+		if !ok {
+			n = len(data.Technicians)
+			byUser[e.UserID] = n
+			data.Technicians = append(data.Technicians, LabourTotal{UserID: e.UserID})
+		}
+		data.Technicians[n].Hours += worked.Hours()
+		data.Technicians[n].Cost += cost
+		data.TotalCost += cost
+		total += worked
+		data.Entries[i].localize(loc)
+	}
+	for i := range data.Technicians {
+		data.Technicians[i].Hours = math.Round(data.Technicians[i].Hours*100) / 100
+		data.Technicians[i].Cost = math.Round(data.Technicians[i].Cost*100) / 100
+	}
+	data.TotalHours = hours(total)
+	data.TotalCost = math.Round(data.TotalCost*100) / 100
+
+	responseWithJSON(w, http.StatusOK, data, fmt.Sprintf("labour on maintenance history %s read", id))
+	return
+}
+
+// weekStart returns midnight of the Monday of the week holding day in loc.
+func weekStart(day time.Time, loc *time.Location) time.Time {
+	day = day.In(loc)
+	offset := (int(day.Weekday()) + 6) % 7
+	return time.Date(day.Year(), day.Month(), day.Day()-offset, 0, 0, 0, 0, loc)
+}
+
+// userTimesheetHandler lays out a user's time entries for one week, Monday to
+// Sunday in the user's zone. Entries count on the day they started. Pass any
+// day of the wanted week as ?week=, the current week is the default.
+func userTimesheetHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var user User
+	result := db.First(&user, id)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	zones, err := newZoneResolver(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	loc := zones.forUser(user)
+	if zones.override != nil {
+		loc = zones.override
+	}
+
+	day := time.Now()
+	if v := r.URL.Query().Get("week"); v != "" {
+		if day, err = time.ParseInLocation("2006-01-02", v, loc); err != nil {
+			responseWithMsg(w, http.StatusBadRequest, "week must be a date like 2006-01-02")
+			return
+		}
+	}
+	from := weekStart(day, loc)
+	to := from.AddDate(0, 0, 7)
+
+	var entries []TimeEntry
+	result = db.Where("user_id = ? AND started_at >= ? AND started_at < ?", user.ID, from, to).Order("started_at").Find(&entries)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	data := Timesheet{UserID: user.ID, Timezone: loc.String(), WeekStart: from.Format("2006-01-02"), Records: []TimesheetRecord{}}
+	for d := 0; d < 7; d++ {
+		data.Days = append(data.Days, TimesheetDay{Date: from.AddDate(0, 0, d).Format("2006-01-02"), Entries: []TimeEntry{}})
+	}
+
+	now := time.Now()
+	byRecord := map[uint]int{}
+	dayTotals := make([]time.Duration, 7)
+	recordTotals := map[uint]time.Duration{}
+	var total time.Duration
+	for _, e := range entries {
+		worked := e.worked(now)
+		e.localize(loc)
+		d := 6
+		for d > 0 && e.StartedAt.Before(from.AddDate(0, 0, d)) {
+			d--
+		}
+		data.Days[d].Entries = append(data.Days[d].Entries, e)
+		dayTotals[d] += worked
+		total += worked
+
+		if _, ok := byRecord[e.MaintenanceHistoryID]; !ok {
+			var history MaintenanceHistory
+			db.Select("id", "equipment_id").First(&history, e.MaintenanceHistoryID)
+			byRecord[e.MaintenanceHistoryID] = len(data.Records)
+			data.Records = append(data.Records, TimesheetRecord{MaintenanceHistoryID: e.MaintenanceHistoryID, EquipmentID: history.EquipmentID})
+		}
+		recordTotals[e.MaintenanceHistoryID] += worked
+	}
+	for d := range data.Days {
+		data.Days[d].Hours = hours(dayTotals[d])
+	}
+	for i, rec := range data.Records {
+		data.Records[i].Hours = hours(recordTotals[rec.MaintenanceHistoryID])
+	}
+	data.TotalHours = hours(total)
+
+	responseWithJSON(w, http.StatusOK, data, fmt.Sprintf("timesheet of user %s for the week of %s read", id, data.WeekStart))
+	return
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deleting a record moves it to the trash: deleted_at is set on it and, with
+// the same timestamp, on every record depending on it through an ON DELETE
+// CASCADE foreign key, so nothing live is left pointing at a deleted parent
+// and the group can be restored together. Trashed records are only removed
+// for good when an administrator purges them or when the retention job finds
+// them older than TRASH_RETENTION_DAYS.
+
+// trashLink is a cascading foreign key, seen from either end.
+type trashLink struct {
+	table Tables
+	field *schema.Field // the foreign key column on the dependant
+}
+
+var (
+	trashLinksOnce  sync.Once
+	trashLinksErr   error
+	trashDependants map[Tables][]trashLink
+	trashParents    map[Tables][]trashLink
+)
+
+func allTables() []Tables {
+	var tables []Tables
+	for t := Tables(0); t.Struct() != nil; t++ {
+		tables = append(tables, t)
+	}
+	return tables
+}
+
+// tableNamed finds a table by name, also accepting the hyphenated form used
+// in routes, e.g. maintenance-history.
+func tableNamed(name string) (Tables, bool) {
+	name = strings.ReplaceAll(name, "-", "_")
+	for _, t := range allTables() {
+		if t.String() == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+func softDeletable(t Tables) bool {
+	return reflect.ValueOf(t.Struct()).Elem().FieldByName("DeletedAt").IsValid()
+}
+
+func tableOf(s *schema.Schema) (Tables, bool) {
+	for _, t := range allTables() {
+		if reflect.TypeOf(t.Struct()).Elem() == s.ModelType {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+func loadTrashLinks() error {
+	trashLinksOnce.Do(func() {
+		trashDependants = map[Tables][]trashLink{}
+		trashParents = map[Tables][]trashLink{}
+		for _, child := range allTables() {
+			s, err := modelSchema(child.Struct())
+			if err != nil {
+				trashLinksErr = err
+				return
+			}
+			for _, relation := range s.Relationships.BelongsTo {
+				settings := schema.ParseTagSetting(relation.Field.TagSettings["CONSTRAINT"], ",")
+				if settings["ONDELETE"] != "CASCADE" || len(relation.References) != 1 {
+					continue
+				}
+				parent, ok := tableOf(relation.FieldSchema)
+				if !ok {
+					continue
+				}
+				foreignKey := relation.References[0].ForeignKey
+				trashDependants[parent] = append(trashDependants[parent], trashLink{table: child, field: foreignKey})
+				trashParents[child] = append(trashParents[child], trashLink{table: parent, field: foreignKey})
+			}
+		}
+	})
+	return trashLinksErr
+}
+
+func recordID(record interface{}) uint {
+	return uint(reflect.ValueOf(record).Elem().FieldByName("ID").Uint())
+}
+
+func deletedAtOf(record interface{}) gorm.DeletedAt {
+	deletedAt, _ := reflect.ValueOf(record).Elem().FieldByName("DeletedAt").Interface().(gorm.DeletedAt)
+	return deletedAt
+}
+
+// dependantsOf loads the records of the link's table pointing at id.
+func dependantsOf(tx *gorm.DB, link trashLink, id uint) ([]interface{}, error) {
+	data := reflect.New(reflect.TypeOf(link.table.Slice()))
+	if result := tx.Where(map[string]interface{}{link.field.DBName: id}).Find(data.Interface()); result.Error != nil {
+		return nil, result.Error
+	}
+	records := make([]interface{}, data.Elem().Len())
+	for i := range records {
+		records[i] = data.Elem().Index(i).Addr().Interface()
+	}
+	return records, nil
+}
+
+// refreshAfterTrash keeps totals derived from a trashed or restored record in
+// step, as long as the record they belong to is itself live.
+func refreshAfterTrash(tx *gorm.DB, record interface{}) error {
+	var historyID uint
+	switch record := record.(type) {
+	case *MaintenancePartsUsage:
+		historyID = record.MaintenanceHistoryID
+	case *TimeEntry:
+		historyID = record.MaintenanceHistoryID
+	default:
+		return nil
+	}
+	var live int64
+	if result := tx.Model(&MaintenanceHistory{}).Where("id = ?", historyID).Count(&live); result.Error != nil {
+		return result.Error
+	}
+	if live == 0 {
+		return nil
+	}
+	return recalculateMaintenanceCost(tx, historyID)
+}
+
+// trashRecord moves a record and everything cascading from it to the trash.
+func trashRecord(tx *gorm.DB, t Tables, id string) error {
+	if err := loadTrashLinks(); err != nil {
+		return err
+	}
+	return tx.Transaction(func(tx *gorm.DB) error {
+		record := t.Struct()
+		if result := tx.First(record, id); result.Error != nil {
+			return result.Error
+		}
+		return trashCascade(tx, t, record, tx.Config.NowFunc())
+	})
+}
+
+func trashCascade(tx *gorm.DB, t Tables, record interface{}, at time.Time) error {
+	if result := tx.Model(record).UpdateColumn("deleted_at", at); result.Error != nil {
+		return result.Error
+	}
+	if err := refreshAfterTrash(tx, record); err != nil {
+		return err
+	}
+	for _, link := range trashDependants[t] {
+		dependants, err := dependantsOf(tx, link, recordID(record))
+		if err != nil {
+			return err
+		}
+		for _, dependant := range dependants {
+			if err := trashCascade(tx, link.table, dependant, at); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// trashedParent names a parent of the record that is still in the trash, or
+// returns an empty string when all of them are live.
+func trashedParent(tx *gorm.DB, t Tables, record interface{}) (string, error) {
+	for _, link := range trashParents[t] {
+		parentID, zero := link.field.ValueOf(tx.Statement.Context, reflect.ValueOf(record))
+		if zero {
+			continue
+		}
+		var trashed int64
+		result := tx.Unscoped().Model(link.table.Struct()).
+			Where("id = ? AND deleted_at IS NOT NULL", parentID).
+			Count(&trashed)
+		if result.Error != nil {
+			return "", result.Error
+		}
+		if trashed > 0 {
+			return fmt.Sprintf("%s %v", link.table, reflect.Indirect(reflect.ValueOf(parentID))), nil
+		}
+	}
+	return "", nil
+}
+
+// restoreRecord takes a record out of the trash. With dependants it also
+// restores the records that were trashed together with it.
+func restoreRecord(tx *gorm.DB, t Tables, id string, dependants bool) error {
+	if err := loadTrashLinks(); err != nil {
+		return err
+	}
+	return tx.Transaction(func(tx *gorm.DB) error {
+		record := t.Struct()
+		if result := tx.Unscoped().First(record, id); result.Error != nil {
+			return result.Error
+		}
+		if !deletedAtOf(record).Valid {
+			return withStatus(http.StatusConflict, fmt.Errorf("%s %s is not in the trash", t, id))
+		}
+		parent, err := trashedParent(tx, t, record)
+		if err != nil {
+			return err
+		}
+		if parent != "" {
+			return withStatus(http.StatusConflict, fmt.Errorf("%s is in the trash, restore it first", parent))
+		}
+		return restoreCascade(tx, t, record, dependants)
+	})
+}
+
+func restoreCascade(tx *gorm.DB, t Tables, record interface{}, dependants bool) error {
+	deletedAt := deletedAtOf(record).Time
+	// Update rather than UpdateColumn moves updated_at past the deletion, so
+	// calendar feeds announce a restored schedule with a higher sequence.
+	if result := tx.Unscoped().Model(record).Update("deleted_at", nil); result.Error != nil {
+		return result.Error
+	}
+	if err := refreshAfterTrash(tx, record); err != nil {
+		return err
+	}
+	if !dependants {
+		return nil
+	}
+	for _, link := range trashDependants[t] {
+		records, err := dependantsOf(tx.Unscoped().Where("deleted_at = ?", deletedAt), link, recordID(record))
+		if err != nil {
+			return err
+		}
+		for _, dependant := range records {
+			// Dependants held back by another trashed parent stay in the trash.
+			parent, err := trashedParent(tx, link.table, dependant)
+			if err != nil {
+				return err
+			}
+			if parent != "" {
+				continue
+			}
+			if err := restoreCascade(tx, link.table, dependant, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// purgeRecord deletes a trashed record for good together with the dependants
+// trashed with it and the files stored for any of them. The rows go in one
+// transaction and the files are only removed once it has committed, so a
+// failed purge leaves everything in place. A live dependant, added after the
+// record was trashed, is never deleted: the purge is refused with 409 instead.
+func purgeRecord(t Tables, id uint) error {
+	if err := loadTrashLinks(); err != nil {
+		return err
+	}
+	var keys []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return purgeCascade(tx, t, id, &keys)
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil {
+			log.Printf("purge: removing stored file %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func purgeCascade(tx *gorm.DB, t Tables, id uint, keys *[]string) error {
+	for _, link := range trashDependants[t] {
+		if softDeletable(link.table) {
+			var live int64
+			result := tx.Model(link.table.Struct()).
+				Where(map[string]interface{}{link.field.DBName: id}).
+				Count(&live)
+			if result.Error != nil {
+				return result.Error
+			}
+			if live > 0 {
+				return withStatus(http.StatusConflict, fmt.Errorf("%s %d still has %d live %s, delete them first", t, id, live, link.table))
+			}
+		}
+		var ids []uint
+		result := tx.Unscoped().Model(link.table.Struct()).
+			Where(map[string]interface{}{link.field.DBName: id}).
+			Pluck("id", &ids)
+		if result.Error != nil {
+			return result.Error
+		}
+		for _, dependantID := range ids {
+			if err := purgeCascade(tx, link.table, dependantID, keys); err != nil {
+				return err
+			}
+		}
+	}
+
+	var attachments []uint
+	result := tx.Unscoped().Model(&ImageAttachment{}).
+		Where("owner_type = ? AND owner_id = ?", t.String(), id).
+		Pluck("id", &attachments)
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, attachmentID := range attachments {
+		if err := purgeOwnedFiles(tx, ImageAttachmentsTable, attachmentID, keys); err != nil {
+			return err
+		}
+		if result := tx.Unscoped().Delete(&ImageAttachment{}, attachmentID); result.Error != nil {
+			return result.Error
+		}
+	}
+	if err := purgeOwnedFiles(tx, t, id, keys); err != nil {
+		return err
+	}
+	return tx.Unscoped().Delete(t.Struct(), id).Error
+}
+
+// purgeOwnedFiles deletes the file rows of an owner, thumbnails cascading
+// with them, and notes their storage keys for removal after the commit.
+func purgeOwnedFiles(tx *gorm.DB, owner Tables, ownerID uint, keys *[]string) error {
+	var files []StoredFile
+	result := tx.Unscoped().Where("owner_type = ? AND owner_id = ?", owner.String(), ownerID).Find(&files)
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, file := range files {
+		if result := tx.Unscoped().Delete(&file); result.Error != nil {
+			return result.Error
+		}
+		*keys = append(*keys, file.StorageKey)
+	}
+	return nil
+}
+
+// purgeExpiredTrash purges records that have been in the trash longer than
+// TRASH_RETENTION_DAYS (30 by default, 0 keeps them forever). Records that
+// gained live dependants since they were trashed are left for an
+// administrator to sort out.
+func purgeExpiredTrash() error {
+	days := envInt("TRASH_RETENTION_DAYS", 30)
+	if days <= 0 {
+		return nil
+	}
+	cutoff := time.Now().UTC().AddDate(0, 0, -days)
+
+	for _, t := range allTables() {
+		if !softDeletable(t) {
+			continue
+		}
+		var ids []uint
+		result := db.Unscoped().Model(t.Struct()).
+			Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).
+			Pluck("id", &ids)
+		if result.Error != nil {
+			return result.Error
+		}
+		for _, id := range ids {
+			err := purgeRecord(t, id)
+			var httpError *HTTPError
+			if errors.As(err, &httpError) && httpError.Status == http.StatusConflict {
+				log.Printf("trash retention: %v", err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// requireAdmin lets a request through only when it carries the ADMIN_TOKEN
+// in the X-Admin-Token header. Without a configured token nobody is let in.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			responseWithMsg(w, http.StatusForbidden, "administration is disabled, set ADMIN_TOKEN to enable it")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(token)) != 1 {
+			responseWithMsg(w, http.StatusForbidden, "a valid X-Admin-Token header is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trashTable resolves the {resource} path parameter, written like the
+// resource's own route, e.g. maintenance-history.
+func trashTable(r *http.Request) (Tables, error) {
+	t, ok := tableNamed(chi.URLParam(r, "resource"))
+	if ok && softDeletable(t) {
+		return t, nil
+	}
+	return 0, withStatus(http.StatusNotFound, fmt.Errorf("there is no resource named %s", chi.URLParam(r, "resource")))
+}
+
+func trashReadHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := trashTable(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	query, err := includeQuery(r, t.Struct())
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	data := reflect.New(reflect.TypeOf(t.Slice())).Interface()
+	result := query.Unscoped().Where("deleted_at IS NOT NULL").Order("deleted_at DESC").Find(data)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, data, fmt.Sprintf("trashed %s read", t))
+	return
+}
+
+func trashRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := trashTable(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	if err = restoreRecord(db, t, id, r.URL.Query().Get("dependants") == "true"); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	data := t.Struct()
+	if result := db.First(data, id); result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	responseWithJSON(w, http.StatusOK, data, fmt.Sprintf("%s %s restored", t, id))
+	return
+}
+
+func trashPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := trashTable(r)
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+
+	record := t.Struct()
+	if result := db.Unscoped().First(record, id); result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+	if !deletedAtOf(record).Valid {
+		responseWithMsg(w, http.StatusConflict, fmt.Sprintf("%s %s is not in the trash, delete it first", t, id))
+		return
+	}
+
+	if err = purgeRecord(t, recordID(record)); err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	responseWithMsg(w, http.StatusOK, fmt.Sprintf("%s %s purged", t, id))
+	return
+}
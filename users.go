@@ -1,27 +1,28 @@
 package main
 
 import (
-	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 	"net/http"
 )
 
 type User struct {
 	gorm.Model
-	CompanyID    uint    `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	Company      Company `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	RoleID       uint    `gorm:"type:int(10);index;not null" validate:"required,alphanum,len=10"`
-	Role         Role    `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	Username     string  `gorm:"type:varchar(50);unique;not null" validate:"required,max=50"`
-	PasswordHash string  `gorm:"type:varchar(255);not null" validate:"required,max=255,sha256"`
-	Email        string  `gorm:"type:varchar(255);unique;not null" validate:"required,max=255,email"`
-	FirstName    string  `gorm:"type:varchar(50)" validate:"max=50"`
-	LastName     string  `gorm:"type:varchar(50)" validate:"max=50"`
-	Phone        string  `gorm:"type:varchar(50);unique" validate:"max=50,e164"`
+	CompanyID    uint     `gorm:"type:int(10);index;not null" validate:"required"`
+	Company      *Company `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	RoleID       uint     `gorm:"type:int(10);index;not null" validate:"required"`
+	Role         *Role    `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	Username     string   `gorm:"type:varchar(50);unique;not null" validate:"required,max=50"`
+	PasswordHash string   `gorm:"type:varchar(255);not null" validate:"required,max=255,sha256" view:"writeonly"`
+	Email        string   `gorm:"type:varchar(255);unique;not null" validate:"required,max=255,email"`
+	FirstName    string   `gorm:"type:varchar(50)" validate:"max=50"`
+	LastName     string   `gorm:"type:varchar(50)" validate:"max=50"`
+	Phone        string   `gorm:"type:varchar(50);unique" validate:"max=50,e164"`
+	HourlyRate   float64  `gorm:"type:decimal(10,2);not null;default:0" validate:"gte=0"`
+	Timezone     string   `gorm:"type:varchar(64)" validate:"omitempty,timezone"`
 }
 
 func (c *User) Decode(data []byte) (User, error) {
-	err := json.Unmarshal(data, &c)
+	err := decodeJSON(data, &c)
 	if err != nil {
 		return User{}, err
 	}
@@ -35,26 +36,26 @@ func (c *User) Encode() ([]byte, error) {
 func userCreateHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	var c User
 	data, err := c.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result := db.Create(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -63,9 +64,14 @@ func userCreateHandler(w http.ResponseWriter, r *http.Request) {
 
 func userReadHandler(w http.ResponseWriter, r *http.Request) {
 	var data []User
-	result := db.Find(&data)
+	query, err := includeQuery(r, &User{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.Find(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -73,11 +79,20 @@ func userReadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func userReadOneHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data User
-	result := db.First(&data, id)
+	query, err := includeQuery(r, &User{})
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	result := query.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -85,35 +100,39 @@ func userReadOneHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func userUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
 	var data User
 	result := db.First(&data, id)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
 	body, err := Reader(r)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
 	data, err = data.Decode(body)
 	if err != nil {
-		responseWithMsg(w, http.StatusBadRequest, err.Error())
+		responseWithError(w, r, err)
 		return
 	}
 
-	validationError := Validate(data)
-	if validationError.Message != "" {
-		responseWithMsg(w, http.StatusBadRequest, validationError.Message)
+	validationErrors := Validate(data)
+	if len(validationErrors) > 0 {
+		responseWithValidationErrors(w, validationErrors)
 		return
 	}
 
 	result = db.Save(&data)
 	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+		responseWithError(w, r, result.Error)
 		return
 	}
 
@@ -121,11 +140,13 @@ func userUpdateHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func userDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	var data User
-	result := db.Delete(&data, id)
-	if result.Error != nil {
-		responseWithMsg(w, http.StatusBadRequest, result.Error.Error())
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	if err = trashRecord(db, UsersTable, id); err != nil {
+		responseWithError(w, r, err)
 		return
 	}
 
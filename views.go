@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"gorm.io/gorm/schema"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Resources are serialized with snake_case field names derived the same way
+// gorm derives column names, so CompanyID is company_id in JSON and in the
+// database alike. Fields with an explicit JSON name keep it. Fields tagged
+// view:"writeonly", like password hashes, are accepted in request bodies but
+// never written to responses.
+
+var fieldNaming = schema.NamingStrategy{}
+
+func apiFieldName(goName string) string {
+	return fieldNaming.ColumnName("", goName)
+}
+
+type apiViewExtension struct {
+	jsoniter.DummyExtension
+}
+
+func (e *apiViewExtension) UpdateStructDescriptor(structDescriptor *jsoniter.StructDescriptor) {
+	for _, binding := range structDescriptor.Fields {
+		name := binding.Field.Name()
+		if unicode.IsLower(rune(name[0])) || name[0] == '_' {
+			continue
+		}
+		tag, hasTag := binding.Field.Tag().Lookup("json")
+		explicit := false
+		if hasTag {
+			jsonName, _, _ := strings.Cut(tag, ",")
+			if jsonName == "-" {
+				continue
+			}
+			explicit = jsonName != ""
+		}
+		if !explicit {
+			binding.FromNames = []string{apiFieldName(name)}
+			binding.ToNames = []string{apiFieldName(name)}
+		}
+		if binding.Field.Tag().Get("view") == "writeonly" {
+			binding.ToNames = []string{}
+		}
+	}
+}
+
+func init() {
+	jsoniter.RegisterExtension(&apiViewExtension{})
+}
+
+// bufferedResponse holds a response back so it can be reshaped before it is
+// sent.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// sparseFields trims successful GET responses down to the fields listed in
+// ?fields=. Fields of included associations are picked with dots, e.g.
+// fields=id,name,equipment.name; naming an association keeps all of it.
+func sparseFields(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := r.URL.Query().Get("fields")
+		if r.Method != http.MethodGet || raw == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buffered := &bufferedResponse{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(buffered, r)
+
+		var envelope struct {
+			Message string      `json:"message"`
+			Code    int         `json:"code"`
+			Data    interface{} `json:"data"`
+		}
+		if buffered.status >= http.StatusBadRequest || json.Unmarshal(buffered.body.Bytes(), &envelope) != nil || envelope.Data == nil {
+			w.WriteHeader(buffered.status)
+			_, _ = w.Write(buffered.body.Bytes())
+			return
+		}
+
+		fields := map[string]bool{}
+		for _, field := range strings.Split(raw, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields[field] = true
+			}
+		}
+		if err := checkFields(envelope.Data, fields); err != nil {
+			responseWithError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(buffered.status)
+		_ = json.NewEncoder(w).Encode(Response{Message: envelope.Message, Code: envelope.Code, Data: pickFields(envelope.Data, fields, "")})
+	})
+}
+
+// checkFields refuses field names that none of the returned objects have.
+func checkFields(data interface{}, fields map[string]bool) error {
+	known := map[string]bool{}
+	collectFields(data, "", known)
+	if len(known) == 0 {
+		return nil
+	}
+	var unknown []string
+	for field := range fields {
+		if !known[field] {
+			unknown = append(unknown, field)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	available := make([]string, 0, len(known))
+	for field := range known {
+		available = append(available, field)
+	}
+	sort.Strings(available)
+	return &HTTPError{Status: http.StatusBadRequest, Field: "fields",
+		Err: fmt.Errorf("unknown fields %s, available are %s", strings.Join(unknown, ", "), strings.Join(available, ", "))}
+}
+
+func collectFields(data interface{}, prefix string, known map[string]bool) {
+	switch value := data.(type) {
+	case []interface{}:
+		for _, item := range value {
+			collectFields(item, prefix, known)
+		}
+	case map[string]interface{}:
+		for key, item := range value {
+			known[prefix+key] = true
+			collectFields(item, prefix+key+".", known)
+		}
+	}
+}
+
+func pickFields(data interface{}, fields map[string]bool, prefix string) interface{} {
+	switch value := data.(type) {
+	case []interface{}:
+		picked := make([]interface{}, len(value))
+		for i, item := range value {
+			picked[i] = pickFields(item, fields, prefix)
+		}
+		return picked
+	case map[string]interface{}:
+		picked := map[string]interface{}{}
+		for key, item := range value {
+			path := prefix + key
+			if fields[path] {
+				picked[key] = item
+				continue
+			}
+			for field := range fields {
+				if strings.HasPrefix(field, path+".") {
+					picked[key] = pickFields(item, fields, path+".")
+					break
+				}
+			}
+		}
+		return picked
+	}
+	return data
+}
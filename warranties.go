@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+type Warranty struct {
+	gorm.Model
+	EquipmentID       uint             `gorm:"type:int(10);index;not null" validate:"required"`
+	Equipment         *Equipment       `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:",omitempty"`
+	ServiceProviderID *uint            `gorm:"type:int(10);index;default:NULL"`
+	ServiceProvider   *ServiceProvider `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:",omitempty"`
+	ProviderName      string           `gorm:"type:varchar(255)" validate:"max=255"`
+	ReferenceNumber   string           `gorm:"type:varchar(255)" validate:"max=255"`
+	CoverageScope     string           `gorm:"type:ENUM('parts','labour','parts_and_labour','full');not null;default:'full';column:coverage_scope" validate:"omitempty,oneof=parts labour parts_and_labour full"`
+	Terms             string           `gorm:"type:varchar(1000)" validate:"max=1000"`
+	StartDate         time.Time        `gorm:"type:date;not null" validate:"required"`
+	ExpiryDate        time.Time        `gorm:"type:date;not null;index" validate:"required,gtfield=StartDate"`
+	NotifyDaysBefore  int              `gorm:"type:int(10);not null;default:0" validate:"gte=0"`
+	ExpiryNotifiedAt  *time.Time       `gorm:"default:NULL"`
+}
+
+// activeWarranty returns the warranty covering the equipment on the given
+// day, preferring the one that expires last.
+func activeWarranty(equipmentID uint, on time.Time) (*Warranty, error) {
+	var warranty Warranty
+	result := db.Where("equipment_id = ? AND start_date <= ? AND expiry_date >= ?", equipmentID, on, on).
+		Order("expiry_date DESC").
+		Limit(1).
+		Find(&warranty)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &warranty, nil
+}
+
+// notifyExpiringWarranties warns every user of the owning company once when a
+// warranty enters its notice window. The window is the warranty's own
+// NotifyDaysBefore, or WARRANTY_NOTICE_DAYS when that is not set.
+func notifyExpiringWarranties() error {
+	defaultDays := envInt("WARRANTY_NOTICE_DAYS", 30)
+	today := time.Now().Truncate(24 * time.Hour)
+
+	var warranties []Warranty
+	result := db.Preload("Equipment").
+		Where("expiry_notified_at IS NULL AND expiry_date >= ?", today).
+		Where("expiry_date <= DATE_ADD(?, INTERVAL IF(notify_days_before > 0, notify_days_before, ?) DAY)", today, defaultDays).
+		Find(&warranties)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	for _, warranty := range warranties {
+		if warranty.Equipment == nil {
+			continue
+		}
+		var users []User
+		if result := db.Where("company_id = ?", warranty.Equipment.CompanyID).Find(&users); result.Error != nil {
+			return result.Error
+		}
+
+		message := fmt.Sprintf("Warranty %s of %s expires on %s",
+			warranty.ReferenceNumber, warranty.Equipment.Name, warranty.ExpiryDate.Format("2006-01-02"))
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for _, user := range users {
+				notification := Notification{
+					UserID:           user.ID,
+					RelatedID:        warranty.ID,
+					RelatedType:      "warranties",
+					NotificationType: "warranty_expiry",
+					Message:          &message,
+					Status:           "Unread",
+				}
+				if result := tx.Create(&notification); result.Error != nil {
+					return result.Error
+				}
+			}
+			return tx.Model(&warranty).UpdateColumn("expiry_notified_at", time.Now()).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flagWarrantyCoverage marks work on the equipment as possibly covered when a
+// warranty is active on the given day and returns the warranty's provider as
+// the suggested one.
+func flagWarrantyCoverage(equipmentID uint, on time.Time) (warrantyID *uint, providerID *uint, err error) {
+	warranty, err := activeWarranty(equipmentID, on)
+	if err != nil || warranty == nil {
+		return nil, nil, err
+	}
+	return &warranty.ID, warranty.ServiceProviderID, nil
+}
+
+func warrantyCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if Create(w, r, WarrantiesTable) {
+		fmt.Println("warranty created")
+		return
+	}
+	fmt.Println("warranty not created")
+	return
+}
+
+func warrantyReadHandler(w http.ResponseWriter, r *http.Request) {
+	if Read(w, r, WarrantiesTable) {
+		fmt.Println("warranties read")
+		return
+	}
+	fmt.Println("warranties not read")
+	return
+}
+
+func warrantyReadOneHandler(w http.ResponseWriter, r *http.Request) {
+	if ReadOne(w, r, WarrantiesTable) {
+		fmt.Println("warranty read")
+		return
+	}
+	fmt.Println("warranty not read")
+	return
+}
+
+func warrantyUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if Update(w, r, WarrantiesTable) {
+		fmt.Println("warranty updated")
+		return
+	}
+	fmt.Println("warranty not updated")
+	return
+}
+
+func warrantyDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if Delete(w, r, WarrantiesTable) {
+		fmt.Println("warranty deleted")
+		return
+	}
+	fmt.Println("warranty not deleted")
+	return
+}
+
+func equipmentWarrantiesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		responseWithError(w, r, err)
+		return
+	}
+	var data []Warranty
+	result := db.Where("equipment_id = ?", id).Order("expiry_date DESC").Find(&data)
+	if result.Error != nil {
+		responseWithError(w, r, result.Error)
+		return
+	}
+
+	responseWithJSON(w, http.StatusOK, data, "equipment warranties read")
+	return
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Instants are stored in UTC. Requests may send them either with an offset
+// (RFC 3339) or as a local wall time, which is then read in the zone of the
+// company owning the equipment. Responses are rendered in that same zone,
+// unless the caller asks for another one with ?tz= or ?user_id=.
+
+var localTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func loadZone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, withStatus(http.StatusBadRequest, fmt.Errorf("unknown time zone %s", name))
+	}
+	return loc, nil
+}
+
+type zoneResolver struct {
+	override  *time.Location
+	companies map[uint]*time.Location
+	equipment map[uint]*time.Location
+}
+
+func newZones() *zoneResolver {
+	return &zoneResolver{companies: map[uint]*time.Location{}, equipment: map[uint]*time.Location{}}
+}
+
+// newZoneResolver reads the display zone a request asks for: an explicit
+// ?tz=, or the zone of the user given by ?user_id=, falling back to their
+// company's.
+func newZoneResolver(r *http.Request) (*zoneResolver, error) {
+	z := newZones()
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		loc, err := loadZone(tz)
+		if err != nil {
+			return nil, err
+		}
+		z.override = loc
+		return z, nil
+	}
+	if raw := r.URL.Query().Get("user_id"); raw != "" {
+		id, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return nil, &HTTPError{Status: http.StatusBadRequest, Field: "user_id", Err: errors.New("user_id must be a number")}
+		}
+		var user User
+		if result := db.Select("id", "company_id", "timezone").First(&user, id); result.Error != nil {
+			return nil, result.Error
+		}
+		if user.Timezone != "" {
+			z.override, err = loadZone(user.Timezone)
+			return z, err
+		}
+		z.override = z.company(user.CompanyID)
+	}
+	return z, nil
+}
+
+// forUser returns the user's own zone, or their company's.
+func (z *zoneResolver) forUser(user User) *time.Location {
+	if user.Timezone != "" {
+		if loc, err := loadZone(user.Timezone); err == nil {
+			return loc
+		}
+	}
+	return z.company(user.CompanyID)
+}
+
+func (z *zoneResolver) company(id uint) *time.Location {
+	if loc, ok := z.companies[id]; ok {
+		return loc
+	}
+	var company Company
+	loc := time.UTC
+	if db.Select("id", "timezone").First(&company, id).Error == nil {
+		if l, err := loadZone(company.Timezone); err == nil {
+			loc = l
+		}
+	}
+	z.companies[id] = loc
+	return loc
+}
+
+// forEquipment returns the zone instants of the equipment are shown in.
+func (z *zoneResolver) forEquipment(id uint) *time.Location {
+	if z.override != nil {
+		return z.override
+	}
+	return z.ownerOf(id)
+}
+
+// ownerOf returns the zone of the company owning the equipment, which is the
+// zone local wall times sent for it are read in.
+func (z *zoneResolver) ownerOf(id uint) *time.Location {
+	if loc, ok := z.equipment[id]; ok {
+		return loc
+	}
+	var equipment Equipment
+	loc := time.UTC
+	if db.Select("id", "company_id").First(&equipment, id).Error == nil {
+		loc = z.company(equipment.CompanyID)
+	}
+	z.equipment[id] = loc
+	return loc
+}
+
+// parseLocalTime accepts an RFC 3339 time or a wall time read in loc.
+func parseLocalTime(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range localTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("must be an RFC 3339 time or a local time like 2006-01-02T15:04")
+}
+
+// rangeParams reads the from and to query parameters, defaulting to the
+// given number of days starting today.
+func rangeParams(r *http.Request, loc *time.Location, days int) (time.Time, time.Time, error) {
+	now := time.Now().In(loc)
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	to := from.AddDate(0, 0, days)
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = parseLocalTime(v, loc); err != nil {
+			return from, to, &HTTPError{Status: http.StatusBadRequest, Field: "from", Err: fmt.Errorf("from %s", err.Error())}
+		}
+		if r.URL.Query().Get("to") == "" {
+			to = from.AddDate(0, 0, days)
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = parseLocalTime(v, loc); err != nil {
+			return from, to, &HTTPError{Status: http.StatusBadRequest, Field: "to", Err: fmt.Errorf("to %s", err.Error())}
+		}
+	}
+	if !to.After(from) {
+		return from, to, &HTTPError{Status: http.StatusBadRequest, Field: "to", Err: errors.New("to must be after from")}
+	}
+	return from, to, nil
+}
+
+// localizeBody rewrites the named fields of a JSON object that hold local
+// wall times into RFC 3339 instants in loc, so they decode into time.Time.
+// Values that already carry an offset are left alone.
+func localizeBody(body []byte, loc *time.Location, fields ...string) ([]byte, error) {
+	var object map[string]interface{}
+	if err := decodeJSON(body, &object); err != nil {
+		return nil, err
+	}
+	changed, err := localizeObject(object, loc, fields...)
+	if err != nil || !changed {
+		return body, err
+	}
+	return json.Marshal(object)
+}
+
+func localizeObject(object map[string]interface{}, loc *time.Location, fields ...string) (bool, error) {
+	changed := false
+	for _, field := range fields {
+		value, ok := object[field].(string)
+		if !ok {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			continue
+		}
+		t, err := parseLocalTime(value, loc)
+		if err != nil {
+			return false, &HTTPError{Status: http.StatusBadRequest, Field: field, Err: fmt.Errorf("%s %s", field, err.Error())}
+		}
+		object[field] = t.Format(time.RFC3339Nano)
+		changed = true
+	}
+	return changed, nil
+}
+
+// equipmentIDInBody peeks at the EquipmentID of a request body so local
+// times can be resolved before the body is decoded.
+func equipmentIDInBody(body []byte, fallback uint) uint {
+	var peek struct{ EquipmentID uint }
+	if json.Unmarshal(body, &peek) == nil && peek.EquipmentID != 0 {
+		return peek.EquipmentID
+	}
+	return fallback
+}